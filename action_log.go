@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/danielstutzman/todomvc-backend-go/handlers"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+	"os"
+)
+
+const actionLogUsage = "Usage: todomvc-backend-go (model flags) " +
+	"[-conflict_policy POLICY] action-log dump|rebuild"
+
+// mustRunActionLogCommand handles `action-log dump`, which prints every action
+// event as a line of JSON, and `action-log rebuild`, which replaces the todos
+// with the result of replaying them
+func mustRunActionLogCommand(model models.Model, config handlers.Config,
+	subcommandArgs []string) {
+	if len(subcommandArgs) != 1 {
+		log.Fatal(actionLogUsage)
+	}
+	ctx := context.Background()
+
+	switch subcommandArgs[0] {
+	case "dump":
+		events, err := model.ListActionEvents(ctx)
+		if err != nil {
+			log.Fatalf("Error from ListActionEvents: %s", err)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				log.Fatalf("Error from Encode: %s", err)
+			}
+		}
+	case "rebuild":
+		if err := handlers.RebuildTodos(ctx, model, config); err != nil {
+			log.Fatalf("Error from RebuildTodos: %s", err)
+		}
+	default:
+		log.Fatal(actionLogUsage)
+	}
+}
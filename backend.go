@@ -2,17 +2,31 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/handlers"
 	"github.com/danielstutzman/todomvc-backend-go/models"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 type CommandLineArgs struct {
 	postgresCredentialsPath string
 	socketPath              string
 	inMemoryDb              bool
+	dataDir                 string
+	snapshotInterval        time.Duration
+	sqlitePath              string
+	requestTimeout          time.Duration
+	conflictPolicyName      string
+	testMode                bool
+	adminCredentialsPath    string
+	socketIdleTimeout       time.Duration
+	socketMaxLineBytes      int
+	maxWait                 time.Duration
 }
 
 func mustParseFlags() CommandLineArgs {
@@ -23,6 +37,30 @@ func mustParseFlags() CommandLineArgs {
 		"Path for UNIX socket server for testing")
 	flag.BoolVar(&args.inMemoryDb, "in_memory_db", false,
 		"Store data in memory instead of PostgreSQL for faster testing")
+	flag.StringVar(&args.dataDir, "data_dir", "",
+		"With -in_memory_db, keep a snapshot and write-ahead log of the data "+
+			"in this directory, and recover from them at startup")
+	flag.DurationVar(&args.snapshotInterval, "snapshot_interval", time.Minute,
+		"With -data_dir, how often to snapshot the data")
+	flag.StringVar(&args.sqlitePath, "sqlite_path", "",
+		"SQLite database file to store data in instead of PostgreSQL; "+
+			"created if it doesn't exist")
+	flag.DurationVar(&args.requestTimeout, "request_timeout", 10*time.Second,
+		"Give up on a sync request if it takes longer than this")
+	flag.StringVar(&args.conflictPolicyName, "conflict_policy", "last_writer_wins",
+		"How to handle updates made from an old version of a todo: "+
+			strings.Join(handlers.ConflictPolicyNames(), ", "))
+	flag.BoolVar(&args.testMode, "test_mode", false,
+		"Let clients wipe all data with resetModel; never use in production")
+	flag.StringVar(&args.adminCredentialsPath, "admin_credentials_path", "",
+		"JSON file mapping each admin's name to the SHA-256 (in hex) of their "+
+			"token, for POST /admin/reset")
+	flag.DurationVar(&args.socketIdleTimeout, "socket_idle_timeout", 5*time.Minute,
+		"Close socket connections that send nothing for this long")
+	flag.IntVar(&args.socketMaxLineBytes, "socket_max_line_bytes", 1024*1024,
+		"Reject socket requests longer than this")
+	flag.DurationVar(&args.maxWait, "max_wait", handlers.DefaultMaxWait,
+		"Longest a sync request may wait for changes with waitMillis")
 	flag.Parse()
 	return args
 }
@@ -42,25 +80,132 @@ func readPostgresCredentials(path string) models.PostgresCredentials {
 	return creds
 }
 
+func readAdminCredentials(path string) map[string]string {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(fmt.Errorf("Couldn't os.Open admin_credentials: %s", err))
+	}
+	defer file.Close()
+
+	adminNameToTokenHash := map[string]string{}
+	decoder := json.NewDecoder(file)
+	if err = decoder.Decode(&adminNameToTokenHash); err != nil {
+		log.Fatalf("Error using decoder.Decode to parse JSON at %s: %s", path, err)
+	}
+	return adminNameToTokenHash
+}
+
 func main() {
 	args := mustParseFlags()
+	if flag.Arg(0) == "migrate" {
+		mustRunMigrateCommand(args, flag.Args()[1:])
+		return
+	}
+
+	model, closeModel := mustOpenModel(args)
+	defer closeModel()
+	config := mustMakeConfig(args)
+	if flag.Arg(0) == "action-log" {
+		mustRunActionLogCommand(model, config, flag.Args()[1:])
+		return
+	}
+	if args.postgresCredentialsPath != "" {
+		closeListener := mustListenForChanges(args, config.Hub)
+		defer closeListener()
+	}
+
+	if args.socketPath != "" {
+		mustRunSocketServer(args.socketPath, model, config, args.requestTimeout,
+			args.socketIdleTimeout, args.socketMaxLineBytes)
+	} else {
+		mustRunWebServer(model, config, args.requestTimeout)
+	}
+}
+
+// mustOpenModel returns the model chosen by the flags, and a function to call
+// when done with it
+func mustOpenModel(args CommandLineArgs) (models.Model, func()) {
+	if args.dataDir != "" && !args.inMemoryDb {
+		log.Fatal("-data_dir only works with -in_memory_db")
+	}
 
-	var model models.Model
 	if args.postgresCredentialsPath != "" {
 		creds := readPostgresCredentials(args.postgresCredentialsPath)
-		model = models.NewDbModel(models.MustOpenPostgres(creds))
-	} else if args.inMemoryDb {
-		model = &models.MemoryModel{
-			NextDeviceId: 1,
-			Devices:      []models.Device{},
+		db := models.MustOpenPostgres(creds)
+		return models.NewDbModel(db), func() { db.Close() }
+	} else if args.sqlitePath != "" {
+		sqliteModel, err := models.OpenSqliteModel(args.sqlitePath)
+		if errors.Is(err, models.ErrSchemaOutOfDate) {
+			log.Fatalf("Error from OpenSqliteModel: %s (run the migrate up command)",
+				err)
+		} else if err != nil {
+			log.Fatalf("Error from OpenSqliteModel: %s", err)
+		}
+		return sqliteModel, func() { sqliteModel.Close() }
+	} else if args.inMemoryDb && args.dataDir != "" {
+		memoryModel, err := models.OpenPersistentMemoryModel(args.dataDir)
+		if err != nil {
+			log.Fatalf("Error from OpenPersistentMemoryModel: %s", err)
+		}
+		go snapshotPeriodically(memoryModel, args.snapshotInterval)
+		return memoryModel, func() {
+			if err := memoryModel.Close(); err != nil {
+				log.Printf("Error from Close: %s", err)
+			}
 		}
+	} else if args.inMemoryDb {
+		return models.NewMemoryModel(), func() {}
 	} else {
-		log.Fatal("Supply either -postgres_credentials_path or -in_memory_db")
+		log.Fatal("Supply -postgres_credentials_path, -sqlite_path or -in_memory_db")
+		return nil, nil
 	}
+}
 
-	if args.socketPath != "" {
-		mustRunSocketServer(args.socketPath, model)
-	} else {
-		mustRunWebServer(model)
+// mustListenForChanges passes the pushes from other processes using the same
+// database to the hub, and returns a function to call when done
+func mustListenForChanges(args CommandLineArgs, hub *handlers.Hub) func() {
+	creds := readPostgresCredentials(args.postgresCredentialsPath)
+	listener, err := models.ListenForChanges(creds, func(payload string) {
+		if err := hub.PublishNotification(payload); err != nil {
+			log.Printf("Error from PublishNotification: %s", err)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Error from ListenForChanges: %s", err)
+	}
+	return func() {
+		if err := listener.Close(); err != nil {
+			log.Printf("Error from Close: %s", err)
+		}
+	}
+}
+
+func mustMakeConfig(args CommandLineArgs) handlers.Config {
+	conflictPolicy, err := handlers.ConflictPolicyByName(args.conflictPolicyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := handlers.Config{
+		ConflictPolicy: conflictPolicy,
+		TestMode:       args.testMode,
+		Hub:            handlers.NewHub(),
+		MaxWait:        args.maxWait,
+	}
+	if args.testMode {
+		log.Printf("Running in test mode: clients may wipe all data")
+	}
+	if args.adminCredentialsPath != "" {
+		config.AdminNameToTokenHash = readAdminCredentials(args.adminCredentialsPath)
+	}
+	return config
+}
+
+// snapshotPeriodically keeps the write-ahead log short, so recovering at
+// startup doesn't take long
+func snapshotPeriodically(model *models.MemoryModel, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := model.Snapshot(); err != nil {
+			log.Printf("Error from Snapshot: %s", err)
+		}
 	}
 }
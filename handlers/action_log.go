@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+)
+
+// RebuildTodos replaces every todo with the result of replaying the action
+// log, e.g. after fixing a bug that left them wrong.  Use the ConflictPolicy
+// the actions were applied with.  If a replayed action's output differs from
+// the logged one, the log and the todos disagree about what happened, so it
+// fails without changing anything.
+func RebuildTodos(ctx context.Context, model models.Model, config Config) error {
+	err := model.WithTx(ctx, func(tx models.Model) error {
+		// No actions may be logged between reading the log and replacing the
+		// todos
+		if err := tx.LockForWrite(ctx); err != nil {
+			return fmt.Errorf("Error from LockForWrite: %w", err)
+		}
+		events, err := tx.ListActionEvents(ctx)
+		if err != nil {
+			return fmt.Errorf("Error from ListActionEvents: %w", err)
+		}
+		projection, err := projectTodos(ctx, events, config)
+		if err != nil {
+			return err
+		}
+		if err := tx.ReplaceTodos(ctx, projection.Todos,
+			projection.DeletedTodos); err != nil {
+			return fmt.Errorf("Error from ReplaceTodos: %w", err)
+		}
+		log.Printf("Rebuilt %d todos from %d action events", len(projection.Todos),
+			len(events))
+		return nil
+	})
+	return err
+}
+
+// projectTodos replays events, in order, into a new MemoryModel.  Actions on
+// shared lists were logged with the owner's UserId, so they replay without
+// the memberships.
+func projectTodos(ctx context.Context, events []models.ActionEvent,
+	config Config) (*models.MemoryModel, error) {
+	projection := models.NewMemoryModel()
+	for _, event := range events {
+		if membershipActionTypes[event.Action.Type] {
+			continue
+		} else if event.Action.Type == "TODOS/ADD_TODO" {
+			// Ids skipped by rolled-back transactions aren't in the log, so give
+			// the todo its original id
+			projection.NextTodoId = event.TodoId
+		} else if event.Action.Type == "LISTS/ADD_LIST" {
+			projection.NextTodoListId = event.Output
+		}
+		output, err := handleActionToSync(ctx, event.Action, projection, config,
+			actionSource{
+				UserId:     event.UserId,
+				DeviceId:   event.DeviceId,
+				ServerTime: event.ServerTime,
+			}, event.TodoId, map[int]ConflictOutcome{})
+		if err != nil {
+			return nil, fmt.Errorf("Error replaying action event %d: %w",
+				event.Id, err)
+		}
+		if output != event.Output {
+			return nil, fmt.Errorf("Replaying action event %d gave output %d, "+
+				"but it was logged with %d", event.Id, output, event.Output)
+		}
+	}
+	return projection, nil
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHandleBodyLogsActionEvents(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	body := Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{
+			{
+				Id:              1,
+				Type:            "TODOS/ADD_TODO",
+				TodoIdMaybeTemp: -1,
+				Title:           stringPtr("title1"),
+				Completed:       boolPtr(false),
+			}, {
+				Id:              2,
+				Type:            "TODO/UPDATE_TODO",
+				TodoIdMaybeTemp: -1,
+				Completed:       boolPtr(true),
+			}, {
+				Id:              3,
+				Type:            "TODO/UPDATE_TODO",
+				TodoIdMaybeTemp: 99,
+				Completed:       boolPtr(true),
+			},
+		},
+	}
+	_, err := HandleBody(context.Background(), body, model, Config{})
+	assert.Equal(t, nil, err)
+	// Actions already applied aren't logged again
+	_, err = HandleBody(context.Background(), body, model, Config{})
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, 3, len(model.ActionEvents))
+	for i, event := range model.ActionEvents {
+		assert.Equal(t, i+1, event.Id)
+		assert.Equal(t, 1, event.UserId)
+		assert.Equal(t, 1, event.DeviceId)
+		assert.Equal(t, body.ActionsToSync[i], event.Action)
+		assert.Equal(t, false, event.ServerTime.IsZero())
+	}
+	assert.Equal(t, 1, model.ActionEvents[0].TodoId)
+	assert.Equal(t, 1, model.ActionEvents[0].Output)
+	assert.Equal(t, 1, model.ActionEvents[1].TodoId)
+	assert.Equal(t, 1, model.ActionEvents[1].Output)
+	assert.Equal(t, 99, model.ActionEvents[2].TodoId)
+	assert.Equal(t, 0, model.ActionEvents[2].Output)
+}
+
+func TestRebuildTodos(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	tokenC := mustRegister(t, model, "C", "V", "")
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+				Title: stringPtr("first"), Completed: boolPtr(false)},
+			{Id: 2, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -2,
+				Title: stringPtr("second"), Completed: boolPtr(false)},
+		},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+
+	// As if a rolled-back transaction used up some ids
+	model.NextTodoId += 5
+	_, err = HandleBody(context.Background(), Body{
+		DeviceUid: "C",
+		Token:     tokenC,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+				Title: stringPtr("other user's"), Completed: boolPtr(false)},
+		},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+
+	// B's update conflicts with A's
+	_, err = HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 3, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+				Title: stringPtr("first by A"), BaseVersion: intPtr(1)},
+			{Id: 4, Type: "TODOS/DELETE_TODO", TodoIdMaybeTemp: 2},
+		},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	_, err = HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 1, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+				Title: stringPtr("first by B"), Completed: boolPtr(true),
+				BaseVersion: intPtr(1)},
+		},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+
+	expectedTodos := []models.Todo{}
+	for _, todo := range model.Todos {
+		todo.Revision = 7
+		todo.CreatedRevision = 7
+		expectedTodos = append(expectedTodos, todo)
+	}
+	model.Todos[0].Title = "corrupted"
+	model.Todos = model.Todos[1:]
+
+	assert.Equal(t, nil, RebuildTodos(context.Background(), model, Config{}))
+	assert.Equal(t, expectedTodos, model.Todos)
+	assert.Equal(t, []models.DeletedTodo{{Id: 2, UserId: 1, Revision: 7}},
+		model.DeletedTodos)
+	assert.Equal(t, 9, model.NextTodoId)
+}
+
+func TestRebuildTodosRefusesInconsistentLog(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+				Title: stringPtr("first"), Completed: boolPtr(false)},
+		},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	model.ActionEvents = append(model.ActionEvents, models.ActionEvent{
+		Id:       2,
+		UserId:   1,
+		DeviceId: 1,
+		TodoId:   1,
+		Action: models.ActionToSync{Id: 2, Type: "TODOS/DELETE_TODO",
+			TodoIdMaybeTemp: 1},
+		Output: 0,
+	})
+	todos := model.Todos
+
+	err = RebuildTodos(context.Background(), model, Config{})
+	assert.EqualError(t, err,
+		"Replaying action event 2 gave output 1, but it was logged with 0")
+	assert.Equal(t, todos, model.Todos)
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+	"time"
+)
+
+// AdminResetModel deletes everything in the model on behalf of the admin
+// whose token it is, and records who did it.  Unlike Body.ResetModel, it
+// works outside of test mode.  Every device with a push session is then told
+// to sync, and finds out it's gone.
+func AdminResetModel(ctx context.Context, token string, model models.Model,
+	config Config) (models.ResetRecord, error) {
+	adminName, err := findAdminByToken(token, config)
+	if err != nil {
+		return models.ResetRecord{}, err
+	}
+
+	var record models.ResetRecord
+	err = model.WithTx(ctx, func(tx models.Model) error {
+		if err := tx.Reset(ctx); err != nil {
+			return fmt.Errorf("Error from Reset: %w", err)
+		}
+		record, err = tx.CreateResetRecord(ctx, adminName, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("Error from CreateResetRecord: %w", err)
+		}
+		if config.Hub != nil {
+			if err := config.Hub.notify(ctx, tx, Push{}, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return models.ResetRecord{}, err
+	}
+	if config.Hub != nil {
+		config.Hub.publish(Push{}, true)
+	}
+	log.Printf("Admin %s reset the model", adminName)
+	return record, nil
+}
+
+func findAdminByToken(token string, config Config) (string, error) {
+	if token == "" {
+		return "", fmt.Errorf("%w: Blank admin token", ErrUnauthorized)
+	}
+	tokenHash := []byte(hashToken(token))
+	for adminName, adminTokenHash := range config.AdminNameToTokenHash {
+		if subtle.ConstantTimeCompare(tokenHash, []byte(adminTokenHash)) == 1 {
+			return adminName, nil
+		}
+	}
+	return "", fmt.Errorf("%w: Unknown admin token", ErrUnauthorized)
+}
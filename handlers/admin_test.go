@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestResetModelRefusedOutsideTestMode(t *testing.T) {
+	model := models.NewMemoryModel()
+	mustRegister(t, model, "A", "U", "")
+
+	_, err := HandleBody(context.Background(), Body{
+		ResetModel: true,
+		DeviceUid:  "B",
+		UserUid:    "V",
+		Register:   true,
+	}, model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrForbidden))
+	assert.Equal(t, http.StatusForbidden, StatusCodeForError(err))
+	assert.Equal(t, 1, len(model.Devices))
+	assert.Equal(t, "A", model.Devices[0].Uid)
+}
+
+func TestResetModelInTestMode(t *testing.T) {
+	model := models.NewMemoryModel()
+	mustRegister(t, model, "A", "U", "")
+
+	_, err := HandleBody(context.Background(), Body{
+		ResetModel: true,
+		DeviceUid:  "B",
+		UserUid:    "V",
+		Register:   true,
+	}, model, Config{TestMode: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(model.Devices))
+	assert.Equal(t, "B", model.Devices[0].Uid)
+}
+
+func TestAdminResetModel(t *testing.T) {
+	model := models.NewMemoryModel()
+	mustRegister(t, model, "A", "U", "")
+	config := Config{
+		AdminNameToTokenHash: map[string]string{"dan": hashToken("admin secret")},
+	}
+
+	_, err := AdminResetModel(context.Background(), "guessed", model, config)
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+	_, err = AdminResetModel(context.Background(), "", model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+	assert.Equal(t, 1, len(model.Devices))
+	assert.Equal(t, []models.ResetRecord{}, model.ResetRecords)
+
+	record, err := AdminResetModel(context.Background(), "admin secret", model,
+		config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "dan", record.AdminName)
+	assert.Equal(t, []models.Device{}, model.Devices)
+	assert.Equal(t, []models.ResetRecord{record}, model.ResetRecords)
+}
+
+func TestAdminResetModelTellsEveryoneToSync(t *testing.T) {
+	model := notifyingModel{MemoryModel: models.NewMemoryModel(),
+		payloads: &[]string{}}
+	mustRegister(t, model, "A", "U", "")
+	hub, otherHub := NewHub(), NewHub()
+	config := Config{
+		AdminNameToTokenHash: map[string]string{"dan": hashToken("admin secret")},
+		Hub:                  hub,
+	}
+	here := hub.Subscribe(1, 1)
+	there := otherHub.Subscribe(1, 1)
+
+	_, err := AdminResetModel(context.Background(), "admin secret", model,
+		config)
+	assert.Equal(t, nil, err)
+	<-here.C
+	assert.Equal(t, 1, len(*model.payloads))
+	assert.Equal(t, nil, otherHub.PublishNotification((*model.payloads)[0]))
+	<-there.C
+}
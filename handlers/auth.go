@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"time"
+)
+
+// Tokens are only stored hashed, so a leaked devices table can't be used to
+// sync as somebody's device.  They're random enough that a fast hash is fine.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("Error from rand.Read: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// authenticateDevice returns the device that body.Token belongs to, first
+// registering it if body.Register, then rotates or revokes tokens as the body
+// asks.  It also returns the device's new token, if it issued one.
+func authenticateDevice(ctx context.Context, body Body,
+	model models.Model) (models.Device, string, error) {
+	if body.Register {
+		return registerDevice(ctx, body, model)
+	}
+
+	var device models.Device
+	var err error
+	if body.tokenHash != "" {
+		device, err = findDeviceByTokenHash(ctx, body.tokenHash, model)
+	} else {
+		device, err = findDeviceByToken(ctx, body.Token, model)
+	}
+	if err != nil {
+		return models.Device{}, "", err
+	}
+	if device.Uid != body.DeviceUid {
+		return models.Device{}, "", fmt.Errorf("%w: Token isn't for device %s",
+			ErrUnauthorized, body.DeviceUid)
+	}
+	if body.UserUid != "" {
+		user, err := model.FindUserByUid(ctx, body.UserUid)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return models.Device{}, "", fmt.Errorf("Error from FindUserByUid: %w", err)
+		}
+		if err != nil || user.Id != device.UserId {
+			return models.Device{}, "", fmt.Errorf("%w: Device %s belongs to another user",
+				ErrForbidden, body.DeviceUid)
+		}
+	}
+
+	var token string
+	if body.RotateToken {
+		token, err = newToken()
+		if err != nil {
+			return models.Device{}, "", err
+		}
+		device.TokenHash = hashToken(token)
+		if err := model.UpdateDeviceTokenHash(ctx, device.Id,
+			device.TokenHash); err != nil {
+			return models.Device{}, "", fmt.Errorf("Error from UpdateDeviceTokenHash: %w", err)
+		}
+	}
+	if body.RevokeDeviceUid != "" {
+		if err := revokeToken(ctx, body.RevokeDeviceUid, device, model); err != nil {
+			return models.Device{}, "", err
+		}
+	}
+	return device, token, nil
+}
+
+// registerDevice creates the device for body.UserUid with a new token.  A
+// user who already exists must vouch for the new device with the token of one
+// of their other devices; otherwise knowing their uid would be enough to read
+// their todos.
+func registerDevice(ctx context.Context, body Body,
+	model models.Model) (models.Device, string, error) {
+	if body.UserUid == "" {
+		return models.Device{}, "", fmt.Errorf("Blank UserUid for new device")
+	}
+
+	user, err := model.FindUserByUid(ctx, body.UserUid)
+	if errors.Is(err, models.ErrNotFound) {
+		user, err = model.CreateUser(ctx, body.UserUid)
+		if err != nil {
+			return models.Device{}, "", fmt.Errorf("Error from CreateUser: %w", err)
+		}
+	} else if err != nil {
+		return models.Device{}, "", fmt.Errorf("Error from FindUserByUid: %w", err)
+	} else {
+		vouchingDevice, err := findDeviceByToken(ctx, body.Token, model)
+		if err != nil {
+			return models.Device{}, "",
+				fmt.Errorf("Registering another device for user %s: %w", body.UserUid, err)
+		}
+		if vouchingDevice.UserId != user.Id {
+			return models.Device{}, "", fmt.Errorf("%w: Token belongs to another user",
+				ErrForbidden)
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return models.Device{}, "", err
+	}
+	device, err := model.CreateDevice(ctx, body.DeviceUid, user.Id,
+		hashToken(token))
+	if err != nil {
+		return models.Device{}, "", fmt.Errorf("Error from CreateDevice: %w", err)
+	}
+	return device, token, nil
+}
+
+func findDeviceByToken(ctx context.Context, token string,
+	model models.Model) (models.Device, error) {
+	if token == "" {
+		return models.Device{}, fmt.Errorf("%w: Blank token", ErrUnauthorized)
+	}
+	return findDeviceByTokenHash(ctx, hashToken(token), model)
+}
+
+func findDeviceByTokenHash(ctx context.Context, tokenHash string,
+	model models.Model) (models.Device, error) {
+	device, err := model.FindDeviceByTokenHash(ctx, tokenHash)
+	if errors.Is(err, models.ErrNotFound) {
+		return models.Device{}, fmt.Errorf("%w: Unknown or revoked token",
+			ErrUnauthorized)
+	} else if err != nil {
+		return models.Device{}, fmt.Errorf("Error from FindDeviceByTokenHash: %w", err)
+	}
+	return device, nil
+}
+
+// revokeToken revokes the token of the device deviceUid, which must belong
+// to the same user as device.  Other users' devices are treated as missing.
+func revokeToken(ctx context.Context, deviceUid string, device models.Device,
+	model models.Model) error {
+	revokedDevice, err := model.FindDeviceByUid(ctx, deviceUid)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		return fmt.Errorf("Error from FindDeviceByUid: %w", err)
+	}
+	if err != nil || revokedDevice.UserId != device.UserId {
+		return fmt.Errorf("%w: No device with uid=%s", models.ErrNotFound, deviceUid)
+	}
+
+	if err := model.UpdateDeviceTokenHash(ctx, revokedDevice.Id, ""); err != nil {
+		return fmt.Errorf("Error from UpdateDeviceTokenHash: %w", err)
+	}
+	return nil
+}
+
+// StreamTokenTtl is how long a token from IssueStreamToken can be used
+const StreamTokenTtl = time.Minute
+
+// IssueStreamToken authenticates the body's device, which can't ask for
+// anything else, and returns a token that opens one push session for it
+// within StreamTokenTtl.  Unlike the device's token, it can go in a URL,
+// which may be logged, e.g. for an EventSource, which can't set headers.
+func IssueStreamToken(ctx context.Context, body Body,
+	model models.Model) (string, error) {
+	if !onlySyncs(body) || body.Cursor != nil || body.HistoryTodoId != 0 {
+		return "", fmt.Errorf("Stream token body can only have deviceUid, " +
+			"userUid and token")
+	}
+	streamToken, err := newToken()
+	if err != nil {
+		return "", err
+	}
+	err = model.WithTx(ctx, func(tx models.Model) error {
+		device, _, err := authenticateDevice(ctx, body, tx)
+		if err != nil {
+			return err
+		}
+		if err := tx.CreateStreamToken(ctx, models.StreamToken{
+			TokenHash: hashToken(streamToken),
+			DeviceId:  device.Id,
+			IssuedAt:  time.Now().UTC(),
+		}); err != nil {
+			return fmt.Errorf("Error from CreateStreamToken: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return streamToken, nil
+}
+
+// StreamTokenBody uses up a token from IssueStreamToken, and returns a body
+// for StartPushSession that syncs as the device until its own token is
+// rotated or revoked
+func StreamTokenBody(ctx context.Context, deviceUid string,
+	streamToken string, model models.Model) (Body, error) {
+	var body Body
+	err := model.WithTx(ctx, func(tx models.Model) error {
+		taken, err := tx.TakeStreamToken(ctx, hashToken(streamToken))
+		if errors.Is(err, models.ErrNotFound) {
+			return fmt.Errorf("%w: Unknown or used stream token", ErrUnauthorized)
+		} else if err != nil {
+			return fmt.Errorf("Error from TakeStreamToken: %w", err)
+		}
+		if time.Since(taken.IssuedAt) > StreamTokenTtl {
+			return fmt.Errorf("%w: Expired stream token", ErrUnauthorized)
+		}
+
+		device, err := tx.FindDeviceByUid(ctx, deviceUid)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return fmt.Errorf("Error from FindDeviceByUid: %w", err)
+		}
+		if err != nil || device.Id != taken.DeviceId {
+			return fmt.Errorf("%w: Stream token isn't for device %s",
+				ErrUnauthorized, deviceUid)
+		}
+		body = Body{DeviceUid: deviceUid, tokenHash: device.TokenHash}
+		return nil
+	})
+	if err != nil {
+		return Body{}, err
+	}
+	return body, nil
+}
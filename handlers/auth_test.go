@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncNeedsToken(t *testing.T) {
+	model := models.NewMemoryModel()
+	mustRegister(t, model, "A", "U", "")
+
+	_, err := HandleBody(context.Background(), Body{DeviceUid: "A"}, model,
+		Config{})
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+	assert.Equal(t, http.StatusUnauthorized, StatusCodeForError(err))
+
+	_, err = HandleBody(context.Background(),
+		Body{DeviceUid: "A", Token: "guessed"}, model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+}
+
+func TestTokenIsForOneDevice(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustRegister(t, model, "B", "U", tokenA)
+
+	_, err := HandleBody(context.Background(),
+		Body{DeviceUid: "B", Token: tokenA}, model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+}
+
+func TestRegisterForExistingUserNeedsToken(t *testing.T) {
+	model := models.NewMemoryModel()
+	mustRegister(t, model, "A", "U", "")
+	tokenV := mustRegister(t, model, "V1", "V", "")
+
+	_, err := HandleBody(context.Background(),
+		Body{DeviceUid: "B", UserUid: "U", Register: true}, model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+
+	_, err = HandleBody(context.Background(),
+		Body{DeviceUid: "B", UserUid: "U", Register: true, Token: tokenV},
+		model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrForbidden))
+	assert.Equal(t, 2, len(model.Devices))
+}
+
+func TestRotateToken(t *testing.T) {
+	model := models.NewMemoryModel()
+	oldToken := mustRegister(t, model, "A", "U", "")
+
+	response, err := HandleBody(context.Background(),
+		Body{DeviceUid: "A", Token: oldToken, RotateToken: true}, model, Config{})
+	assert.Equal(t, nil, err)
+	newToken := response.Token
+	assert.NotEqual(t, "", newToken)
+	assert.NotEqual(t, oldToken, newToken)
+
+	_, err = HandleBody(context.Background(),
+		Body{DeviceUid: "A", Token: oldToken}, model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+	_, err = HandleBody(context.Background(),
+		Body{DeviceUid: "A", Token: newToken}, model, Config{})
+	assert.Equal(t, nil, err)
+}
+
+func TestRevokeToken(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	tokenV := mustRegister(t, model, "V1", "V", "")
+
+	// Another user's device can't revoke B's token
+	_, err := HandleBody(context.Background(),
+		Body{DeviceUid: "V1", Token: tokenV, RevokeDeviceUid: "B"}, model,
+		Config{})
+	assert.Equal(t, true, errors.Is(err, models.ErrNotFound))
+
+	_, err = HandleBody(context.Background(),
+		Body{DeviceUid: "A", Token: tokenA, RevokeDeviceUid: "B"}, model,
+		Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", model.Devices[1].TokenHash)
+
+	_, err = HandleBody(context.Background(),
+		Body{DeviceUid: "B", Token: tokenB}, model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+	_, err = HandleBody(context.Background(),
+		Body{DeviceUid: "A", Token: tokenA}, model, Config{})
+	assert.Equal(t, nil, err)
+}
+
+func TestTokensAreRedactedFromLogs(t *testing.T) {
+	body := Body{DeviceUid: "A", Token: "secret"}
+	assert.Equal(t, false, strings.Contains(body.String(), "secret"))
+	response := Response{Token: "secret"}
+	assert.Equal(t, false, strings.Contains(response.String(), "secret"))
+}
+
+func TestStreamTokenOpensOnePushSession(t *testing.T) {
+	ctx := context.Background()
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustRegister(t, model, "B", "U", tokenA)
+	config := Config{Hub: NewHub()}
+
+	streamToken, err := IssueStreamToken(ctx,
+		Body{DeviceUid: "A", Token: tokenA}, model)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, "", streamToken)
+
+	// It's only for device A
+	_, err = StreamTokenBody(ctx, "B", streamToken, model)
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+
+	body, err := StreamTokenBody(ctx, "A", streamToken, model)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, strings.Contains(body.String(), tokenA))
+	session, response, err := StartPushSession(ctx, body, model, config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, response.DeviceId)
+	session.Close()
+
+	// It's used up
+	_, err = StreamTokenBody(ctx, "A", streamToken, model)
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+
+	_, err = IssueStreamToken(ctx, Body{DeviceUid: "A", Token: "guessed"},
+		model)
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+}
+
+func TestStreamTokenExpires(t *testing.T) {
+	ctx := context.Background()
+	model := models.NewMemoryModel()
+	mustRegister(t, model, "A", "U", "")
+
+	err := model.CreateStreamToken(ctx, models.StreamToken{
+		TokenHash: hashToken("old"),
+		DeviceId:  1,
+		IssuedAt:  time.Now().UTC().Add(-2 * StreamTokenTtl),
+	})
+	assert.Equal(t, nil, err)
+	_, err = StreamTokenBody(ctx, "A", "old", model)
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+}
+
+func TestStreamTokenStopsWorkingWhenDeviceIsRevoked(t *testing.T) {
+	ctx := context.Background()
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	config := Config{Hub: NewHub()}
+
+	streamToken, err := IssueStreamToken(ctx,
+		Body{DeviceUid: "B", Token: tokenB}, model)
+	assert.Equal(t, nil, err)
+	body, err := StreamTokenBody(ctx, "B", streamToken, model)
+	assert.Equal(t, nil, err)
+
+	_, err = HandleBody(ctx,
+		Body{DeviceUid: "A", Token: tokenA, RevokeDeviceUid: "B"}, model,
+		Config{})
+	assert.Equal(t, nil, err)
+	_, _, err = StartPushSession(ctx, body, model, config)
+	assert.Equal(t, true, errors.Is(err, ErrUnauthorized))
+}
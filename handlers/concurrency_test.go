@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+// Run with -race to also check for data races
+func TestParallelHandleBody(t *testing.T) {
+	t.Run("MemoryModel", func(t *testing.T) {
+		testParallelHandleBody(t, models.NewMemoryModel())
+	})
+	t.Run("SqliteModel", func(t *testing.T) {
+		db, err := models.ConnectSqlite(":memory:")
+		if errors.Is(err, models.ErrSqliteNotBuiltIn) {
+			t.Skip(err)
+		} else if err != nil {
+			t.Fatalf("Error from ConnectSqlite: %s", err)
+		}
+		defer db.Close()
+		if _, err := models.MigrateUp(context.Background(), db,
+			models.SqliteDialect); err != nil {
+			t.Fatalf("Error from MigrateUp: %s", err)
+		}
+		testParallelHandleBody(t, models.NewSqliteModel(db))
+	})
+}
+
+func testParallelHandleBody(t *testing.T, model models.Model) {
+	const numDevices = 10
+	const numTodosPerDevice = 10
+	tokens := []string{mustRegister(t, model, "device0", "U", "")}
+	for i := 1; i < numDevices; i++ {
+		tokens = append(tokens,
+			mustRegister(t, model, fmt.Sprintf("device%d", i), "U", tokens[0]))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numDevices*numTodosPerDevice*2)
+	for i := 0; i < numDevices; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 1; j <= numTodosPerDevice; j++ {
+				body := Body{
+					DeviceUid: fmt.Sprintf("device%d", i),
+					Token:     tokens[i],
+					ActionsToSync: []models.ActionToSync{{
+						Id:              j,
+						Type:            "TODOS/ADD_TODO",
+						TodoIdMaybeTemp: -j,
+						Title:           stringPtr(fmt.Sprintf("%d.%d", i, j)),
+						Completed:       boolPtr(false),
+					}},
+				}
+				// Sending each body twice, as after a lost response, mustn't
+				// create the todo twice
+				for retry := 0; retry < 2; retry++ {
+					if _, err := HandleBody(context.Background(), body, model,
+						Config{}); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Error from HandleBody: %s", err)
+	}
+
+	ctx := context.Background()
+	user, err := model.FindUserByUid(ctx, "U")
+	assert.Equal(t, nil, err)
+	todos, err := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, nil, err)
+	titles := map[string]bool{}
+	ids := map[int]bool{}
+	for _, todo := range todos {
+		titles[todo.Title] = true
+		ids[todo.Id] = true
+	}
+	assert.Equal(t, numDevices*numTodosPerDevice, len(todos))
+	assert.Equal(t, numDevices*numTodosPerDevice, len(titles))
+	assert.Equal(t, numDevices*numTodosPerDevice, len(ids))
+	for i := 0; i < numDevices; i++ {
+		device, err := model.FindDeviceByUid(ctx, fmt.Sprintf("device%d", i))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, numTodosPerDevice, len(device.ActionToSyncIdToOutput))
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"sort"
+)
+
+// ConflictOutcome says what became of a TODO/UPDATE_TODO whose BaseVersion
+// was older than the todo's current version
+type ConflictOutcome string
+
+const (
+	// All of the action's fields were applied over the other change
+	ConflictOverwrote ConflictOutcome = "overwrote"
+	// Only the fields nobody else changed were applied
+	ConflictMerged ConflictOutcome = "merged"
+	// None of the action's fields were applied because the other change won
+	ConflictDiscarded ConflictOutcome = "discarded"
+	// None of the action's fields were applied because of the conflict
+	ConflictRejected ConflictOutcome = "rejected"
+)
+
+// ConflictPolicy decides which fields of a TODO/UPDATE_TODO to apply when
+// current.Version is newer than the action's BaseVersion.  It returns the
+// action with the fields to skip set to nil.
+type ConflictPolicy interface {
+	Resolve(current models.Todo,
+		action models.ActionToSync) (models.ActionToSync, ConflictOutcome)
+}
+
+// LastWriterWins applies the whole action if its ClientTimestamp is at least
+// as late as the one from the todo's last update, and none of it otherwise.
+// Actions without a ClientTimestamp lose to any update that had one.
+type LastWriterWins struct{}
+
+func (LastWriterWins) Resolve(current models.Todo,
+	action models.ActionToSync) (models.ActionToSync, ConflictOutcome) {
+	var clientTimestamp int64
+	if action.ClientTimestamp != nil {
+		clientTimestamp = *action.ClientTimestamp
+	}
+
+	if clientTimestamp >= current.ClientUpdatedAt {
+		return action, ConflictOverwrote
+	} else {
+		return withoutFields(action), ConflictDiscarded
+	}
+}
+
+// MergeFields applies the action's title and completed separately, skipping
+// each one that some other update changed after the action's BaseVersion
+type MergeFields struct{}
+
+func (MergeFields) Resolve(current models.Todo,
+	action models.ActionToSync) (models.ActionToSync, ConflictOutcome) {
+	resolved := action
+	if current.TitleVersion > *action.BaseVersion {
+		resolved.Title = nil
+	}
+	if current.CompletedVersion > *action.BaseVersion {
+		resolved.Completed = nil
+	}
+
+	if resolved.Title == nil && resolved.Completed == nil {
+		return resolved, ConflictDiscarded
+	} else if (resolved.Title == nil) != (action.Title == nil) ||
+		(resolved.Completed == nil) != (action.Completed == nil) {
+		return resolved, ConflictMerged
+	} else {
+		// The other updates only changed fields this action doesn't set
+		return resolved, ConflictOverwrote
+	}
+}
+
+// RejectConflicts applies none of the action, leaving the client to show the
+// conflict to the user
+type RejectConflicts struct{}
+
+func (RejectConflicts) Resolve(current models.Todo,
+	action models.ActionToSync) (models.ActionToSync, ConflictOutcome) {
+	return withoutFields(action), ConflictRejected
+}
+
+var conflictPolicyByName = map[string]ConflictPolicy{
+	"last_writer_wins": LastWriterWins{},
+	"merge_fields":     MergeFields{},
+	"reject":           RejectConflicts{},
+}
+
+// ConflictPolicyNames lists the names accepted by ConflictPolicyByName
+func ConflictPolicyNames() []string {
+	names := []string{}
+	for name := range conflictPolicyByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func ConflictPolicyByName(name string) (ConflictPolicy, error) {
+	policy, ok := conflictPolicyByName[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown conflict policy '%s', expected one of %v",
+			name, ConflictPolicyNames())
+	}
+	return policy, nil
+}
+
+func withoutFields(action models.ActionToSync) models.ActionToSync {
+	action.Title = nil
+	action.Completed = nil
+	return action
+}
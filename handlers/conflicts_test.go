@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"context"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func int64Ptr(i int64) *int64 { return &i }
+
+// A todo created at version 1, then had its title changed at version 2
+var conflictingTodo = models.Todo{
+	Id:               1,
+	Title:            "changed elsewhere",
+	Completed:        false,
+	Version:          2,
+	TitleVersion:     2,
+	CompletedVersion: 1,
+	ClientUpdatedAt:  2000,
+}
+
+func TestLastWriterWins(t *testing.T) {
+	action := models.ActionToSync{
+		Title:           stringPtr("later"),
+		BaseVersion:     intPtr(1),
+		ClientTimestamp: int64Ptr(3000),
+	}
+	resolved, outcome := LastWriterWins{}.Resolve(conflictingTodo, action)
+	assert.Equal(t, action, resolved)
+	assert.Equal(t, ConflictOverwrote, outcome)
+
+	action.ClientTimestamp = int64Ptr(1000)
+	resolved, outcome = LastWriterWins{}.Resolve(conflictingTodo, action)
+	assert.Equal(t, (*string)(nil), resolved.Title)
+	assert.Equal(t, ConflictDiscarded, outcome)
+}
+
+func TestMergeFields(t *testing.T) {
+	resolved, outcome := MergeFields{}.Resolve(conflictingTodo,
+		models.ActionToSync{
+			Title:       stringPtr("mine"),
+			Completed:   boolPtr(true),
+			BaseVersion: intPtr(1),
+		})
+	assert.Equal(t, (*string)(nil), resolved.Title)
+	assert.Equal(t, boolPtr(true), resolved.Completed)
+	assert.Equal(t, ConflictMerged, outcome)
+
+	resolved, outcome = MergeFields{}.Resolve(conflictingTodo,
+		models.ActionToSync{Title: stringPtr("mine"), BaseVersion: intPtr(1)})
+	assert.Equal(t, (*string)(nil), resolved.Title)
+	assert.Equal(t, ConflictDiscarded, outcome)
+
+	resolved, outcome = MergeFields{}.Resolve(conflictingTodo,
+		models.ActionToSync{Completed: boolPtr(true), BaseVersion: intPtr(1)})
+	assert.Equal(t, boolPtr(true), resolved.Completed)
+	assert.Equal(t, ConflictOverwrote, outcome)
+}
+
+func TestConflictPolicyByName(t *testing.T) {
+	policy, err := ConflictPolicyByName("reject")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, RejectConflicts{}, policy)
+
+	_, err = ConflictPolicyByName("coin_flip")
+	assert.Error(t, err)
+}
+
+func TestConflictingUpdatesFromTwoDevices(t *testing.T) {
+	model := models.NewMemoryModel()
+	config := Config{ConflictPolicy: RejectConflicts{}}
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODOS/ADD_TODO",
+			TodoIdMaybeTemp: -1,
+			Title:           stringPtr("title"),
+			Completed:       boolPtr(false),
+		}},
+	}, model, config)
+	assert.Equal(t, nil, err)
+
+	// Both devices saw version 1 before editing offline
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              2,
+			Type:            "TODO/UPDATE_TODO",
+			TodoIdMaybeTemp: 1,
+			Completed:       boolPtr(true),
+			BaseVersion:     intPtr(1),
+		}},
+	}, model, config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]ConflictOutcome(nil),
+		response.ActionToSyncIdToConflict)
+
+	response, err = HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODO/UPDATE_TODO",
+			TodoIdMaybeTemp: 1,
+			Title:           stringPtr("edited on B"),
+			BaseVersion:     intPtr(1),
+		}},
+	}, model, config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]ConflictOutcome{"1": ConflictRejected},
+		response.ActionToSyncIdToConflict)
+	assert.Equal(t, map[string]int{"1": 0}, response.ActionToSyncIdToOutput)
+	assert.Equal(t, "title", model.Todos[0].Title)
+	assert.Equal(t, true, model.Todos[0].Completed)
+	assert.Equal(t, 2, model.Todos[0].Version)
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"net/http"
+)
+
+var (
+	// ErrUnauthorized means the body's token is missing, unknown or revoked
+	ErrUnauthorized = errors.New("Unauthorized")
+
+	// ErrForbidden means the device isn't allowed to do what the body asks
+	ErrForbidden = errors.New("Forbidden")
+)
+
+// ErrorResponse is sent instead of a Response when HandleBody fails, over
+// the socket protocol (HTTP clients get the status code and message instead)
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+	// Retriable is true if sending the same Body again later may succeed
+	Retriable bool `json:"retriable"`
+}
+
+func NewErrorResponse(err error) ErrorResponse {
+	status := StatusCodeForError(err)
+	retriable := status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+	return ErrorResponse{
+		Error:     err.Error(),
+		Status:    status,
+		Retriable: retriable,
+	}
+}
+
+// StatusCodeForError maps an error from HandleBody to an HTTP status code.
+// Errors not caused by the model are blamed on the request.
+func StatusCodeForError(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, models.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, models.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, models.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadRequest
+	}
+}
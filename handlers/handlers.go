@@ -1,23 +1,131 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/danielstutzman/todomvc-backend-go/models"
 	"log"
+	"sort"
 	"strconv"
+	"time"
 )
 
+// Config holds the server-wide settings for HandleBody
+type Config struct {
+	// ConflictPolicy handles TODO/UPDATE_TODO actions whose BaseVersion is out
+	// of date; LastWriterWins if nil
+	ConflictPolicy ConflictPolicy
+	// TestMode allows Body.ResetModel; otherwise resets have to go through
+	// AdminResetModel
+	TestMode bool
+	// AdminNameToTokenHash has the SHA-256 in hex of each admin's token, for
+	// AdminResetModel
+	AdminNameToTokenHash map[string]string
+	// Hub is told about every change, for StartPushSession and
+	// Body.WaitMillis; nil if pushes are turned off
+	Hub *Hub
+	// MaxWait caps Body.WaitMillis; DefaultMaxWait if 0
+	MaxWait time.Duration
+}
+
+const DefaultMaxWait = time.Minute
+
+func (config Config) conflictPolicy() ConflictPolicy {
+	if config.ConflictPolicy == nil {
+		return LastWriterWins{}
+	}
+	return config.ConflictPolicy
+}
+
 type Body struct {
-	// ResetModel is for testing purposes
-	ResetModel    bool                  `json:"resetModel"`
-	DeviceUid     string                `json:"deviceUid"`
-	ActionsToSync []models.ActionToSync `json:"actionsToSync"`
+	// ResetModel is for testing purposes, and refused unless Config.TestMode
+	ResetModel bool   `json:"resetModel"`
+	DeviceUid  string `json:"deviceUid"`
+	// UserUid is required to register a device, to say which user the device
+	// (and the todos it creates) belongs to.  After that it's optional, but
+	// must match if given.
+	UserUid string `json:"userUid"`
+	// Token is the secret from the Response that registered the device or
+	// last rotated its token.  HTTP clients send it in the Authorization
+	// header instead.
+	Token string `json:"token,omitempty"`
+	// Register creates the device, and its user if that's new, and issues
+	// the device's first token.  Registering another device for an existing
+	// user needs the Token of one of that user's devices.
+	Register bool `json:"register,omitempty"`
+	// RotateToken replaces the device's token with a new one
+	RotateToken bool `json:"rotateToken,omitempty"`
+	// RevokeDeviceUid revokes the token of that device, which must belong to
+	// the same user, e.g. to lock out a lost device
+	RevokeDeviceUid string                `json:"revokeDeviceUid,omitempty"`
+	ActionsToSync   []models.ActionToSync `json:"actionsToSync"`
+	// Cursor is the Response.Cursor from the device's last sync, to receive
+	// only the todos changed since then; leave it out to get every todo
+	Cursor *int `json:"cursor,omitempty"`
+	// HistoryTodoId asks for Response.TodoHistory of that todo, which must
+	// belong to the device's user, or be in a list shared with them, but may
+	// have been deleted
+	HistoryTodoId int `json:"historyTodoId,omitempty"`
+	// WaitMillis makes a body that only syncs from a Cursor wait up to that
+	// long (and at most Config.MaxWait) for another device to change
+	// something, if nothing's changed since the Cursor yet.  It's ignored if
+	// Config.Hub is nil.
+	WaitMillis int `json:"waitMillis,omitempty"`
+
+	// tokenHash stands in for Token in bodies from StreamTokenBody
+	tokenHash string
 }
 
 type Response struct {
 	DeviceId               int            `json:"deviceId"`
 	ActionToSyncIdToOutput map[string]int `json:"actionToSyncIdToOutput"`
-	Todos                  []models.Todo  `json:"todos"`
+	// Todos and the Lists' Todos have every todo, or only those changed since
+	// Body.Cursor, each once: Todos has the ones that aren't in a list
+	Todos []models.Todo `json:"todos"`
+	// DeletedTodoIds is set only if Body.Cursor was
+	DeletedTodoIds []int `json:"deletedTodoIds,omitempty"`
+	// Lists groups the todos in lists by list.  It has every list, or only
+	// those changed since Body.Cursor, plus the lists of any changed todos.
+	Lists []ResponseList `json:"lists"`
+	// DeletedListIds is set only if Body.Cursor was
+	DeletedListIds []int `json:"deletedListIds,omitempty"`
+	Cursor         int   `json:"cursor"`
+	// ActionToSyncIdToConflict is set for the actions in this body that
+	// conflicted with another device's update, as decided by ConflictPolicy
+	ActionToSyncIdToConflict map[string]ConflictOutcome `json:"actionToSyncIdToConflict,omitempty"`
+	// ActionToSyncIdToRejection has the reason for each action in this body
+	// that the user's role in a shared list doesn't allow, e.g. a viewer's
+	// TODO/UPDATE_TODO.  They're left out of the log, and their output is 0,
+	// so clients shouldn't send them again.
+	ActionToSyncIdToRejection map[string]string `json:"actionToSyncIdToRejection,omitempty"`
+	// Token is set only if the body registered the device or rotated its
+	// token.  Only its hash is stored, so the client must keep it.
+	Token string `json:"token,omitempty"`
+	// TodoHistory is set only if Body.HistoryTodoId was, to every change to
+	// that todo (including this body's), oldest first
+	TodoHistory []models.TodoChange `json:"todoHistory,omitempty"`
+}
+
+// String keeps the token out of logs
+func (body Body) String() string {
+	type bodyWithoutString Body
+	if body.Token != "" {
+		body.Token = "[redacted]"
+	}
+	if body.tokenHash != "" {
+		body.tokenHash = "[redacted]"
+	}
+	return fmt.Sprintf("%v", bodyWithoutString(body))
+}
+
+// String keeps the token out of logs
+func (response Response) String() string {
+	type responseWithoutString Response
+	if response.Token != "" {
+		response.Token = "[redacted]"
+	}
+	return fmt.Sprintf("%v", responseWithoutString(response))
 }
 
 func mapIntIntToMapStringInt(input map[int]int) map[string]int {
@@ -28,98 +136,510 @@ func mapIntIntToMapStringInt(input map[int]int) map[string]int {
 	return output
 }
 
-func HandleBody(body Body, model models.Model) (*Response, error) {
+// HandleBody applies the whole body in one transaction, so if any action
+// fails, none of them (nor the device's ActionToSyncIdToOutput) are saved
+// and the client can safely retry the same body.
+// The ctx's deadline or cancellation stops the work between queries.
+// Once committed, any changes are published to config.Hub.
+func HandleBody(ctx context.Context, body Body, model models.Model,
+	config Config) (*Response, error) {
+	if config.Wait(body) > 0 {
+		return handleBodyWaiting(ctx, body, model, config)
+	}
 	log.Printf("-- Got body %v", body)
 
+	var response *Response
+	var push *Push
+	err := model.WithTx(ctx, func(tx models.Model) error {
+		var err error
+		response, push, err = handleBodyInTx(ctx, body, tx, config)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if push != nil {
+		config.Hub.Publish(*push)
+	}
+	return response, nil
+}
+
+// handleBodyInTx also returns the Push for config.Hub, if there's a hub and
+// the body changed anything
+func handleBodyInTx(ctx context.Context, body Body, model models.Model,
+	config Config) (*Response, *Push, error) {
+	// Bodies that change things check the device's outputs and the todos'
+	// versions first, so nothing else may change them in between
+	if !onlySyncs(body) {
+		if err := model.LockForWrite(ctx); err != nil {
+			return nil, nil, fmt.Errorf("Error from LockForWrite: %w", err)
+		}
+	}
 	if body.ResetModel {
-		model.Reset()
+		if !config.TestMode {
+			return nil, nil, fmt.Errorf("%w: ResetModel is only allowed in test mode",
+				ErrForbidden)
+		}
+		if err := model.Reset(ctx); err != nil {
+			return nil, nil, fmt.Errorf("Error from Reset: %w", err)
+		}
 	}
 
 	if body.DeviceUid == "" {
-		return nil, fmt.Errorf("Blank DeviceUid")
+		return nil, nil, fmt.Errorf("Blank DeviceUid")
+	}
+	device, token, err := authenticateDevice(ctx, body, model)
+	if err != nil {
+		return nil, nil, err
 	}
-	device := model.FindOrCreateDeviceByUid(body.DeviceUid)
 	log.Println("   Got device", device)
 
 	tempIdToId := map[int]int{}
+	tempListIdToId := map[int]int{}
+	conflicts := map[int]ConflictOutcome{}
+	rejections := map[int]string{}
+	source := actionSource{
+		UserId:     device.UserId,
+		DeviceId:   device.Id,
+		ServerTime: time.Now().UTC(),
+	}
+	// Found before the first change and again after the last, so users who
+	// join or leave lists are told too
+	var pushUserIds map[int]bool
 	for _, actionToSync := range body.ActionsToSync {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, fmt.Errorf("Stopped before action %d: %w",
+				actionToSync.Id, err)
+		}
+
 		_, alreadyExecuted := device.ActionToSyncIdToOutput[actionToSync.Id]
 		if !alreadyExecuted {
-			output, err := handleActionToSync(actionToSync, model, tempIdToId)
+			actionToSync, err := resolveOtherIds(actionToSync, tempIdToId,
+				tempListIdToId)
 			if err != nil {
-				return nil, fmt.Errorf("Error from handleActionToSync: %s", err)
+				return nil, nil, fmt.Errorf("Error from resolveOtherIds: %w", err)
+			}
+			todoId, err := resolveTodoId(actionToSync, tempIdToId)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error from resolveTodoId: %w", err)
+			}
+			actingSource := source
+			var rejection string
+			actingSource.UserId, rejection, err = actingUserId(ctx, model, source,
+				actionToSync, todoId)
+			if err != nil {
+				return nil, nil, err
+			}
+			if rejection != "" {
+				log.Printf("  Rejected: %s", rejection)
+				rejections[actionToSync.Id] = rejection
+				device.ActionToSyncIdToOutput[actionToSync.Id] = 0
+			} else {
+				if config.Hub != nil && pushUserIds == nil {
+					pushUserIds = map[int]bool{}
+					if err := addPushUserIds(ctx, model, device.UserId,
+						pushUserIds); err != nil {
+						return nil, nil, err
+					}
+				}
+				if err := applyActionToSync(ctx, actionToSync, model, config,
+					actingSource, todoId, conflicts, device); err != nil {
+					return nil, nil, err
+				}
 			}
-
-			// immutable edit so we don't corrupt MemoryModel
-			device.ActionToSyncIdToOutput = immutableSetForMapIntInt(
-				device.ActionToSyncIdToOutput, actionToSync.Id, output)
 		}
 
 		if actionToSync.Type == "TODOS/ADD_TODO" {
 			tempIdToId[actionToSync.TodoIdMaybeTemp] =
 				device.ActionToSyncIdToOutput[actionToSync.Id]
+		} else if actionToSync.Type == "LISTS/ADD_LIST" &&
+			actionToSync.ListIdMaybeTemp != nil {
+			tempListIdToId[*actionToSync.ListIdMaybeTemp] =
+				device.ActionToSyncIdToOutput[actionToSync.Id]
+		}
+	}
+	if pushUserIds != nil {
+		if err := addPushUserIds(ctx, model, device.UserId, pushUserIds); err != nil {
+			return nil, nil, err
 		}
 	}
-	model.UpdateDeviceActionToSyncIdToOutputJson(device)
+	if err := model.UpdateDeviceActionToSyncIdToOutputJson(ctx, device); err != nil {
+		return nil, nil,
+			fmt.Errorf("Error from UpdateDeviceActionToSyncIdToOutputJson: %w", err)
+	}
 
 	response := Response{
 		DeviceId:               device.Id,
 		ActionToSyncIdToOutput: mapIntIntToMapStringInt(device.ActionToSyncIdToOutput),
-		Todos: model.ListTodos(),
+		Token:                  token,
+	}
+	if len(conflicts) > 0 {
+		response.ActionToSyncIdToConflict = map[string]ConflictOutcome{}
+		for actionToSyncId, outcome := range conflicts {
+			response.ActionToSyncIdToConflict[strconv.Itoa(actionToSyncId)] = outcome
+		}
+	}
+	if len(rejections) > 0 {
+		response.ActionToSyncIdToRejection = map[string]string{}
+		for actionToSyncId, reason := range rejections {
+			response.ActionToSyncIdToRejection[strconv.Itoa(actionToSyncId)] = reason
+		}
+	}
+	var lists []models.TodoList
+	if body.Cursor != nil {
+		changes, err := model.ListChangesSince(ctx, device.UserId, *body.Cursor)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error from ListChangesSince: %w", err)
+		}
+		response.Todos = changes.Todos
+		response.DeletedTodoIds = changes.DeletedTodoIds
+		response.DeletedListIds = changes.DeletedListIds
+		response.Cursor = changes.Revision
+		lists = changes.Lists
+	} else {
+		// Read the revision first so the client can't miss changes that happen
+		// in between (it might see them twice instead)
+		response.Cursor, err = model.LatestRevision(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error from LatestRevision: %w", err)
+		}
+		response.Todos, err = model.ListTodos(ctx, device.UserId)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error from ListTodos: %w", err)
+		}
+		lists, err = model.ListTodoLists(ctx, device.UserId)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error from ListTodoLists: %w", err)
+		}
+	}
+	shared, err := sharedListChanges(ctx, model, device.UserId, body.Cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	response.Todos = append(response.Todos, shared.Todos...)
+	lists = append(lists, shared.Lists...)
+	if body.Cursor != nil {
+		response.DeletedTodoIds = append(response.DeletedTodoIds,
+			shared.DeletedTodoIds...)
+	}
+	response.Lists, response.Todos, err = groupTodosByList(ctx, model,
+		response.Todos, lists)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := addMembers(ctx, model, device.UserId, response.Lists); err != nil {
+		return nil, nil, err
+	}
+	if body.HistoryTodoId != 0 {
+		// Changes to todos in shared lists are recorded as their owner's
+		historyUserId := device.UserId
+		todo, err := model.FindTodoById(ctx, body.HistoryTodoId)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			return nil, nil, fmt.Errorf("Error from FindTodoById: %w", err)
+		} else if err == nil {
+			historyUserId, _, err = actingUserIdInList(ctx, model, device.UserId,
+				"see history", todo.ListId, anyRoles)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		response.TodoHistory, err = model.ListTodoChanges(ctx, historyUserId,
+			body.HistoryTodoId)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error from ListTodoChanges: %w", err)
+		}
+	}
+
+	var push *Push
+	if pushUserIds != nil {
+		push = &Push{DeviceId: device.Id, Revision: response.Cursor}
+		for userId := range pushUserIds {
+			push.UserIds = append(push.UserIds, userId)
+		}
+		sort.Ints(push.UserIds)
+		if err := config.Hub.notify(ctx, model, *push, false); err != nil {
+			return nil, nil, err
+		}
 	}
-	return &response, nil
+	return &response, push, nil
 }
 
-// returns output -- the new TodoID if TODOS/ADD_TODOS, the number of rows updated
-// for other types
-func handleActionToSync(actionToSync models.ActionToSync,
-	model models.Model, tempIdToId map[int]int) (int, error) {
+// applyActionToSync handles the action, saves its output in the device's
+// ActionToSyncIdToOutput, and logs it
+func applyActionToSync(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, config Config, source actionSource, todoId int,
+	conflicts map[int]ConflictOutcome, device models.Device) error {
+	output, err := handleActionToSync(ctx, actionToSync, model, config, source,
+		todoId, conflicts)
+	if err != nil {
+		return fmt.Errorf("Error from handleActionToSync: %w", err)
+	}
+	device.ActionToSyncIdToOutput[actionToSync.Id] = output
+
+	if actionToSync.Type == "TODOS/ADD_TODO" {
+		todoId = output
+	}
+	if _, err := model.CreateActionEvent(ctx, models.ActionEvent{
+		UserId:     source.UserId,
+		DeviceId:   source.DeviceId,
+		TodoId:     todoId,
+		Action:     actionToSync,
+		ServerTime: source.ServerTime,
+		Output:     output,
+	}); err != nil {
+		return fmt.Errorf("Error from CreateActionEvent: %w", err)
+	}
+	return nil
+}
+
+// resolveTodoId returns the id of the todo the action applies to, looking up
+// temporary (negative) ids in tempIdToId, or 0 for TODOS/ADD_TODO, actions
+// on any number of todos, and actions on lists
+func resolveTodoId(actionToSync models.ActionToSync,
+	tempIdToId map[int]int) (int, error) {
+	switch actionToSync.Type {
+	case "TODOS/ADD_TODO", "TODOS/TOGGLE_ALL", "TODOS/CLEAR_COMPLETED",
+		"TODOS/UNDO", "LISTS/ADD_LIST", "LIST/UPDATE_LIST", "LISTS/DELETE_LIST",
+		"LIST/INVITE_TO_LIST", "LISTS/JOIN_LIST", "LIST/UPDATE_MEMBER":
+		return 0, nil
+	}
+
+	return resolveTodoIdMaybeTemp(actionToSync.TodoIdMaybeTemp, actionToSync,
+		tempIdToId)
+}
+
+// resolveTodoIdMaybeTemp returns todoIdMaybeTemp, from actionToSync, with a
+// temporary (negative) id looked up in tempIdToId
+func resolveTodoIdMaybeTemp(todoIdMaybeTemp int,
+	actionToSync models.ActionToSync, tempIdToId map[int]int) (int, error) {
+	if todoIdMaybeTemp < 0 {
+		todoId, ok := tempIdToId[todoIdMaybeTemp]
+		if !ok {
+			return 0,
+				fmt.Errorf("Don't know todoId for temp id in action %v", actionToSync)
+		}
+		return todoId, nil
+	} else if todoIdMaybeTemp > 0 {
+		return todoIdMaybeTemp, nil
+	} else {
+		return 0, fmt.Errorf("Invalid TodoIdMaybeTemp in action %v", actionToSync)
+	}
+}
+
+// resolveOtherIds returns the action with a temporary id in
+// BeforeTodoIdMaybeTemp or AfterTodoIdMaybeTemp replaced by the real one from
+// tempIdToId, and in ListIdMaybeTemp by the one from tempListIdToId, except
+// for LISTS/ADD_LIST, which creates that list
+func resolveOtherIds(actionToSync models.ActionToSync,
+	tempIdToId map[int]int, tempListIdToId map[int]int) (models.ActionToSync,
+	error) {
+	if actionToSync.ListIdMaybeTemp != nil &&
+		*actionToSync.ListIdMaybeTemp < 0 &&
+		actionToSync.Type != "LISTS/ADD_LIST" {
+		listId, ok := tempListIdToId[*actionToSync.ListIdMaybeTemp]
+		if !ok {
+			return models.ActionToSync{},
+				fmt.Errorf("Don't know listId for temp id in action %v", actionToSync)
+		}
+		actionToSync.ListIdMaybeTemp = &listId
+	}
 
-	var todoId int
-	if actionToSync.Type != "TODOS/ADD_TODO" {
-		if actionToSync.TodoIdMaybeTemp < 0 {
-			var ok bool
-			todoId, ok = tempIdToId[actionToSync.TodoIdMaybeTemp]
-			if !ok {
-				return 0,
-					fmt.Errorf("Don't know todoId for temp id in action %v", actionToSync)
+	for _, field := range []**int{
+		&actionToSync.BeforeTodoIdMaybeTemp,
+		&actionToSync.AfterTodoIdMaybeTemp,
+	} {
+		if *field != nil {
+			todoId, err := resolveTodoIdMaybeTemp(**field, actionToSync, tempIdToId)
+			if err != nil {
+				return models.ActionToSync{}, err
 			}
-		} else if actionToSync.TodoIdMaybeTemp > 0 {
-			todoId = actionToSync.TodoIdMaybeTemp
-		} else {
-			return 0, fmt.Errorf("Invalid TodoIdMaybeTemp in action %v", actionToSync)
+			*field = &todoId
 		}
 	}
+	return actionToSync, nil
+}
 
+// actionSource says which device sent an action, and when it arrived.
+// UserId is the user the action acts as; see actingUserId.
+type actionSource struct {
+	UserId     int
+	DeviceId   int
+	ServerTime time.Time
+}
+
+// returns output -- the new TodoID if TODOS/ADD_TODOS, the new list's id if
+// LISTS/ADD_LIST, the joined list's id if LISTS/JOIN_LIST, the number of rows
+// updated for other types (including the bulk ones, TODOS/TOGGLE_ALL and
+// TODOS/CLEAR_COMPLETED, TODO/MOVE_TODO, TODOS/UNDO, and the other list
+// actions).  Records conflicting updates'
+// outcomes in conflicts, and each change made in the todo's history.  Only
+// todos and lists belonging to source.UserId can be changed; the IDs of other
+// users' are treated as missing.
+func handleActionToSync(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, config Config, source actionSource, todoId int,
+	conflicts map[int]ConflictOutcome) (int, error) {
 	switch actionToSync.Type {
 
 	case "TODOS/ADD_TODO":
+		if actionToSync.Title == nil || actionToSync.Completed == nil {
+			return 0, fmt.Errorf("Missing title or completed in action %v", actionToSync)
+		}
+		if actionToSync.ListIdMaybeTemp != nil {
+			listId, err := existingListId(ctx, model, source.UserId,
+				*actionToSync.ListIdMaybeTemp)
+			if err != nil {
+				return 0, err
+			}
+			actionToSync.ListIdMaybeTemp = &listId
+		}
 		log.Printf("  Calling CreateTodo(%v)", actionToSync)
-		todo := model.CreateTodo(actionToSync)
+		todo, err := model.CreateTodo(ctx, source.UserId, actionToSync)
+		if err != nil {
+			return 0, fmt.Errorf("Error from CreateTodo: %w", err)
+		}
+		if err := recordTodoChange(ctx, model, source, actionToSync,
+			todo.Id); err != nil {
+			return 0, err
+		}
 		return todo.Id, nil
 
 	case "TODO/UPDATE_TODO":
+		if actionToSync.BaseVersion != nil {
+			current, err := model.FindTodo(ctx, source.UserId, todoId)
+			if errors.Is(err, models.ErrNotFound) {
+				return 0, nil // same output as updating a missing todo
+			} else if err != nil {
+				return 0, fmt.Errorf("Error from FindTodo: %w", err)
+			}
+
+			if current.Version > *actionToSync.BaseVersion {
+				var outcome ConflictOutcome
+				actionToSync, outcome =
+					config.conflictPolicy().Resolve(current, actionToSync)
+				log.Printf("  Conflict with version %d: %s", current.Version, outcome)
+				conflicts[actionToSync.Id] = outcome
+				if actionToSync.Title == nil && actionToSync.Completed == nil {
+					return 0, nil
+				}
+			}
+		}
+
 		log.Printf("  Calling UpdateTodo(%v)", actionToSync)
-		output := model.UpdateTodo(actionToSync, todoId)
+		output, err := model.UpdateTodo(ctx, source.UserId, actionToSync, todoId)
+		if err != nil {
+			return 0, fmt.Errorf("Error from UpdateTodo: %w", err)
+		}
+		if output > 0 {
+			// With the fields as resolved, if there was a conflict
+			if err := recordTodoChange(ctx, model, source, actionToSync,
+				todoId); err != nil {
+				return 0, err
+			}
+		}
 		return output, nil
 
 	case "TODOS/DELETE_TODO":
 		log.Printf("  Calling DeleteTodo(%v)", actionToSync)
-		output := model.DeleteTodo(todoId)
+		output, err := model.DeleteTodo(ctx, source.UserId, todoId)
+		if err != nil {
+			return 0, fmt.Errorf("Error from DeleteTodo: %w", err)
+		}
+		if output > 0 {
+			if err := recordTodoChange(ctx, model, source, actionToSync,
+				todoId); err != nil {
+				return 0, err
+			}
+		}
 		return output, nil
 
+	case "TODO/MOVE_TODO":
+		return moveTodo(ctx, actionToSync, model, source.UserId, todoId)
+
+	case "TODOS/TOGGLE_ALL":
+		if actionToSync.Completed == nil {
+			return 0, fmt.Errorf("Missing completed in action %v", actionToSync)
+		}
+		log.Printf("  Calling SetAllTodosCompleted(%v)", actionToSync)
+		todoIds, err := model.SetAllTodosCompleted(ctx, source.UserId,
+			actionToSync)
+		if err != nil {
+			return 0, fmt.Errorf("Error from SetAllTodosCompleted: %w", err)
+		}
+		change := models.ActionToSync{Id: actionToSync.Id,
+			Type: actionToSync.Type, Completed: actionToSync.Completed}
+		for _, todoId := range todoIds {
+			if err := recordTodoChange(ctx, model, source, change,
+				todoId); err != nil {
+				return 0, err
+			}
+		}
+		return len(todoIds), nil
+
+	case "TODOS/CLEAR_COMPLETED":
+		log.Printf("  Calling DeleteCompletedTodos(%v)", actionToSync)
+		todoIds, err := model.DeleteCompletedTodos(ctx, source.UserId,
+			actionToSync)
+		if err != nil {
+			return 0, fmt.Errorf("Error from DeleteCompletedTodos: %w", err)
+		}
+		change := models.ActionToSync{Id: actionToSync.Id, Type: actionToSync.Type}
+		for _, todoId := range todoIds {
+			if err := recordTodoChange(ctx, model, source, change,
+				todoId); err != nil {
+				return 0, err
+			}
+		}
+		return len(todoIds), nil
+
+	case "TODOS/UNDO":
+		return undoAction(ctx, actionToSync, model, source)
+
+	case "LISTS/ADD_LIST":
+		return addList(ctx, actionToSync, model, source.UserId)
+
+	case "LIST/UPDATE_LIST":
+		return updateList(ctx, actionToSync, model, source.UserId)
+
+	case "LISTS/DELETE_LIST":
+		return deleteList(ctx, actionToSync, model, source)
+
+	case "LIST/INVITE_TO_LIST":
+		return inviteToList(ctx, actionToSync, model, source.UserId)
+
+	case "LISTS/JOIN_LIST":
+		return joinList(ctx, actionToSync, model, source.UserId)
+
+	case "LIST/UPDATE_MEMBER":
+		return updateMember(ctx, actionToSync, model, source.UserId)
+
 	default:
 		return 0, fmt.Errorf("Unknown type in actionToSync: %v", actionToSync)
 	}
 }
 
-// Set input[keyToSet] = valueToSet in a copy of input (doesn't modify input)
-func immutableSetForMapIntInt(input map[int]int, keyToSet int,
-	valueToSet int) map[int]int {
-	output := map[int]int{}
-	for k, v := range input {
-		output[k] = v
+// recordTodoChange adds the fields actionToSync set on the todo to its history
+func recordTodoChange(ctx context.Context, model models.Model,
+	source actionSource, actionToSync models.ActionToSync, todoId int) error {
+	change := models.TodoChange{
+		UserId:         source.UserId,
+		TodoId:         todoId,
+		DeviceId:       source.DeviceId,
+		ActionToSyncId: actionToSync.Id,
+		Type:           actionToSync.Type,
+		Title:          actionToSync.Title,
+		Completed:      actionToSync.Completed,
+		ServerTime:     source.ServerTime,
 	}
-	output[keyToSet] = valueToSet
-	return output
+	if actionToSync.Type == "TODOS/DELETE_TODO" {
+		change.Title = nil
+		change.Completed = nil
+	} else if actionToSync.Type == "TODOS/ADD_TODO" &&
+		actionToSync.ListIdMaybeTemp != nil {
+		change.ListId = *actionToSync.ListIdMaybeTemp
+	}
+	if _, err := model.CreateTodoChange(ctx, change); err != nil {
+		return fmt.Errorf("Error from CreateTodoChange: %w", err)
+	}
+	return nil
 }
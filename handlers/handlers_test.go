@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/danielstutzman/todomvc-backend-go/models"
 	"github.com/stretchr/testify/assert"
+	"net/http"
 	"testing"
+	"time"
 )
 
 func stringPtr(s string) *string { return &s }
@@ -15,22 +19,48 @@ func TestHandleBodyNoDeviceUid(t *testing.T) {
 		NextDeviceId: 1,
 		Devices:      []models.Device{},
 	}
-	_, err := HandleBody(Body{}, model)
+	_, err := HandleBody(context.Background(), Body{}, model, Config{})
 	assert.Equal(t, fmt.Errorf("Blank DeviceUid"), err)
 }
 
+// mustRegister registers the device and returns its token.  vouchingToken
+// is needed if the user already has a device.
+func mustRegister(t *testing.T, model models.Model, deviceUid string,
+	userUid string, vouchingToken string) string {
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: deviceUid,
+		UserUid:   userUid,
+		Register:  true,
+		Token:     vouchingToken,
+	}, model, Config{})
+	if err != nil {
+		t.Fatalf("Error from HandleBody: %s", err)
+	}
+	return response.Token
+}
+
 func TestHandleBodyNewDevice(t *testing.T) {
 	model := &models.MemoryModel{
+		Users:        []models.User{{Id: 1, Uid: "U"}},
+		NextUserId:   2,
 		NextDeviceId: 2,
 		Devices: []models.Device{
-			{Id: 1, Uid: "earlier", ActionToSyncIdToOutput: map[int]int{}},
+			{Id: 1, Uid: "earlier", UserId: 1, TokenHash: hashToken("earlier token"),
+				ActionToSyncIdToOutput: map[int]int{}},
 		},
 	}
-	_, err := HandleBody(Body{DeviceUid: "new"}, model)
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "new",
+		UserUid:   "U",
+		Register:  true,
+		Token:     "earlier token",
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, []models.Device{
-		{Id: 1, Uid: "earlier", ActionToSyncIdToOutput: map[int]int{}},
-		{Id: 2, Uid: "new", ActionToSyncIdToOutput: map[int]int{}},
+		{Id: 1, Uid: "earlier", UserId: 1, TokenHash: hashToken("earlier token"),
+			ActionToSyncIdToOutput: map[int]int{}},
+		{Id: 2, Uid: "new", UserId: 1, TokenHash: hashToken(response.Token),
+			ActionToSyncIdToOutput: map[int]int{}},
 	}, model.Devices)
 }
 
@@ -38,64 +68,69 @@ func TestHandleBodyExistingDevice(t *testing.T) {
 	model := &models.MemoryModel{
 		NextDeviceId: 2,
 		Devices: []models.Device{
-			{Id: 1, Uid: "here", ActionToSyncIdToOutput: map[int]int{}},
+			{Id: 1, Uid: "here", TokenHash: hashToken("secret"),
+				ActionToSyncIdToOutput: map[int]int{}},
 		},
 	}
-	_, err := HandleBody(Body{DeviceUid: "here"}, model)
+	response, err := HandleBody(context.Background(),
+		Body{DeviceUid: "here", Token: "secret"}, model, Config{})
 	assert.Equal(t, nil, err)
+	assert.Equal(t, "", response.Token)
 	assert.Equal(t, []models.Device{
-		{Id: 1, Uid: "here", ActionToSyncIdToOutput: map[int]int{}},
+		{Id: 1, Uid: "here", TokenHash: hashToken("secret"),
+			ActionToSyncIdToOutput: map[int]int{}},
 	}, model.Devices)
 }
 
 func TestCreateNewDevice(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	response, err := HandleBody(context.Background(), Body{
 		DeviceUid:     "A",
+		UserUid:       "U",
+		Register:      true,
 		ActionsToSync: []models.ActionToSync{},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
+	assert.NotEqual(t, "", response.Token)
 	assert.Equal(t, []models.Device{{
-		Id:  1,
-		Uid: "A",
+		Id:                     1,
+		Uid:                    "A",
+		UserId:                 1,
+		TokenHash:              hashToken(response.Token),
 		ActionToSyncIdToOutput: map[int]int{},
 	}}, model.Devices)
 }
 
 func TestCreateSameDeviceTwice(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
-		DeviceUid:     "D",
-		ActionsToSync: []models.ActionToSync{},
-	}, model)
-	assert.Equal(t, nil, err)
-	_, err = HandleBody(Body{
+	token := mustRegister(t, model, "D", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid:     "D",
+		UserUid:       "U",
+		Register:      true,
+		Token:         token,
 		ActionsToSync: []models.ActionToSync{},
-	}, model)
-	assert.Equal(t, nil, err)
+	}, model, Config{})
+	assert.Equal(t, http.StatusConflict, StatusCodeForError(err))
 	assert.Equal(t, []models.Device{{
-		Id:  1,
-		Uid: "D",
+		Id:                     1,
+		Uid:                    "D",
+		UserId:                 1,
+		TokenHash:              hashToken(token),
 		ActionToSyncIdToOutput: map[int]int{},
 	}}, model.Devices)
 }
 
 func TestCreate2NewDevices(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
-		DeviceUid:     "B",
-		ActionsToSync: []models.ActionToSync{},
-	}, model)
-	assert.Equal(t, nil, err)
-	_, err = HandleBody(Body{
-		DeviceUid:     "C",
-		ActionsToSync: []models.ActionToSync{},
-	}, model)
-	assert.Equal(t, nil, err)
+	tokenB := mustRegister(t, model, "B", "U", "")
+	tokenC := mustRegister(t, model, "C", "U", tokenB)
+	assert.NotEqual(t, tokenB, tokenC)
 	assert.Equal(t, []models.Device{
-		{Id: 1, Uid: "B", ActionToSyncIdToOutput: map[int]int{}},
-		{Id: 2, Uid: "C", ActionToSyncIdToOutput: map[int]int{}},
+		{Id: 1, Uid: "B", UserId: 1, TokenHash: hashToken(tokenB),
+			ActionToSyncIdToOutput: map[int]int{}},
+		{Id: 2, Uid: "C", UserId: 1, TokenHash: hashToken(tokenC),
+			ActionToSyncIdToOutput: map[int]int{}},
 	}, model.Devices)
 }
 
@@ -103,12 +138,14 @@ func TestCreateTodo(t *testing.T) {
 	model := &models.MemoryModel{
 		NextDeviceId: 2,
 		Devices: []models.Device{
-			{Id: 1, Uid: "here", ActionToSyncIdToOutput: map[int]int{}},
+			{Id: 1, Uid: "here", TokenHash: hashToken("secret"),
+				ActionToSyncIdToOutput: map[int]int{}},
 		},
 		NextTodoId: 1,
 	}
-	_, err := HandleBody(Body{
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "here",
+		Token:     "secret",
 		ActionsToSync: []models.ActionToSync{{
 			Id:              1,
 			Type:            "TODOS/ADD_TODO",
@@ -116,20 +153,28 @@ func TestCreateTodo(t *testing.T) {
 			Title:           stringPtr("title"),
 			Completed:       boolPtr(true),
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, []models.Todo{{
-		Id:        1,
-		Title:     "title",
-		Completed: true,
+		Id:               1,
+		Title:            "title",
+		Completed:        true,
+		Position:         1024,
+		Revision:         1,
+		CreatedRevision:  1,
+		Version:          1,
+		TitleVersion:     1,
+		CompletedVersion: 1,
 	}}, model.Todos)
 	assert.Equal(t, 2, model.NextTodoId)
 }
 
 func TestCreateSameTodoTwice(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenHere := mustRegister(t, model, "here", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "here",
+		Token:     tokenHere,
 		ActionsToSync: []models.ActionToSync{
 			{
 				Id:              1,
@@ -145,20 +190,29 @@ func TestCreateSameTodoTwice(t *testing.T) {
 				Completed:       boolPtr(true),
 			},
 		},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, map[int]int{1: 1}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{{
-		Id:        1,
-		Title:     "title1",
-		Completed: true,
+		Id:               1,
+		UserId:           1,
+		Title:            "title1",
+		Completed:        true,
+		Position:         1024,
+		Revision:         1,
+		CreatedRevision:  1,
+		Version:          1,
+		TitleVersion:     1,
+		CompletedVersion: 1,
 	}}, model.Todos)
 }
 
 func TestCreate1ThenCreate1Update2(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              1,
 			Type:            "TODOS/ADD_TODO",
@@ -166,10 +220,11 @@ func TestCreate1ThenCreate1Update2(t *testing.T) {
 			Title:           stringPtr("title1"),
 			Completed:       boolPtr(false),
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
-	_, err = HandleBody(Body{
+	_, err = HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{
 			{
 				Id:              1,
@@ -184,20 +239,29 @@ func TestCreate1ThenCreate1Update2(t *testing.T) {
 				Completed:       boolPtr(true),
 			},
 		},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, map[int]int{1: 1, 2: 1}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{{
-		Id:        1,
-		Title:     "title1",
-		Completed: true,
+		Id:               1,
+		UserId:           1,
+		Title:            "title1",
+		Completed:        true,
+		Position:         1024,
+		Revision:         2,
+		CreatedRevision:  1,
+		Version:          2,
+		TitleVersion:     1,
+		CompletedVersion: 2,
 	}}, model.Todos)
 }
 
 func TestCreate1ThenDelete1(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              1,
 			Type:            "TODOS/ADD_TODO",
@@ -205,16 +269,17 @@ func TestCreate1ThenDelete1(t *testing.T) {
 			Title:           stringPtr("title"),
 			Completed:       boolPtr(false),
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
-	_, err = HandleBody(Body{
+	_, err = HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              2,
 			Type:            "TODOS/DELETE_TODO",
 			TodoIdMaybeTemp: 1,
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, map[int]int{1: 1, 2: 1}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{}, model.Todos)
@@ -222,8 +287,10 @@ func TestCreate1ThenDelete1(t *testing.T) {
 
 func TestCreate1ThenUpdate1(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              1,
 			Type:            "TODOS/ADD_TODO",
@@ -231,30 +298,40 @@ func TestCreate1ThenUpdate1(t *testing.T) {
 			Title:           stringPtr("title"),
 			Completed:       boolPtr(false),
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
-	_, err = HandleBody(Body{
+	_, err = HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              2,
 			Type:            "TODO/UPDATE_TODO",
 			TodoIdMaybeTemp: 1,
 			Completed:       boolPtr(true),
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, map[int]int{1: 1, 2: 1}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{{
-		Id:        1,
-		Title:     "title",
-		Completed: true,
+		Id:               1,
+		UserId:           1,
+		Title:            "title",
+		Completed:        true,
+		Position:         1024,
+		Revision:         2,
+		CreatedRevision:  1,
+		Version:          2,
+		TitleVersion:     1,
+		CompletedVersion: 2,
 	}}, model.Todos)
 }
 
 func TestCreate1Delete1(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{
 			{
 				Id:              1,
@@ -269,7 +346,7 @@ func TestCreate1Delete1(t *testing.T) {
 				TodoIdMaybeTemp: -1,
 			},
 		},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, map[int]int{1: 1, 2: 1}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{}, model.Todos)
@@ -277,8 +354,10 @@ func TestCreate1Delete1(t *testing.T) {
 
 func TestCreate1Update1(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{
 			{
 				Id:              1,
@@ -294,20 +373,29 @@ func TestCreate1Update1(t *testing.T) {
 				Completed:       boolPtr(true),
 			},
 		},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, map[int]int{1: 1, 2: 1}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{{
-		Id:        1,
-		Title:     "title",
-		Completed: true,
+		Id:               1,
+		UserId:           1,
+		Title:            "title",
+		Completed:        true,
+		Position:         1024,
+		Revision:         2,
+		CreatedRevision:  1,
+		Version:          2,
+		TitleVersion:     1,
+		CompletedVersion: 2,
 	}}, model.Todos)
 }
 
 func TestCreate2Todos(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              11,
 			Type:            "TODOS/ADD_TODO",
@@ -315,10 +403,11 @@ func TestCreate2Todos(t *testing.T) {
 			Title:           stringPtr("new title"),
 			Completed:       boolPtr(false),
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
-	_, err = HandleBody(Body{
+	_, err = HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              12,
 			Type:            "TODOS/ADD_TODO",
@@ -326,26 +415,42 @@ func TestCreate2Todos(t *testing.T) {
 			Title:           stringPtr("new title 2"),
 			Completed:       boolPtr(false),
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, map[int]int{11: 1, 12: 2}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{
 		{
-			Id:        1,
-			Title:     "new title",
-			Completed: false,
+			Id:               1,
+			UserId:           1,
+			Title:            "new title",
+			Completed:        false,
+			Position:         1024,
+			Revision:         1,
+			CreatedRevision:  1,
+			Version:          1,
+			TitleVersion:     1,
+			CompletedVersion: 1,
 		}, {
-			Id:        2,
-			Title:     "new title 2",
-			Completed: false,
+			Id:               2,
+			UserId:           1,
+			Title:            "new title 2",
+			Completed:        false,
+			Position:         2048,
+			Revision:         2,
+			CreatedRevision:  2,
+			Version:          1,
+			TitleVersion:     1,
+			CompletedVersion: 1,
 		},
 	}, model.Todos)
 }
 
 func TestCreate1Todo(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              1,
 			Type:            "TODOS/ADD_TODO",
@@ -353,20 +458,29 @@ func TestCreate1Todo(t *testing.T) {
 			Title:           stringPtr("new title"),
 			Completed:       boolPtr(false),
 		}},
-	}, model)
+	}, model, Config{})
 	assert.Equal(t, nil, err)
 	assert.Equal(t, map[int]int{1: 1}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{{
-		Id:        1,
-		Title:     "new title",
-		Completed: false,
+		Id:               1,
+		UserId:           1,
+		Title:            "new title",
+		Completed:        false,
+		Position:         1024,
+		Revision:         1,
+		CreatedRevision:  1,
+		Version:          1,
+		TitleVersion:     1,
+		CompletedVersion: 1,
 	}}, model.Todos)
 }
 
 func TestCreateTodoUpdateTitle(t *testing.T) {
 	model := models.NewMemoryModel()
-	_, err := HandleBody(Body{
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
 		DeviceUid: "A",
+		Token:     tokenA,
 		ActionsToSync: []models.ActionToSync{{
 			Id:              1,
 			Type:            "TODOS/ADD_TODO",
@@ -379,11 +493,432 @@ func TestCreateTodoUpdateTitle(t *testing.T) {
 			TodoIdMaybeTemp: -1,
 			Title:           stringPtr("new title"),
 		}},
-	}, model)
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []models.Todo{{
+		Id:               1,
+		UserId:           1,
+		Title:            "new title",
+		Completed:        false,
+		Position:         1024,
+		Revision:         2,
+		CreatedRevision:  1,
+		Version:          2,
+		TitleVersion:     2,
+		CompletedVersion: 1,
+	}}, model.Todos)
+}
+
+func TestCreateTodoMissingTitle(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODOS/ADD_TODO",
+			TodoIdMaybeTemp: -1,
+			Completed:       boolPtr(false),
+		}},
+	}, model, Config{})
+	assert.Equal(t, http.StatusBadRequest, StatusCodeForError(err))
+	assert.Equal(t, []models.Todo{}, model.Todos)
+}
+
+func TestStatusCodeForError(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, StatusCodeForError(
+		fmt.Errorf("Error from UpdateTodo: %w", models.ErrNotFound)))
+	assert.Equal(t, http.StatusConflict, StatusCodeForError(
+		fmt.Errorf("Error from CreateTodo: %w", models.ErrConflict)))
+	assert.Equal(t, http.StatusServiceUnavailable, StatusCodeForError(
+		fmt.Errorf("Error from ListTodos: %w", models.ErrUnavailable)))
+	assert.Equal(t, http.StatusBadRequest, StatusCodeForError(
+		fmt.Errorf("Blank DeviceUid")))
+	assert.Equal(t, true, NewErrorResponse(models.ErrUnavailable).Retriable)
+}
+
+func TestFailedActionRollsBackBatch(t *testing.T) {
+	model := models.NewMemoryModel()
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		UserUid:   "U",
+		Register:  true,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODOS/ADD_TODO",
+			TodoIdMaybeTemp: -1,
+			Title:           stringPtr("title"),
+			Completed:       boolPtr(false),
+		}, {
+			Id:              2,
+			Type:            "TODO/UPDATE_TODO",
+			TodoIdMaybeTemp: -2, // unknown temp id
+			Completed:       boolPtr(true),
+		}},
+	}, model, Config{})
+	assert.Error(t, err)
+	assert.Equal(t, []models.Device{}, model.Devices)
+	assert.Equal(t, []models.Todo{}, model.Todos)
+	assert.Equal(t, 1, model.NextTodoId)
+
+	// Retrying without the bad action creates the todo only once
+	_, err = HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		UserUid:   "U",
+		Register:  true,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODOS/ADD_TODO",
+			TodoIdMaybeTemp: -1,
+			Title:           stringPtr("title"),
+			Completed:       boolPtr(false),
+		}},
+	}, model, Config{})
 	assert.Equal(t, nil, err)
+	assert.Equal(t, map[int]int{1: 1}, model.Devices[0].ActionToSyncIdToOutput)
 	assert.Equal(t, []models.Todo{{
-		Id:        1,
-		Title:     "new title",
-		Completed: false,
+		Id:               1,
+		UserId:           1,
+		Title:            "title",
+		Completed:        false,
+		Position:         1024,
+		Revision:         1,
+		CreatedRevision:  1,
+		Version:          1,
+		TitleVersion:     1,
+		CompletedVersion: 1,
 	}}, model.Todos)
 }
+
+func TestCanceledContext(t *testing.T) {
+	model := models.NewMemoryModel()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := HandleBody(ctx, Body{
+		DeviceUid: "A",
+		UserUid:   "U",
+		Register:  true,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODOS/ADD_TODO",
+			TodoIdMaybeTemp: -1,
+			Title:           stringPtr("title"),
+			Completed:       boolPtr(false),
+		}},
+	}, model, Config{})
+	assert.Equal(t, true, errors.Is(err, context.Canceled))
+	assert.Equal(t, http.StatusServiceUnavailable, StatusCodeForError(err))
+	assert.Equal(t, []models.Todo{}, model.Todos)
+}
+
+func TestExpiredDeadline(t *testing.T) {
+	model := models.NewMemoryModel()
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	_, err := HandleBody(ctx, Body{DeviceUid: "A", UserUid: "U", Register: true},
+		model, Config{})
+	assert.Equal(t, http.StatusGatewayTimeout, StatusCodeForError(err))
+	assert.Equal(t, true, NewErrorResponse(err).Retriable)
+	assert.Equal(t, []models.Device{}, model.Devices)
+}
+
+func intPtr(i int) *int { return &i }
+
+func TestSyncWithCursor(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODOS/ADD_TODO",
+			TodoIdMaybeTemp: -1,
+			Title:           stringPtr("first"),
+			Completed:       boolPtr(false),
+		}, {
+			Id:              2,
+			Type:            "TODOS/ADD_TODO",
+			TodoIdMaybeTemp: -2,
+			Title:           stringPtr("second"),
+			Completed:       boolPtr(false),
+		}},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, response.Cursor)
+	assert.Equal(t, 2, len(response.Todos))
+
+	// Nothing changed since the cursor
+	response, err = HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		Cursor:    intPtr(2),
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []models.Todo{}, response.Todos)
+	assert.Equal(t, []int{}, response.DeletedTodoIds)
+	assert.Equal(t, 2, response.Cursor)
+
+	_, err = HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              3,
+			Type:            "TODO/UPDATE_TODO",
+			TodoIdMaybeTemp: 2,
+			Completed:       boolPtr(true),
+		}, {
+			Id:              4,
+			Type:            "TODOS/DELETE_TODO",
+			TodoIdMaybeTemp: 1,
+		}},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+
+	response, err = HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		Cursor:    intPtr(2),
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []models.Todo{{
+		Id:               2,
+		UserId:           1,
+		Title:            "second",
+		Completed:        true,
+		Position:         2048,
+		Revision:         3,
+		CreatedRevision:  2,
+		Version:          2,
+		TitleVersion:     1,
+		CompletedVersion: 2,
+	}}, response.Todos)
+	assert.Equal(t, []int{1}, response.DeletedTodoIds)
+	assert.Equal(t, 4, response.Cursor)
+
+	// Without a cursor, the full list comes back and tombstones are left out
+	response, err = HandleBody(context.Background(), Body{DeviceUid: "B", Token: tokenB}, model,
+		Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(response.Todos))
+	assert.Equal(t, []int(nil), response.DeletedTodoIds)
+	assert.Equal(t, 4, response.Cursor)
+}
+
+func TestNewDeviceNeedsUserUid(t *testing.T) {
+	model := models.NewMemoryModel()
+	_, err := HandleBody(context.Background(),
+		Body{DeviceUid: "A", Register: true}, model, Config{})
+	assert.EqualError(t, err, "Blank UserUid for new device")
+	assert.Equal(t, []models.Device{}, model.Devices)
+}
+
+func TestDeviceOfAnotherUser(t *testing.T) {
+	model := models.NewMemoryModel()
+	token := mustRegister(t, model, "A", "U", "")
+	mustRegister(t, model, "B", "V", "")
+
+	_, err := HandleBody(context.Background(),
+		Body{DeviceUid: "A", UserUid: "V", Token: token}, model, Config{})
+	assert.Equal(t, true, errors.Is(err, ErrForbidden))
+	assert.Equal(t, http.StatusForbidden, StatusCodeForError(err))
+}
+
+func TestTodosScopedToUser(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "V", "")
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODOS/ADD_TODO",
+			TodoIdMaybeTemp: -1,
+			Title:           stringPtr("U's todo"),
+			Completed:       boolPtr(false),
+		}},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+
+	// Another user's device guesses the todo's ID
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		ActionsToSync: []models.ActionToSync{{
+			Id:              1,
+			Type:            "TODO/UPDATE_TODO",
+			TodoIdMaybeTemp: 1,
+			Title:           stringPtr("hijacked"),
+			BaseVersion:     intPtr(1),
+		}, {
+			Id:              2,
+			Type:            "TODOS/DELETE_TODO",
+			TodoIdMaybeTemp: 1,
+		}},
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]int{"1": 0, "2": 0}, response.ActionToSyncIdToOutput)
+	assert.Equal(t, []models.Todo{}, response.Todos)
+	assert.Equal(t, "U's todo", model.Todos[0].Title)
+
+	response, err = HandleBody(context.Background(),
+		Body{DeviceUid: "A", Token: tokenA}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(response.Todos))
+}
+
+func TestTodoHistory(t *testing.T) {
+	model := models.NewMemoryModel()
+	config := Config{ConflictPolicy: MergeFields{}}
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	tokenC := mustRegister(t, model, "C", "V", "")
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+				Title: stringPtr("first"), Completed: boolPtr(false)},
+			{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: -1,
+				Title: stringPtr("first by A"), BaseVersion: intPtr(1)},
+		},
+	}, model, config)
+	assert.Equal(t, nil, err)
+
+	// Only B's completed survives the conflict; the missing todo's update
+	// changes nothing, so it's left out
+	_, err = HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 1, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+				Title: stringPtr("first by B"), Completed: boolPtr(true),
+				BaseVersion: intPtr(1)},
+			{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 99,
+				Completed: boolPtr(true)},
+		},
+	}, model, config)
+	assert.Equal(t, nil, err)
+
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 3, Type: "TODOS/DELETE_TODO", TodoIdMaybeTemp: 1},
+		},
+		HistoryTodoId: 1,
+	}, model, config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(response.TodoHistory))
+	for i, expected := range []models.TodoChange{
+		{Id: 1, UserId: 1, TodoId: 1, DeviceId: 1, ActionToSyncId: 1,
+			Type: "TODOS/ADD_TODO", Title: stringPtr("first"),
+			Completed: boolPtr(false)},
+		{Id: 2, UserId: 1, TodoId: 1, DeviceId: 1, ActionToSyncId: 2,
+			Type: "TODO/UPDATE_TODO", Title: stringPtr("first by A")},
+		{Id: 3, UserId: 1, TodoId: 1, DeviceId: 2, ActionToSyncId: 1,
+			Type: "TODO/UPDATE_TODO", Completed: boolPtr(true)},
+		{Id: 4, UserId: 1, TodoId: 1, DeviceId: 1, ActionToSyncId: 3,
+			Type: "TODOS/DELETE_TODO"},
+	} {
+		change := response.TodoHistory[i]
+		assert.Equal(t, false, change.ServerTime.IsZero())
+		change.ServerTime = expected.ServerTime
+		assert.Equal(t, expected, change)
+	}
+
+	// Another user can't see it
+	response, err = HandleBody(context.Background(),
+		Body{DeviceUid: "C", Token: tokenC, HistoryTodoId: 1}, model, config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []models.TodoChange{}, response.TodoHistory)
+}
+
+func TestToggleAll(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "V", "")
+	mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("first"), Completed: boolPtr(false)},
+		models.ActionToSync{Id: 2, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -2,
+			Title: stringPtr("second"), Completed: boolPtr(true)})
+	mustSync(t, model, "B", tokenB,
+		models.ActionToSync{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("other user's"), Completed: boolPtr(false)})
+
+	response := mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 3, Type: "TODOS/TOGGLE_ALL",
+			Completed: boolPtr(true)})
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["3"])
+	assert.Equal(t, true, response.Todos[0].Completed)
+	assert.Equal(t, true, response.Todos[1].Completed)
+	assert.Equal(t, false, model.Todos[2].Completed)
+
+	response = mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 4, Type: "TODOS/TOGGLE_ALL",
+			Completed: boolPtr(false)})
+	assert.Equal(t, 2, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, false, response.Todos[0].Completed)
+	assert.Equal(t, false, response.Todos[1].Completed)
+
+	// Each todo's history has the change, and undo reverses all of them
+	changes, _ := model.ListTodoChanges(context.Background(), 1, 2)
+	assert.Equal(t, 2, len(changes))
+	assert.Equal(t, "TODOS/TOGGLE_ALL", changes[1].Type)
+	assert.Equal(t, boolPtr(false), changes[1].Completed)
+	response = mustSync(t, model, "A", tokenA, undoOf(5, 4))
+	assert.Equal(t, 2, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, true, response.Todos[0].Completed)
+	assert.Equal(t, true, response.Todos[1].Completed)
+
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 6, Type: "TODOS/TOGGLE_ALL"},
+		},
+	}, model, Config{})
+	assert.EqualError(t, err, "Error from handleActionToSync: Missing completed "+
+		"in action {6 TODOS/TOGGLE_ALL 0 <nil> <nil> <nil> <nil> <nil> <nil> "+
+		"<nil> <nil> <nil> <nil> <nil> <nil> <nil>}")
+}
+
+func TestClearCompleted(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	response := mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("first"), Completed: boolPtr(true)},
+		models.ActionToSync{Id: 2, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -2,
+			Title: stringPtr("second"), Completed: boolPtr(false)},
+		models.ActionToSync{Id: 3, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -3,
+			Title: stringPtr("third"), Completed: boolPtr(true)})
+	cursor := response.Cursor
+
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 4, Type: "TODOS/CLEAR_COMPLETED"},
+			{Id: 5, Type: "TODOS/CLEAR_COMPLETED"},
+		},
+		Cursor: &cursor,
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, []int{1, 3}, response.DeletedTodoIds)
+	assert.Equal(t, 1, len(model.Todos))
+
+	response = mustSync(t, model, "A", tokenA, undoOf(6, 4))
+	assert.Equal(t, 2, response.ActionToSyncIdToOutput["6"])
+	assert.Equal(t, 3, len(response.Todos))
+	assert.Equal(t, "third", response.Todos[2].Title)
+
+	assert.Equal(t, nil, RebuildTodos(context.Background(), model, Config{}))
+	assert.Equal(t, 3, len(model.Todos))
+}
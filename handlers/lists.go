@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+	"sort"
+)
+
+// ResponseList is a list with its todos in the Response, and who it's shared
+// with
+type ResponseList struct {
+	models.TodoList
+	// Todos is left out if none of the list's todos are in the Response
+	Todos []models.Todo `json:"todos,omitempty"`
+	// Members has everyone the list is shared with, including its owner
+	Members []models.ListMember `json:"members,omitempty"`
+	// Invites is only set for the list's owner
+	Invites []models.ListInvite `json:"invites,omitempty"`
+}
+
+// addList handles LISTS/ADD_LIST, and returns the new list's id
+func addList(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, userId int) (int, error) {
+	if actionToSync.Name == nil {
+		return 0, fmt.Errorf("Missing name in action %v", actionToSync)
+	}
+	log.Printf("  Calling CreateTodoList(%v)", actionToSync)
+	list, err := model.CreateTodoList(ctx, userId, actionToSync)
+	if err != nil {
+		return 0, fmt.Errorf("Error from CreateTodoList: %w", err)
+	}
+	return list.Id, nil
+}
+
+// updateList handles LIST/UPDATE_LIST, which renames or (un)archives a list,
+// and returns the number of lists updated, 0 or 1
+func updateList(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, userId int) (int, error) {
+	if actionToSync.ListIdMaybeTemp == nil {
+		return 0, fmt.Errorf("Missing listIdMaybeTemp in action %v", actionToSync)
+	}
+	log.Printf("  Calling UpdateTodoList(%v)", actionToSync)
+	output, err := model.UpdateTodoList(ctx, userId, actionToSync,
+		*actionToSync.ListIdMaybeTemp)
+	if err != nil {
+		return 0, fmt.Errorf("Error from UpdateTodoList: %w", err)
+	}
+	return output, nil
+}
+
+// deleteList handles LISTS/DELETE_LIST, which deletes the list and its
+// todos, recording each todo's deletion in its history.  Returns the number
+// of lists deleted, 0 or 1.
+func deleteList(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, source actionSource) (int, error) {
+	if actionToSync.ListIdMaybeTemp == nil {
+		return 0, fmt.Errorf("Missing listIdMaybeTemp in action %v", actionToSync)
+	}
+	listId := *actionToSync.ListIdMaybeTemp
+	if _, err := model.FindTodoList(ctx, source.UserId,
+		listId); errors.Is(err, models.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error from FindTodoList: %w", err)
+	}
+
+	todos, err := model.ListTodos(ctx, source.UserId)
+	if err != nil {
+		return 0, fmt.Errorf("Error from ListTodos: %w", err)
+	}
+	change := models.ActionToSync{Id: actionToSync.Id, Type: actionToSync.Type}
+	for _, todo := range todos {
+		if todo.ListId != listId {
+			continue
+		}
+		output, err := model.DeleteTodo(ctx, source.UserId, todo.Id)
+		if err != nil {
+			return 0, fmt.Errorf("Error from DeleteTodo: %w", err)
+		}
+		if output > 0 {
+			if err := recordTodoChange(ctx, model, source, change,
+				todo.Id); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	log.Printf("  Calling DeleteTodoList(%d)", listId)
+	output, err := model.DeleteTodoList(ctx, source.UserId, listId)
+	if err != nil {
+		return 0, fmt.Errorf("Error from DeleteTodoList: %w", err)
+	}
+	return output, nil
+}
+
+// existingListId returns the list to add a todo to: the one in actionToSync,
+// or 0 if that's been deleted (maybe by another device while this one was
+// offline), so the todo isn't lost
+func existingListId(ctx context.Context, model models.Model, userId int,
+	listId int) (int, error) {
+	if listId == 0 {
+		return 0, nil
+	}
+	if _, err := model.FindTodoList(ctx, userId,
+		listId); errors.Is(err, models.ErrNotFound) {
+		log.Printf("  No list %d, so using none", listId)
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error from FindTodoList: %w", err)
+	}
+	return listId, nil
+}
+
+// groupTodosByList returns lists, plus the lists of any todos not in them,
+// ordered by Id, each with its todos, and the todos that aren't in a list
+func groupTodosByList(ctx context.Context, model models.Model,
+	todos []models.Todo, lists []models.TodoList) ([]ResponseList,
+	[]models.Todo, error) {
+	idToList := map[int]*ResponseList{}
+	for _, list := range lists {
+		idToList[list.Id] = &ResponseList{TodoList: list}
+	}
+	unlisted := []models.Todo{}
+	for _, todo := range todos {
+		if todo.ListId == 0 {
+			unlisted = append(unlisted, todo)
+			continue
+		}
+		group, ok := idToList[todo.ListId]
+		if !ok {
+			// Maybe another user's, shared with this one
+			list, err := model.FindTodoListById(ctx, todo.ListId)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Error from FindTodoListById: %w", err)
+			}
+			group = &ResponseList{TodoList: list}
+			idToList[list.Id] = group
+		}
+		group.Todos = append(group.Todos, todo)
+	}
+
+	grouped := []ResponseList{}
+	for _, group := range idToList {
+		grouped = append(grouped, *group)
+	}
+	sort.Slice(grouped, func(i, j int) bool {
+		return grouped[i].Id < grouped[j].Id
+	})
+	return grouped, unlisted, nil
+}
@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"context"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func addListAction(id int, tempId int, name string) models.ActionToSync {
+	return models.ActionToSync{Id: id, Type: "LISTS/ADD_LIST",
+		ListIdMaybeTemp: intPtr(tempId), Name: stringPtr(name)}
+}
+
+func addTodoToList(id int, tempId int, listId int) models.ActionToSync {
+	action := addTodo(id, tempId, "in list")
+	action.ListIdMaybeTemp = intPtr(listId)
+	return action
+}
+
+func TestLists(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	response := mustSync(t, model, "A", tokenA,
+		addListAction(1, -1, "groceries"),
+		addTodoToList(2, -1, -1),
+		addTodo(3, -2, "in no list"),
+		models.ActionToSync{Id: 4, Type: "LIST/UPDATE_LIST",
+			ListIdMaybeTemp: intPtr(-1), Name: stringPtr("shopping")},
+		addListAction(5, -2, "old"),
+		models.ActionToSync{Id: 6, Type: "LIST/UPDATE_LIST",
+			ListIdMaybeTemp: intPtr(-2), Archived: boolPtr(true)})
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["1"])
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, 2, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["6"])
+	assert.Equal(t, []int{2}, todoIds(response.Todos))
+	assert.Equal(t, 0, response.Todos[0].ListId)
+
+	assert.Equal(t, 2, len(response.Lists))
+	assert.Equal(t, "shopping", response.Lists[0].Name)
+	assert.Equal(t, []int{1}, todoIds(response.Lists[0].Todos))
+	assert.Equal(t, 1, response.Lists[0].Todos[0].ListId)
+	assert.Equal(t, "old", response.Lists[1].Name)
+	assert.Equal(t, true, response.Lists[1].Archived)
+	assert.Equal(t, []int{}, todoIds(response.Lists[1].Todos))
+
+	// The log has the real list ids, so it can be replayed
+	assert.Equal(t, 1, *model.ActionEvents[1].Action.ListIdMaybeTemp)
+	lists := model.TodoLists
+	todos := model.Todos
+	assert.Equal(t, nil, RebuildTodos(context.Background(), model, Config{}))
+	assert.Equal(t, lists, model.TodoLists)
+	assert.Equal(t, todoIds(todos), todoIds(model.Todos))
+	assert.Equal(t, 1, model.Todos[0].ListId)
+}
+
+func TestListsOfOtherUsers(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenC := mustRegister(t, model, "C", "V", "")
+	mustSync(t, model, "A", tokenA, addListAction(1, -1, "mine"))
+
+	response := mustSync(t, model, "C", tokenC,
+		models.ActionToSync{Id: 1, Type: "LIST/UPDATE_LIST",
+			ListIdMaybeTemp: intPtr(1), Name: stringPtr("stolen")},
+		models.ActionToSync{Id: 2, Type: "LISTS/DELETE_LIST",
+			ListIdMaybeTemp: intPtr(1)},
+		addTodoToList(3, -1, 1))
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["1"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["2"])
+	// Added to no list instead
+	assert.Equal(t, 0, response.Todos[0].ListId)
+	assert.Equal(t, 0, len(response.Lists))
+
+	response = mustSync(t, model, "A", tokenA)
+	assert.Equal(t, "mine", response.Lists[0].Name)
+}
+
+func TestListScopedBulkActions(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustSync(t, model, "A", tokenA,
+		addListAction(1, -1, "list"), addTodoToList(2, -1, -1),
+		addTodoToList(3, -2, -1), addTodo(4, -3, "in no list"))
+
+	response := mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 5, Type: "TODOS/TOGGLE_ALL",
+			ListIdMaybeTemp: intPtr(1), Completed: boolPtr(true)},
+		models.ActionToSync{Id: 6, Type: "TODOS/TOGGLE_ALL",
+			ListIdMaybeTemp: intPtr(0), Completed: boolPtr(true)},
+		models.ActionToSync{Id: 7, Type: "TODOS/CLEAR_COMPLETED",
+			ListIdMaybeTemp: intPtr(1)})
+	assert.Equal(t, 2, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["6"])
+	assert.Equal(t, 2, response.ActionToSyncIdToOutput["7"])
+	assert.Equal(t, []int{3}, todoIds(response.Todos))
+	assert.Equal(t, true, response.Todos[0].Completed)
+}
+
+func TestDeleteList(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	response := mustSync(t, model, "A", tokenA,
+		addListAction(1, -1, "list"), addTodoToList(2, -1, -1),
+		addTodo(3, -2, "in no list"))
+	cursor := response.Cursor
+
+	response = mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 4, Type: "LISTS/DELETE_LIST",
+			ListIdMaybeTemp: intPtr(1)})
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, []int{2}, todoIds(response.Todos))
+	history, _ := model.ListTodoChanges(context.Background(), 1, 1)
+	assert.Equal(t, "LISTS/DELETE_LIST", history[1].Type)
+
+	// B was offline, so only now finds out, after adding to the list
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		ActionsToSync: []models.ActionToSync{
+			addTodoToList(1, -1, 1),
+		},
+		Cursor: &cursor,
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{1}, response.DeletedTodoIds)
+	assert.Equal(t, []int{1}, response.DeletedListIds)
+	assert.Equal(t, []int{3}, todoIds(response.Todos))
+	assert.Equal(t, 0, response.Todos[0].ListId)
+	assert.Equal(t, 0, len(response.Lists))
+}
+
+func TestUndoDeleteRestoresToList(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustSync(t, model, "A", tokenA,
+		addListAction(1, -1, "list"), addTodoToList(2, -1, -1),
+		models.ActionToSync{Id: 3, Type: "TODOS/DELETE_TODO", TodoIdMaybeTemp: 1})
+
+	response := mustSync(t, model, "A", tokenA, undoOf(4, 3))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, []int{1}, todoIds(response.Lists[0].Todos))
+	assert.Equal(t, 1, response.Lists[0].Todos[0].ListId)
+}
+
+func TestMoveTodoBetweenListsDoesNothing(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	response := mustSync(t, model, "A", tokenA,
+		addListAction(1, -1, "list"), addTodoToList(2, -1, -1),
+		addTodo(3, -2, "in no list"),
+		models.ActionToSync{Id: 4, Type: "TODO/MOVE_TODO", TodoIdMaybeTemp: -2,
+			BeforeTodoIdMaybeTemp: intPtr(-1)})
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, []int{1}, todoIds(response.Lists[0].Todos))
+	assert.Equal(t, []int{2}, todoIds(response.Todos))
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+)
+
+// moveTodo moves the todo just before actionToSync.BeforeTodoIdMaybeTemp, or
+// just after actionToSync.AfterTodoIdMaybeTemp, and returns the number of
+// todos moved, 0 or 1.  If either todo is missing, or they're in different
+// lists, it does nothing.  Only the moved todo's Position changes, unless its
+// neighbors' Positions are too close, in which case the user's todos are
+// renumbered first.
+func moveTodo(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, userId int, todoId int) (int, error) {
+	var targetId int
+	var before bool
+	if actionToSync.BeforeTodoIdMaybeTemp != nil &&
+		actionToSync.AfterTodoIdMaybeTemp == nil {
+		targetId, before = *actionToSync.BeforeTodoIdMaybeTemp, true
+	} else if actionToSync.AfterTodoIdMaybeTemp != nil &&
+		actionToSync.BeforeTodoIdMaybeTemp == nil {
+		targetId, before = *actionToSync.AfterTodoIdMaybeTemp, false
+	} else {
+		return 0, fmt.Errorf("Need exactly one of beforeTodoIdMaybeTemp and "+
+			"afterTodoIdMaybeTemp in action %v", actionToSync)
+	}
+	if targetId == todoId {
+		return 0, nil
+	}
+
+	for renumbered := false; ; renumbered = true {
+		todos, err := model.ListTodos(ctx, userId)
+		if err != nil {
+			return 0, fmt.Errorf("Error from ListTodos: %w", err)
+		}
+		position, found, hasRoom := positionNextTo(todos, todoId, targetId, before)
+		if !found {
+			return 0, nil
+		}
+		if hasRoom {
+			log.Printf("  Calling MoveTodo(%d, %d)", todoId, position)
+			output, err := model.MoveTodo(ctx, userId, todoId, position)
+			if err != nil {
+				return 0, fmt.Errorf("Error from MoveTodo: %w", err)
+			}
+			return output, nil
+		}
+		if renumbered {
+			return 0, fmt.Errorf("No room to move todo %d even after renumbering",
+				todoId)
+		}
+		log.Printf("  Calling RenumberTodos")
+		if err := model.RenumberTodos(ctx, userId); err != nil {
+			return 0, fmt.Errorf("Error from RenumberTodos: %w", err)
+		}
+	}
+}
+
+// positionNextTo returns a Position putting the todo with todoId just before
+// or after the one with targetId, given todos in order.  found is false if
+// either is missing or they're in different lists, and hasRoom is false if no
+// integer fits between the new neighbors' Positions.
+func positionNextTo(todos []models.Todo, todoId int, targetId int,
+	before bool) (position int, found bool, hasRoom bool) {
+	var moving *models.Todo
+	for i, todo := range todos {
+		if todo.Id == todoId {
+			moving = &todos[i]
+		}
+	}
+	if moving == nil {
+		return 0, false, false
+	}
+	// Only the todos in the same list are neighbors
+	others := []models.Todo{}
+	for _, todo := range todos {
+		if todo.Id != todoId && todo.ListId == moving.ListId {
+			others = append(others, todo)
+		}
+	}
+	targetIndex := -1
+	for i, todo := range others {
+		if todo.Id == targetId {
+			targetIndex = i
+		}
+	}
+	if targetIndex == -1 {
+		return 0, false, false
+	}
+
+	var prev, next *models.Todo
+	if before {
+		next = &others[targetIndex]
+		if targetIndex > 0 {
+			prev = &others[targetIndex-1]
+		}
+	} else {
+		prev = &others[targetIndex]
+		if targetIndex+1 < len(others) {
+			next = &others[targetIndex+1]
+		}
+	}
+
+	switch {
+	case prev == nil:
+		return next.Position - models.TodoPositionGap, true, true
+	case next == nil:
+		return prev.Position + models.TodoPositionGap, true, true
+	case next.Position-prev.Position >= 2:
+		return prev.Position + (next.Position-prev.Position)/2, true, true
+	default:
+		return 0, true, false
+	}
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"context"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+)
+
+func todoIds(todos []models.Todo) []int {
+	ids := []int{}
+	for _, todo := range todos {
+		ids = append(ids, todo.Id)
+	}
+	return ids
+}
+
+func addTodo(id int, tempId int, title string) models.ActionToSync {
+	return models.ActionToSync{Id: id, Type: "TODOS/ADD_TODO",
+		TodoIdMaybeTemp: tempId, Title: stringPtr(title),
+		Completed: boolPtr(false)}
+}
+
+func TestMoveTodo(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustSync(t, model, "A", tokenA,
+		addTodo(1, -1, "first"), addTodo(2, -2, "second"),
+		addTodo(3, -3, "third"))
+
+	response := mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 4, Type: "TODO/MOVE_TODO", TodoIdMaybeTemp: 3,
+			BeforeTodoIdMaybeTemp: intPtr(1)},
+		models.ActionToSync{Id: 5, Type: "TODO/MOVE_TODO", TodoIdMaybeTemp: 1,
+			AfterTodoIdMaybeTemp: intPtr(2)},
+		// Missing target
+		models.ActionToSync{Id: 6, Type: "TODO/MOVE_TODO", TodoIdMaybeTemp: 1,
+			AfterTodoIdMaybeTemp: intPtr(99)})
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["6"])
+	assert.Equal(t, []int{3, 2, 1}, todoIds(response.Todos))
+	// Moving doesn't change the Version, so it can't conflict with edits
+	assert.Equal(t, 1, response.Todos[0].Version)
+}
+
+func TestMoveTodoWithTempIds(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	response := mustSync(t, model, "A", tokenA,
+		addTodo(1, -1, "first"), addTodo(2, -2, "second"),
+		models.ActionToSync{Id: 3, Type: "TODO/MOVE_TODO", TodoIdMaybeTemp: -2,
+			BeforeTodoIdMaybeTemp: intPtr(-1)})
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["3"])
+	assert.Equal(t, []int{2, 1}, todoIds(response.Todos))
+
+	// The logged action refers to the real id, so it can be replayed
+	event := model.ActionEvents[2]
+	assert.Equal(t, 1, *event.Action.BeforeTodoIdMaybeTemp)
+
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid: "A",
+		Token:     tokenA,
+		ActionsToSync: []models.ActionToSync{{Id: 4, Type: "TODO/MOVE_TODO",
+			TodoIdMaybeTemp: 1, AfterTodoIdMaybeTemp: intPtr(-9)}},
+	}, model, Config{})
+	assert.Error(t, err)
+}
+
+func TestMoveTodoNeedsOneTarget(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustSync(t, model, "A", tokenA, addTodo(1, -1, "first"))
+	for _, action := range []models.ActionToSync{
+		{Id: 2, Type: "TODO/MOVE_TODO", TodoIdMaybeTemp: 1},
+		{Id: 2, Type: "TODO/MOVE_TODO", TodoIdMaybeTemp: 1,
+			BeforeTodoIdMaybeTemp: intPtr(1), AfterTodoIdMaybeTemp: intPtr(1)},
+	} {
+		_, err := HandleBody(context.Background(), Body{
+			DeviceUid:     "A",
+			Token:         tokenA,
+			ActionsToSync: []models.ActionToSync{action},
+		}, model, Config{})
+		assert.Error(t, err)
+	}
+}
+
+func TestMoveTodoRenumbersWhenOutOfRoom(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustSync(t, model, "A", tokenA,
+		addTodo(1, -1, "first"), addTodo(2, -2, "second"),
+		addTodo(3, -3, "third"))
+	// Repeatedly moving into the same gap halves it until nothing fits
+	actions := []models.ActionToSync{}
+	for i := 0; i < 12; i++ {
+		todoId := 2 + i%2
+		actions = append(actions, models.ActionToSync{Id: 4 + i,
+			Type: "TODO/MOVE_TODO", TodoIdMaybeTemp: todoId,
+			AfterTodoIdMaybeTemp: intPtr(1)})
+	}
+	response := mustSync(t, model, "A", tokenA, actions...)
+	for i := range actions {
+		assert.Equal(t, 1, response.ActionToSyncIdToOutput[strconv.Itoa(4+i)])
+	}
+	assert.Equal(t, []int{1, 3, 2}, todoIds(response.Todos))
+
+	// Replaying the log renumbers at the same point
+	todos, _ := model.ListTodos(context.Background(), 1)
+	assert.Equal(t, nil, RebuildTodos(context.Background(), model, Config{}))
+	rebuilt, _ := model.ListTodos(context.Background(), 1)
+	assert.Equal(t, todoIds(todos), todoIds(rebuilt))
+	for i := range todos {
+		assert.Equal(t, todos[i].Position, rebuilt[i].Position)
+	}
+}
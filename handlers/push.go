@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Push tells subscribers that a HandleBody call changed todos or lists
+type Push struct {
+	// UserIds are the users who may see the changes: the device's user, and
+	// the other members of every list they're a member of
+	UserIds []int `json:"userIds"`
+	// DeviceId made the changes, so it isn't told about them
+	DeviceId int `json:"deviceId"`
+	// Revision is the Response.Cursor of the call that made the changes
+	Revision int `json:"revision"`
+}
+
+// Hub fans Pushes out to the subscribed devices of their users.  It's
+// in-process, so it works the same with every Model, but with a
+// ChangeNotifier model, like DbModel, it also tells the hubs of other
+// processes, which get the pushes with PublishNotification.
+type Hub struct {
+	// id tells this hub's notifications apart from other processes'
+	id string
+
+	mutex         sync.Mutex // for the fields below
+	subscriptions map[*Subscription]bool
+}
+
+func NewHub() *Hub {
+	hostname, _ := os.Hostname()
+	return &Hub{
+		id: fmt.Sprintf("%s/%d/%d", hostname, os.Getpid(),
+			time.Now().UnixNano()),
+		subscriptions: map[*Subscription]bool{},
+	}
+}
+
+// Subscription receives the Pushes for one device until it's closed
+type Subscription struct {
+	// C gets the latest Push not yet received.  Pushes that arrive while one
+	// is waiting replace it, since syncing from a cursor catches up on both.
+	C        chan Push
+	hub      *Hub
+	userId   int
+	deviceId int
+}
+
+// Subscribe starts receiving the Pushes that the user may see, except those
+// the device made itself
+func (hub *Hub) Subscribe(userId int, deviceId int) *Subscription {
+	subscription := &Subscription{
+		C:        make(chan Push, 1),
+		hub:      hub,
+		userId:   userId,
+		deviceId: deviceId,
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	hub.subscriptions[subscription] = true
+	return subscription
+}
+
+func (subscription *Subscription) Close() {
+	hub := subscription.hub
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	delete(hub.subscriptions, subscription)
+}
+
+// Publish sends the push to its subscribers without waiting for them
+func (hub *Hub) Publish(push Push) {
+	hub.publish(push, false)
+}
+
+// publish sends the push to every subscriber if toAll
+func (hub *Hub) publish(push Push, toAll bool) {
+	userIds := map[int]bool{}
+	for _, userId := range push.UserIds {
+		userIds[userId] = true
+	}
+
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for subscription := range hub.subscriptions {
+		if !toAll && (!userIds[subscription.userId] ||
+			subscription.deviceId == push.DeviceId) {
+			continue
+		}
+		// Only the publishers send to C, and they hold the mutex, so C has
+		// room after emptying it
+		select {
+		case <-subscription.C:
+		default:
+		}
+		subscription.C <- push
+	}
+}
+
+// ChangeNotifier is implemented by models that can tell other processes
+// about changes once the transaction making them commits, like DbModel
+type ChangeNotifier interface {
+	NotifyChange(ctx context.Context, payload string) error
+}
+
+// pushNotification is a Push sent between processes' hubs
+type pushNotification struct {
+	HubId string `json:"hubId"`
+	Push  Push   `json:"push"`
+	// ToAll is set instead of Push.UserIds when they don't fit in a payload,
+	// and tells every subscriber to sync
+	ToAll bool `json:"toAll,omitempty"`
+}
+
+// maxNotifyPayload is a little under the 8000 bytes at which PostgreSQL
+// refuses a NOTIFY, failing the transaction
+const maxNotifyPayload = 7900
+
+// notify sends the push to the other processes' hubs, if the model can, and
+// to all of their subscribers if toAll
+func (hub *Hub) notify(ctx context.Context, model models.Model, push Push,
+	toAll bool) error {
+	notifier, ok := model.(ChangeNotifier)
+	if !ok {
+		return nil
+	}
+	notification := pushNotification{HubId: hub.id, Push: push, ToAll: toAll}
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("Error marshaling JSON %v: %w", push, err)
+	}
+	if len(payload) > maxNotifyPayload {
+		notification.Push.UserIds = nil
+		notification.ToAll = true
+		if payload, err = json.Marshal(notification); err != nil {
+			return fmt.Errorf("Error marshaling JSON %v: %w", push, err)
+		}
+	}
+	if err := notifier.NotifyChange(ctx, string(payload)); err != nil {
+		return fmt.Errorf("Error from NotifyChange: %w", err)
+	}
+	return nil
+}
+
+// PublishNotification publishes a Push from a ChangeNotifier payload, unless
+// this hub sent it and so published it already.  A blank payload means some
+// may have been missed, so every subscriber is told to sync, as they are for
+// pushes to too many users to list.
+func (hub *Hub) PublishNotification(payload string) error {
+	if payload == "" {
+		hub.publish(Push{}, true)
+		return nil
+	}
+	var notification pushNotification
+	if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+		return fmt.Errorf("Error parsing JSON %s: %w", payload, err)
+	}
+	if notification.HubId != hub.id {
+		hub.publish(notification.Push, notification.ToAll)
+	}
+	return nil
+}
+
+// addPushUserIds adds the users who may see changes made by userId, or to
+// any list shared with them
+func addPushUserIds(ctx context.Context, model models.Model, userId int,
+	userIds map[int]bool) error {
+	userIds[userId] = true
+	memberships, err := model.ListMemberships(ctx, userId)
+	if err != nil {
+		return fmt.Errorf("Error from ListMemberships: %w", err)
+	}
+	for _, membership := range memberships {
+		members, err := model.ListListMembers(ctx, membership.ListId)
+		if err != nil {
+			return fmt.Errorf("Error from ListListMembers: %w", err)
+		}
+		for _, member := range members {
+			userIds[member.UserId] = true
+		}
+	}
+	return nil
+}
+
+// PushSession follows the changes that other devices make to the todos a
+// device can see, e.g. for a WebSocket connection or an event stream
+type PushSession struct {
+	body         Body
+	model        models.Model
+	config       Config
+	subscription *Subscription
+	cursor       int
+}
+
+// StartPushSession authenticates the body's device, subscribes it to
+// config.Hub, and returns the Response to the body, which can't have any
+// actions or anything else to do besides syncing
+func StartPushSession(ctx context.Context, body Body, model models.Model,
+	config Config) (*PushSession, *Response, error) {
+	log.Printf("-- Got push body %v", body)
+	if config.Hub == nil {
+		return nil, nil, fmt.Errorf("%w: Pushes are turned off", ErrForbidden)
+	}
+	if !onlySyncs(body) {
+		return nil, nil, fmt.Errorf("Push body can only have deviceUid, " +
+			"userUid, token, cursor and historyTodoId")
+	}
+	body.WaitMillis = 0
+
+	var device models.Device
+	err := model.WithTx(ctx, func(tx models.Model) error {
+		var err error
+		device, _, err = authenticateDevice(ctx, body, tx)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Subscribe before syncing, so no changes are missed in between
+	session := &PushSession{
+		body:         body,
+		model:        model,
+		config:       config,
+		subscription: config.Hub.Subscribe(device.UserId, device.Id),
+	}
+	response, err := HandleBody(ctx, body, model, config)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	session.cursor = response.Cursor
+	return session, response, nil
+}
+
+// onlySyncs is true if the body doesn't change anything
+func onlySyncs(body Body) bool {
+	return !body.ResetModel && !body.Register && !body.RotateToken &&
+		body.RevokeDeviceUid == "" && len(body.ActionsToSync) == 0
+}
+
+// Next waits for a push, then returns the changes since the last Response
+func (session *PushSession) Next(ctx context.Context) (*Response, error) {
+	select {
+	case <-session.subscription.C:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	body := session.body
+	body.Cursor = &session.cursor
+	body.HistoryTodoId = 0
+	response, err := HandleBody(ctx, body, session.model, session.config)
+	if err != nil {
+		return nil, err
+	}
+	session.cursor = response.Cursor
+	return response, nil
+}
+
+func (session *PushSession) Close() {
+	session.subscription.Close()
+}
+
+// ChangeEvent is a change to one todo or list, for streaming a Response's
+// changes
+type ChangeEvent struct {
+	// Type is "created" for todos created since the cursor, "updated" or
+	// "deleted", or for lists, "listUpdated" or "listDeleted"
+	Type   string `json:"-"`
+	TodoId int    `json:"todoId,omitempty"`
+	// Todo is nil if it was deleted
+	Todo   *models.Todo `json:"todo,omitempty"`
+	ListId int          `json:"listId,omitempty"`
+	// List is nil if it was deleted, or the user was removed from it
+	List *ResponseList `json:"list,omitempty"`
+	// Revision is the todo's or list's, or for deletions the Response.Cursor
+	Revision int `json:"revision"`
+}
+
+// ChangeEvents lists the changes in the response to a body with the cursor
+// (0 for none): first the lists, so the todos' lists are known, then the
+// todos, oldest first, then the deletions
+func ChangeEvents(response *Response, cursor int) []ChangeEvent {
+	events := []ChangeEvent{}
+	todos := make([]models.Todo, len(response.Todos))
+	copy(todos, response.Todos)
+	for _, list := range response.Lists {
+		list := list
+		// Its todos get their own events
+		todos = append(todos, list.Todos...)
+		list.Todos = nil
+		events = append(events, ChangeEvent{
+			Type:     "listUpdated",
+			ListId:   list.Id,
+			List:     &list,
+			Revision: list.Revision,
+		})
+	}
+	sort.SliceStable(todos, func(i, j int) bool {
+		return todos[i].Revision < todos[j].Revision
+	})
+	for i := range todos {
+		eventType := "updated"
+		if todos[i].CreatedRevision > cursor {
+			eventType = "created"
+		}
+		events = append(events, ChangeEvent{
+			Type:     eventType,
+			TodoId:   todos[i].Id,
+			Todo:     &todos[i],
+			Revision: todos[i].Revision,
+		})
+	}
+	for _, todoId := range response.DeletedTodoIds {
+		events = append(events, ChangeEvent{
+			Type:     "deleted",
+			TodoId:   todoId,
+			Revision: response.Cursor,
+		})
+	}
+	for _, listId := range response.DeletedListIds {
+		events = append(events, ChangeEvent{
+			Type:     "listDeleted",
+			ListId:   listId,
+			Revision: response.Cursor,
+		})
+	}
+	return events
+}
+
+// Wait returns how long HandleBody may wait for changes before answering the
+// body, or 0 if it won't wait, including when pushes are turned off
+func (config Config) Wait(body Body) time.Duration {
+	if config.Hub == nil || body.WaitMillis <= 0 || body.Cursor == nil ||
+		!onlySyncs(body) || body.HistoryTodoId != 0 {
+		return 0
+	}
+	maxWait := config.MaxWait
+	if maxWait == 0 {
+		maxWait = DefaultMaxWait
+	}
+	wait := time.Duration(body.WaitMillis) * time.Millisecond
+	if wait > maxWait {
+		return maxWait
+	}
+	return wait
+}
+
+// handleBodyWaiting answers the body once there are changes since its
+// cursor, or when config.Wait(body) is up
+func handleBodyWaiting(ctx context.Context, body Body, model models.Model,
+	config Config) (*Response, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, config.Wait(body))
+	defer cancel()
+	session, response, err := StartPushSession(ctx, body, model, config)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	for !hasChanges(response) {
+		next, err := session.Next(waitCtx)
+		if err != nil && waitCtx.Err() != nil && ctx.Err() == nil {
+			// Nothing changed in time
+			return response, nil
+		} else if err != nil {
+			return nil, err
+		}
+		response = next
+	}
+	return response, nil
+}
+
+func hasChanges(response *Response) bool {
+	return len(response.Todos) > 0 || len(response.DeletedTodoIds) > 0 ||
+		len(response.Lists) > 0 || len(response.DeletedListIds) > 0
+}
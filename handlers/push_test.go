@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"context"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func assertNoPush(t *testing.T, subscription *Subscription) {
+	select {
+	case push := <-subscription.C:
+		t.Errorf("Unexpected push %v", push)
+	default:
+	}
+}
+
+func TestHubPublish(t *testing.T) {
+	hub := NewHub()
+	otherDevice := hub.Subscribe(1, 2)
+	sameDevice := hub.Subscribe(1, 1)
+	otherUser := hub.Subscribe(3, 3)
+	closed := hub.Subscribe(1, 4)
+	closed.Close()
+
+	hub.Publish(Push{UserIds: []int{1}, DeviceId: 1, Revision: 5})
+	hub.Publish(Push{UserIds: []int{1}, DeviceId: 1, Revision: 6})
+	// Only the latest push waits
+	assert.Equal(t, 6, (<-otherDevice.C).Revision)
+	assertNoPush(t, otherDevice)
+	assertNoPush(t, sameDevice)
+	assertNoPush(t, otherUser)
+	assertNoPush(t, closed)
+}
+
+func TestPushSession(t *testing.T) {
+	model := models.NewMemoryModel()
+	config := Config{Hub: NewHub()}
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "V", "")
+	tokenC := mustRegister(t, model, "C", "W", "")
+	mustSync(t, model, "A", tokenA, addTodo(1, -1, "before"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	session, response, err := StartPushSession(ctx,
+		Body{DeviceUid: "A", Token: tokenA}, model, config)
+	assert.Equal(t, nil, err)
+	defer session.Close()
+	assert.Equal(t, []int{1}, todoIds(response.Todos))
+
+	// Another user's changes aren't pushed, but a shared list's are
+	_, err = HandleBody(ctx, Body{DeviceUid: "C", Token: tokenC,
+		ActionsToSync: []models.ActionToSync{addTodo(1, -1, "other user's")},
+	}, model, config)
+	assert.Equal(t, nil, err)
+	assertNoPush(t, session.subscription)
+	_, err = HandleBody(ctx, Body{DeviceUid: "B", Token: tokenB,
+		ActionsToSync: []models.ActionToSync{
+			addListAction(1, -1, "shared"),
+			inviteAction(2, -1, models.RoleEditor),
+		},
+	}, model, config)
+	assert.Equal(t, nil, err)
+	code := model.ListInvites[0].Code
+	_, err = HandleBody(ctx, Body{DeviceUid: "A", Token: tokenA,
+		ActionsToSync: []models.ActionToSync{joinAction(2, code)},
+	}, model, config)
+	assert.Equal(t, nil, err)
+	// Joining was A's own change
+	assertNoPush(t, session.subscription)
+
+	_, err = HandleBody(ctx, Body{DeviceUid: "B", Token: tokenB,
+		ActionsToSync: []models.ActionToSync{addTodoToList(3, -1, 1)},
+	}, model, config)
+	assert.Equal(t, nil, err)
+	response, err = session.Next(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "shared", listById(response.Lists, 1).Name)
+	assert.Equal(t, []int{3}, todoIds(listById(response.Lists, 1).Todos))
+
+	// Removed members are told too
+	_, err = HandleBody(ctx, Body{DeviceUid: "B", Token: tokenB,
+		ActionsToSync: []models.ActionToSync{updateMemberAction(4, 1, "U", "")},
+	}, model, config)
+	assert.Equal(t, nil, err)
+	response, err = session.Next(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{1}, response.DeletedListIds)
+
+	// Waiting stops with the ctx
+	shortCtx, cancelShort := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelShort()
+	_, err = session.Next(shortCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestStartPushSessionOnlySyncs(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+
+	_, _, err := StartPushSession(context.Background(),
+		Body{DeviceUid: "A", Token: tokenA}, model, Config{})
+	assert.Equal(t, 403, StatusCodeForError(err))
+
+	config := Config{Hub: NewHub()}
+	_, _, err = StartPushSession(context.Background(), Body{
+		DeviceUid:     "A",
+		Token:         tokenA,
+		ActionsToSync: []models.ActionToSync{addTodo(1, -1, "no")},
+	}, model, config)
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(model.Todos))
+
+	_, _, err = StartPushSession(context.Background(),
+		Body{DeviceUid: "A", Token: "wrong"}, model, config)
+	assert.Equal(t, 401, StatusCodeForError(err))
+	assert.Equal(t, 0, len(config.Hub.subscriptions))
+}
+
+func TestChangeEvents(t *testing.T) {
+	response := &Response{
+		Todos: []models.Todo{
+			{Id: 1, Revision: 7, CreatedRevision: 6, Version: 1},
+			{Id: 2, Revision: 5, CreatedRevision: 2, Version: 2},
+		},
+		DeletedTodoIds: []int{3},
+		Lists: []ResponseList{{
+			TodoList: models.TodoList{Id: 5, Name: "renamed", Revision: 6},
+			Todos: []models.Todo{
+				{Id: 4, ListId: 5, Revision: 8, CreatedRevision: 4, Version: 2},
+			},
+		}},
+		DeletedListIds: []int{6},
+		Cursor:         9,
+	}
+	events := ChangeEvents(response, 3)
+	assert.Equal(t, 6, len(events))
+	assert.Equal(t, "listUpdated", events[0].Type)
+	assert.Equal(t, 5, events[0].ListId)
+	assert.Equal(t, "renamed", events[0].List.Name)
+	// Its todos get their own events
+	assert.Equal(t, 0, len(events[0].List.Todos))
+	assert.Equal(t, 1, len(response.Lists[0].Todos))
+	assert.Equal(t, 6, events[0].Revision)
+	// Created before the cursor
+	assert.Equal(t, "updated", events[1].Type)
+	assert.Equal(t, 2, events[1].TodoId)
+	assert.Equal(t, 5, events[1].Revision)
+	assert.Equal(t, "created", events[2].Type)
+	assert.Equal(t, 1, events[2].Todo.Id)
+	// Created since the cursor, even if updated since too
+	assert.Equal(t, "created", events[3].Type)
+	assert.Equal(t, 4, events[3].TodoId)
+	assert.Equal(t, ChangeEvent{Type: "deleted", TodoId: 3, Revision: 9},
+		events[4])
+	assert.Equal(t, ChangeEvent{Type: "listDeleted", ListId: 6, Revision: 9},
+		events[5])
+
+	// Without a cursor, every todo is new
+	events = ChangeEvents(&Response{Todos: []models.Todo{
+		{Id: 2, Revision: 5, CreatedRevision: 2, Version: 2},
+	}, Cursor: 9}, 0)
+	assert.Equal(t, "created", events[0].Type)
+}
+
+// notifyingModel keeps the payloads that a DbModel would notify, once the
+// transaction commits
+type notifyingModel struct {
+	*models.MemoryModel
+	payloads *[]string
+	pending  *[]string
+}
+
+func (model notifyingModel) WithTx(ctx context.Context,
+	fn func(tx models.Model) error) error {
+	pending := []string{}
+	err := model.MemoryModel.WithTx(ctx, func(tx models.Model) error {
+		return fn(notifyingModel{tx.(*models.MemoryModel), model.payloads,
+			&pending})
+	})
+	if err == nil {
+		*model.payloads = append(*model.payloads, pending...)
+	}
+	return err
+}
+
+func (model notifyingModel) NotifyChange(ctx context.Context,
+	payload string) error {
+	*model.pending = append(*model.pending, payload)
+	return nil
+}
+
+func TestPushNotifications(t *testing.T) {
+	model := notifyingModel{MemoryModel: models.NewMemoryModel(),
+		payloads: &[]string{}}
+	hub, otherHub := NewHub(), NewHub()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustRegister(t, model, "B", "U", tokenA)
+	here := hub.Subscribe(1, 2)
+	there := otherHub.Subscribe(1, 2)
+
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid:     "A",
+		Token:         tokenA,
+		ActionsToSync: []models.ActionToSync{addTodo(1, -1, "notified")},
+	}, model, Config{Hub: hub})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(*model.payloads))
+	assert.Equal(t, 1, (<-here.C).DeviceId)
+
+	// Other processes publish it, but not the one that sent it again
+	payload := (*model.payloads)[0]
+	assert.Equal(t, nil, otherHub.PublishNotification(payload))
+	assert.Equal(t, []int{1}, (<-there.C).UserIds)
+	assert.Equal(t, nil, hub.PublishNotification(payload))
+	assertNoPush(t, here)
+
+	// After missing notifications, everyone syncs
+	otherUser := otherHub.Subscribe(3, 4)
+	assert.Equal(t, nil, otherHub.PublishNotification(""))
+	<-there.C
+	<-otherUser.C
+
+	assert.Error(t, otherHub.PublishNotification("{"))
+}
+
+func TestPushNotificationsToManyUsersFitInPayload(t *testing.T) {
+	model := notifyingModel{MemoryModel: models.NewMemoryModel(),
+		payloads: &[]string{}, pending: &[]string{}}
+	hub, otherHub := NewHub(), NewHub()
+	push := Push{DeviceId: 1, Revision: 2}
+	for userId := 1; userId <= 2000; userId++ {
+		push.UserIds = append(push.UserIds, userId)
+	}
+
+	assert.Equal(t, nil, hub.notify(context.Background(), model, push,
+		false))
+	payload := (*model.pending)[0]
+	assert.Equal(t, true, len(payload) <= maxNotifyPayload)
+
+	// So every subscriber syncs, even those of users not listed
+	otherUser := otherHub.Subscribe(3000, 4)
+	assert.Equal(t, nil, otherHub.PublishNotification(payload))
+	assert.Equal(t, 2, (<-otherUser.C).Revision)
+}
+
+func TestConfigWait(t *testing.T) {
+	config := Config{Hub: NewHub(), MaxWait: time.Second}
+	cursor := 0
+	body := Body{DeviceUid: "A", Cursor: &cursor, WaitMillis: 500}
+	assert.Equal(t, 500*time.Millisecond, config.Wait(body))
+	body.WaitMillis = 5000
+	assert.Equal(t, time.Second, config.Wait(body))
+	assert.Equal(t, 5*time.Second, Config{Hub: config.Hub}.Wait(body))
+	assert.Equal(t, time.Duration(0), Config{}.Wait(body))
+
+	// Only bodies that just sync from a cursor wait
+	body.Cursor = nil
+	assert.Equal(t, time.Duration(0), config.Wait(body))
+	body.Cursor = &cursor
+	body.ActionsToSync = []models.ActionToSync{addTodo(1, -1, "now")}
+	assert.Equal(t, time.Duration(0), config.Wait(body))
+}
+
+func TestHandleBodyWaits(t *testing.T) {
+	model := models.NewMemoryModel()
+	config := Config{Hub: NewHub()}
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	cursor := mustSync(t, model, "B", tokenB).Cursor
+	ctx := context.Background()
+
+	// Answers when nothing changes in time
+	start := time.Now()
+	response, err := HandleBody(ctx, Body{DeviceUid: "B", Token: tokenB,
+		Cursor: &cursor, WaitMillis: 50}, model, config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, 0, len(response.Todos))
+	assert.Equal(t, cursor, response.Cursor)
+
+	// Answers as soon as another device changes something
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		HandleBody(ctx, Body{DeviceUid: "A", Token: tokenA,
+			ActionsToSync: []models.ActionToSync{addTodo(1, -1, "waited for")},
+		}, model, config)
+	}()
+	response, err = HandleBody(ctx, Body{DeviceUid: "B", Token: tokenB,
+		Cursor: &cursor, WaitMillis: 5000}, model, config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{1}, todoIds(response.Todos))
+
+	// Or right away if there were changes already
+	start = time.Now()
+	response, err = HandleBody(ctx, Body{DeviceUid: "B", Token: tokenB,
+		Cursor: &cursor, WaitMillis: 5000}, model, config)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{1}, todoIds(response.Todos))
+	assert.Equal(t, true, time.Since(start) < time.Second)
+
+	// Without pushes, answers right away
+	start = time.Now()
+	cursor = response.Cursor
+	response, err = HandleBody(ctx, Body{DeviceUid: "B", Token: tokenB,
+		Cursor: &cursor, WaitMillis: 5000}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, len(response.Todos))
+	assert.Equal(t, true, time.Since(start) < time.Second)
+}
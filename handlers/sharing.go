@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+)
+
+// Roles allowed to do each kind of action in a list shared with them
+var (
+	anyRoles    = []string{models.RoleOwner, models.RoleEditor, models.RoleViewer}
+	editorRoles = []string{models.RoleOwner, models.RoleEditor}
+	ownerRoles  = []string{models.RoleOwner}
+)
+
+// membershipActionTypes only change who can see and change lists, not any
+// todos, so RebuildTodos skips them
+var membershipActionTypes = map[string]bool{
+	"LIST/INVITE_TO_LIST": true,
+	"LISTS/JOIN_LIST":     true,
+	"LIST/UPDATE_MEMBER":  true,
+}
+
+// actingUserId returns the user whose todos and lists the action applies to.
+// That's the owner of the list the action's todo or list is in, if it's
+// shared with source.UserId in a role that allows the action, or else
+// source.UserId, so other users' todos and lists look missing as usual.  If
+// the role doesn't allow the action, it returns the reason to reject it
+// instead.
+func actingUserId(ctx context.Context, model models.Model,
+	source actionSource, actionToSync models.ActionToSync,
+	todoId int) (int, string, error) {
+	userId := source.UserId
+	switch actionToSync.Type {
+
+	case "TODOS/ADD_TODO", "TODOS/TOGGLE_ALL", "TODOS/CLEAR_COMPLETED":
+		if actionToSync.ListIdMaybeTemp == nil {
+			return userId, "", nil
+		}
+		return actingUserIdInList(ctx, model, userId, actionToSync.Type,
+			*actionToSync.ListIdMaybeTemp, editorRoles)
+
+	case "TODO/UPDATE_TODO", "TODOS/DELETE_TODO", "TODO/MOVE_TODO":
+		todo, err := model.FindTodoById(ctx, todoId)
+		if errors.Is(err, models.ErrNotFound) {
+			return userId, "", nil
+		} else if err != nil {
+			return 0, "", fmt.Errorf("Error from FindTodoById: %w", err)
+		}
+		return actingUserIdInList(ctx, model, userId, actionToSync.Type,
+			todo.ListId, editorRoles)
+
+	case "TODOS/UNDO":
+		return actingUserIdForUndo(ctx, model, source, actionToSync)
+
+	case "LIST/UPDATE_LIST", "LISTS/DELETE_LIST", "LIST/INVITE_TO_LIST",
+		"LIST/UPDATE_MEMBER":
+		if actionToSync.ListIdMaybeTemp == nil {
+			return userId, "", nil
+		}
+		roles := ownerRoles
+		if actionToSync.Type == "LIST/UPDATE_MEMBER" &&
+			isLeaving(ctx, model, userId, actionToSync) {
+			roles = anyRoles
+		}
+		return actingUserIdInList(ctx, model, userId, actionToSync.Type,
+			*actionToSync.ListIdMaybeTemp, roles)
+
+	default:
+		return userId, "", nil
+	}
+}
+
+// actingUserIdInList returns the owner of the list if it's shared with
+// userId in one of the roles, a reason if it's shared in another role, or
+// userId if it's theirs, isn't shared with them or doesn't exist.  what is
+// the action type, for the reason.
+func actingUserIdInList(ctx context.Context, model models.Model, userId int,
+	what string, listId int, roles []string) (int, string, error) {
+	if listId == 0 {
+		return userId, "", nil
+	}
+	list, err := model.FindTodoListById(ctx, listId)
+	if errors.Is(err, models.ErrNotFound) {
+		return userId, "", nil
+	} else if err != nil {
+		return 0, "", fmt.Errorf("Error from FindTodoListById: %w", err)
+	}
+	if list.UserId == userId {
+		return userId, "", nil
+	}
+
+	member, err := model.FindListMember(ctx, listId, userId)
+	if errors.Is(err, models.ErrNotFound) {
+		return userId, "", nil
+	} else if err != nil {
+		return 0, "", fmt.Errorf("Error from FindListMember: %w", err)
+	}
+	for _, role := range roles {
+		if member.Role == role {
+			return list.UserId, "", nil
+		}
+	}
+	return 0, fmt.Sprintf("Can't %s with role %s in list %d", what,
+		member.Role, listId), nil
+}
+
+// actingUserIdForUndo checks the device's user can still edit the todos that
+// the undone action changed in lists shared with them.  undoAction changes
+// each todo as its owner, so TODOS/UNDO always acts as the device's user.
+func actingUserIdForUndo(ctx context.Context, model models.Model,
+	source actionSource, actionToSync models.ActionToSync) (int, string,
+	error) {
+	if actionToSync.UndoneId == nil {
+		return source.UserId, "", nil
+	}
+	undoneChanges, err := model.ListTodoChangesByAction(ctx, source.DeviceId,
+		*actionToSync.UndoneId)
+	if err != nil {
+		return 0, "", fmt.Errorf("Error from ListTodoChangesByAction: %w", err)
+	}
+	for _, undone := range undoneChanges {
+		if undone.UserId == source.UserId {
+			continue
+		}
+		history, err := model.ListTodoChanges(ctx, undone.UserId, undone.TodoId)
+		if err != nil {
+			return 0, "", fmt.Errorf("Error from ListTodoChanges: %w", err)
+		}
+		listId := addedToListId(history)
+		ownerId, reason, err := actingUserIdInList(ctx, model, source.UserId,
+			actionToSync.Type, listId, editorRoles)
+		if err != nil || reason != "" {
+			return 0, reason, err
+		}
+		if ownerId != undone.UserId {
+			return 0, fmt.Sprintf("List %d isn't shared with the user anymore",
+				listId), nil
+		}
+	}
+	return source.UserId, "", nil
+}
+
+// isLeaving returns whether a LIST/UPDATE_MEMBER removes the device's own
+// user from the list, which any member may do
+func isLeaving(ctx context.Context, model models.Model, userId int,
+	actionToSync models.ActionToSync) bool {
+	if actionToSync.MemberUserUid == nil ||
+		(actionToSync.Role != nil && *actionToSync.Role != "") {
+		return false
+	}
+	user, err := model.FindUserByUid(ctx, *actionToSync.MemberUserUid)
+	return err == nil && user.Id == userId
+}
+
+// inviteToList handles LIST/INVITE_TO_LIST, which creates a ListInvite with
+// a random code that the list's owner can pass on; it's in the owner's next
+// sync.  Returns the number of invites created, 0 or 1.
+func inviteToList(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, userId int) (int, error) {
+	if actionToSync.ListIdMaybeTemp == nil || actionToSync.Role == nil {
+		return 0, fmt.Errorf("Missing listIdMaybeTemp or role in action %v",
+			actionToSync)
+	}
+	if *actionToSync.Role != models.RoleEditor &&
+		*actionToSync.Role != models.RoleViewer {
+		return 0, fmt.Errorf("Invalid role in action %v", actionToSync)
+	}
+	listId := *actionToSync.ListIdMaybeTemp
+	if _, err := model.FindTodoList(ctx, userId,
+		listId); errors.Is(err, models.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error from FindTodoList: %w", err)
+	}
+
+	code, err := newToken()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("  Calling CreateListInvite(%d, %s)", listId,
+		*actionToSync.Role)
+	if err := model.CreateListInvite(ctx, models.ListInvite{Code: code,
+		ListId: listId, Role: *actionToSync.Role}); err != nil {
+		return 0, fmt.Errorf("Error from CreateListInvite: %w", err)
+	}
+	return 1, nil
+}
+
+// joinList handles LISTS/JOIN_LIST, which uses up the invite with
+// actionToSync.InviteCode to make the user a member of its list, or changes
+// their role if they already are, and returns the list's id.  Returns 0 if
+// there's no such invite.  The owner stays the owner.
+func joinList(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, userId int) (int, error) {
+	if actionToSync.InviteCode == nil {
+		return 0, fmt.Errorf("Missing inviteCode in action %v", actionToSync)
+	}
+	invite, err := model.TakeListInvite(ctx, *actionToSync.InviteCode)
+	if errors.Is(err, models.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error from TakeListInvite: %w", err)
+	}
+	list, err := model.FindTodoListById(ctx, invite.ListId)
+	if err != nil {
+		return 0, fmt.Errorf("Error from FindTodoListById: %w", err)
+	}
+	if list.UserId == userId {
+		return list.Id, nil
+	}
+
+	log.Printf("  Calling SetListMember(%d, %s)", list.Id, invite.Role)
+	if err := model.SetListMember(ctx, models.ListMember{ListId: list.Id,
+		UserId: userId, Role: invite.Role}); err != nil {
+		return 0, fmt.Errorf("Error from SetListMember: %w", err)
+	}
+	return list.Id, nil
+}
+
+// updateMember handles LIST/UPDATE_MEMBER, which changes the role of a
+// member of the list, or removes them if the role is "".  The owner can't be
+// changed.  Returns the number of members changed, 0 or 1.
+func updateMember(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, userId int) (int, error) {
+	if actionToSync.ListIdMaybeTemp == nil ||
+		actionToSync.MemberUserUid == nil {
+		return 0, fmt.Errorf("Missing listIdMaybeTemp or memberUserUid in "+
+			"action %v", actionToSync)
+	}
+	role := ""
+	if actionToSync.Role != nil {
+		role = *actionToSync.Role
+	}
+	if role != "" && role != models.RoleEditor && role != models.RoleViewer {
+		return 0, fmt.Errorf("Invalid role in action %v", actionToSync)
+	}
+	listId := *actionToSync.ListIdMaybeTemp
+	if _, err := model.FindTodoList(ctx, userId,
+		listId); errors.Is(err, models.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error from FindTodoList: %w", err)
+	}
+	user, err := model.FindUserByUid(ctx, *actionToSync.MemberUserUid)
+	if errors.Is(err, models.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error from FindUserByUid: %w", err)
+	}
+	member, err := model.FindListMember(ctx, listId, user.Id)
+	if errors.Is(err, models.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("Error from FindListMember: %w", err)
+	}
+	if member.Role == models.RoleOwner {
+		return 0, nil
+	}
+
+	if role == "" {
+		log.Printf("  Calling DeleteListMember(%d, %d)", listId, user.Id)
+		output, err := model.DeleteListMember(ctx, listId, user.Id)
+		if err != nil {
+			return 0, fmt.Errorf("Error from DeleteListMember: %w", err)
+		}
+		return output, nil
+	}
+	log.Printf("  Calling SetListMember(%d, %d, %s)", listId, user.Id, role)
+	member.Role = role
+	if err := model.SetListMember(ctx, member); err != nil {
+		return 0, fmt.Errorf("Error from SetListMember: %w", err)
+	}
+	return 1, nil
+}
+
+// sharedListChanges returns the lists shared with the user by other users,
+// and their todos: all of them, or those changed since cursor.  Lists the
+// user joined, or changed role in, since cursor are returned whole.
+func sharedListChanges(ctx context.Context, model models.Model, userId int,
+	cursor *int) (models.Changes, error) {
+	shared := models.Changes{
+		Todos:          []models.Todo{},
+		DeletedTodoIds: []int{},
+		Lists:          []models.TodoList{},
+	}
+	memberships, err := model.ListMemberships(ctx, userId)
+	if err != nil {
+		return models.Changes{}, fmt.Errorf("Error from ListMemberships: %w", err)
+	}
+	for _, member := range memberships {
+		if member.Role == models.RoleOwner {
+			continue
+		}
+		revision := 0
+		if cursor != nil && member.Revision <= *cursor {
+			revision = *cursor
+		}
+		changes, err := model.ListChangesInListSince(ctx, member.ListId,
+			revision)
+		if err != nil {
+			return models.Changes{},
+				fmt.Errorf("Error from ListChangesInListSince: %w", err)
+		}
+		shared.Todos = append(shared.Todos, changes.Todos...)
+		shared.Lists = append(shared.Lists, changes.Lists...)
+		if revision != 0 {
+			shared.DeletedTodoIds = append(shared.DeletedTodoIds,
+				changes.DeletedTodoIds...)
+		}
+	}
+	return shared, nil
+}
+
+// addMembers sets the Members of each list, and for lists the user owns, the
+// Invites
+func addMembers(ctx context.Context, model models.Model, userId int,
+	lists []ResponseList) error {
+	for i, list := range lists {
+		if list.Id == 0 {
+			continue
+		}
+		members, err := model.ListListMembers(ctx, list.Id)
+		if err != nil {
+			return fmt.Errorf("Error from ListListMembers: %w", err)
+		}
+		lists[i].Members = members
+		if list.UserId == userId {
+			invites, err := model.ListListInvites(ctx, list.Id)
+			if err != nil {
+				return fmt.Errorf("Error from ListListInvites: %w", err)
+			}
+			lists[i].Invites = invites
+		}
+	}
+	return nil
+}
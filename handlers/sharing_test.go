@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"context"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func inviteAction(id int, listId int, role string) models.ActionToSync {
+	return models.ActionToSync{Id: id, Type: "LIST/INVITE_TO_LIST",
+		ListIdMaybeTemp: intPtr(listId), Role: stringPtr(role)}
+}
+
+func joinAction(id int, code string) models.ActionToSync {
+	return models.ActionToSync{Id: id, Type: "LISTS/JOIN_LIST",
+		InviteCode: stringPtr(code)}
+}
+
+func updateMemberAction(id int, listId int, userUid string,
+	role string) models.ActionToSync {
+	return models.ActionToSync{Id: id, Type: "LIST/UPDATE_MEMBER",
+		ListIdMaybeTemp: intPtr(listId), MemberUserUid: stringPtr(userUid),
+		Role: stringPtr(role)}
+}
+
+func memberRoles(members []models.ListMember) map[string]string {
+	uidToRole := map[string]string{}
+	for _, member := range members {
+		uidToRole[member.UserUid] = member.Role
+	}
+	return uidToRole
+}
+
+func listById(lists []ResponseList, id int) ResponseList {
+	for _, list := range lists {
+		if list.Id == id {
+			return list
+		}
+	}
+	return ResponseList{}
+}
+
+// Returns the tokens of devices A (the owner, user U), B (an editor, user V)
+// and C (a viewer, user W) of list 1, which has todo 1
+func mustShareList(t *testing.T, model models.Model) (string, string, string) {
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "V", "")
+	tokenC := mustRegister(t, model, "C", "W", "")
+	response := mustSync(t, model, "A", tokenA,
+		addListAction(1, -1, "shared"), addTodoToList(2, -1, -1),
+		inviteAction(3, -1, models.RoleEditor),
+		inviteAction(4, -1, models.RoleViewer))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["3"])
+	invites := listById(response.Lists, 1).Invites
+	assert.Equal(t, 2, len(invites))
+	for _, invite := range invites {
+		if invite.Role == models.RoleEditor {
+			mustSync(t, model, "B", tokenB, joinAction(1, invite.Code))
+		} else {
+			mustSync(t, model, "C", tokenC, joinAction(1, invite.Code))
+		}
+	}
+	return tokenA, tokenB, tokenC
+}
+
+func TestSharedList(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA, tokenB, tokenC := mustShareList(t, model)
+
+	response := mustSync(t, model, "B", tokenB,
+		addTodoToList(2, -1, 1),
+		models.ActionToSync{Id: 3, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+			Title: stringPtr("renamed by editor")},
+		addTodo(4, -2, "private"))
+	assert.Equal(t, 2, response.ActionToSyncIdToOutput["2"])
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["3"])
+	assert.Equal(t, 1, len(response.Lists))
+	assert.Equal(t, []int{3}, todoIds(response.Todos))
+	assert.Equal(t, "shared", listById(response.Lists, 1).Name)
+	assert.Equal(t, []int{1, 2}, todoIds(listById(response.Lists, 1).Todos))
+	assert.Equal(t, "renamed by editor", listById(response.Lists, 1).Todos[0].Title)
+	assert.Equal(t, map[string]string{"U": models.RoleOwner,
+		"V": models.RoleEditor, "W": models.RoleViewer},
+		memberRoles(listById(response.Lists, 1).Members))
+	// Only the owner sees the invites
+	assert.Equal(t, []models.ListInvite(nil), listById(response.Lists, 1).Invites)
+
+	// The viewer's changes are rejected one by one
+	response = mustSync(t, model, "C", tokenC,
+		models.ActionToSync{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+			Title: stringPtr("renamed by viewer")},
+		addTodoToList(3, -1, 1),
+		models.ActionToSync{Id: 4, Type: "LIST/UPDATE_LIST",
+			ListIdMaybeTemp: intPtr(1), Name: stringPtr("renamed")},
+		addTodo(5, -2, "private"))
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["2"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["3"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, 4, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, "Can't TODO/UPDATE_TODO with role viewer in list 1",
+		response.ActionToSyncIdToRejection["2"])
+	assert.Equal(t, 3, len(response.ActionToSyncIdToRejection))
+	assert.Equal(t, []int{4}, todoIds(response.Todos))
+	assert.Equal(t, []int{1, 2}, todoIds(listById(response.Lists, 1).Todos))
+	assert.Equal(t, "renamed by editor",
+		listById(response.Lists, 1).Todos[0].Title)
+
+	// The owner sees the editor's changes, in the history too
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid:     "A",
+		Token:         tokenA,
+		HistoryTodoId: 1,
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{1, 2}, todoIds(listById(response.Lists, 1).Todos))
+	assert.Equal(t, 2, len(response.TodoHistory))
+	assert.Equal(t, 2, response.TodoHistory[1].DeviceId)
+	response, err = HandleBody(context.Background(), Body{
+		DeviceUid:     "C",
+		Token:         tokenC,
+		HistoryTodoId: 1,
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(response.TodoHistory))
+
+	// Replaying the log doesn't need the memberships
+	todos := model.Todos
+	assert.Equal(t, nil, RebuildTodos(context.Background(), model, Config{}))
+	assert.Equal(t, todoIds(todos), todoIds(model.Todos))
+	assert.Equal(t, todos[0].Title, model.Todos[0].Title)
+}
+
+func TestInviteCodes(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "V", "")
+	response := mustSync(t, model, "A", tokenA,
+		addListAction(1, -1, "shared"), inviteAction(2, -1, models.RoleViewer))
+	code := listById(response.Lists, 1).Invites[0].Code
+
+	response = mustSync(t, model, "B", tokenB,
+		joinAction(1, "wrong"), joinAction(2, code),
+		// Someone else's list isn't found, rather than rejected
+		inviteAction(3, 1, models.RoleEditor))
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["1"])
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["2"])
+	assert.Equal(t, "Can't LIST/INVITE_TO_LIST with role viewer in list 1",
+		response.ActionToSyncIdToRejection["3"])
+
+	// Codes can only be used once
+	tokenC := mustRegister(t, model, "C", "W", "")
+	response = mustSync(t, model, "C", tokenC, joinAction(1, code))
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["1"])
+	assert.Equal(t, 0, len(response.Lists))
+
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid:     "A",
+		Token:         tokenA,
+		ActionsToSync: []models.ActionToSync{inviteAction(3, 1, models.RoleOwner)},
+	}, model, Config{})
+	assert.Error(t, err)
+}
+
+func TestMembershipChangesSync(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA, tokenB, tokenC := mustShareList(t, model)
+	cursorB := mustSync(t, model, "B", tokenB).Cursor
+	cursorC := mustSync(t, model, "C", tokenC).Cursor
+
+	response := mustSync(t, model, "A", tokenA,
+		updateMemberAction(5, 1, "W", models.RoleEditor),
+		updateMemberAction(6, 1, "V", ""),
+		// The owner stays the owner
+		updateMemberAction(7, 1, "U", models.RoleViewer))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["6"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["7"])
+	assert.Equal(t, map[string]string{"U": models.RoleOwner,
+		"W": models.RoleEditor}, memberRoles(listById(response.Lists, 1).Members))
+
+	// The removed editor finds out, and can't change the list anymore
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+				Title: stringPtr("too late")},
+		},
+		Cursor: &cursorB,
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["2"])
+	assert.Equal(t, []int{1}, response.DeletedListIds)
+	assert.Equal(t, 0, len(response.Lists))
+
+	// The viewer, now an editor, gets the list again with its new members
+	response, err = HandleBody(context.Background(), Body{
+		DeviceUid: "C",
+		Token:     tokenC,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+				Completed: boolPtr(true)},
+		},
+		Cursor: &cursorC,
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["2"])
+	assert.Equal(t, map[string]string{"U": models.RoleOwner,
+		"W": models.RoleEditor}, memberRoles(listById(response.Lists, 1).Members))
+	assert.Equal(t, []int{1}, todoIds(listById(response.Lists, 1).Todos))
+
+	// Any member can leave, but not change their own role
+	response = mustSync(t, model, "C", tokenC,
+		updateMemberAction(3, 1, "W", models.RoleViewer),
+		models.ActionToSync{Id: 4, Type: "LIST/UPDATE_MEMBER",
+			ListIdMaybeTemp: intPtr(1), MemberUserUid: stringPtr("W")})
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["3"])
+	assert.Equal(t, 1, len(response.ActionToSyncIdToRejection))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, 0, len(response.Lists))
+}
+
+func TestDeleteSharedList(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA, tokenB, _ := mustShareList(t, model)
+	cursorB := mustSync(t, model, "B", tokenB).Cursor
+
+	response := mustSync(t, model, "B", tokenB,
+		models.ActionToSync{Id: 2, Type: "LISTS/DELETE_LIST",
+			ListIdMaybeTemp: intPtr(1)})
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["2"])
+	assert.Equal(t, 1, len(response.ActionToSyncIdToRejection))
+
+	mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 5, Type: "LISTS/DELETE_LIST",
+			ListIdMaybeTemp: intPtr(1)})
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid: "B",
+		Token:     tokenB,
+		Cursor:    &cursorB,
+	}, model, Config{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{1}, response.DeletedListIds)
+}
+
+func TestUndoInSharedList(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA, tokenB, _ := mustShareList(t, model)
+	mustSync(t, model, "B", tokenB,
+		models.ActionToSync{Id: 2, Type: "TODOS/DELETE_TODO", TodoIdMaybeTemp: 1},
+		addTodoToList(3, -1, 1))
+
+	response := mustSync(t, model, "B", tokenB, undoOf(4, 2))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, []int{1, 2}, todoIds(listById(response.Lists, 1).Todos))
+
+	// Not after being made a viewer
+	mustSync(t, model, "A", tokenA,
+		updateMemberAction(5, 1, "V", models.RoleViewer))
+	response = mustSync(t, model, "B", tokenB, undoOf(5, 3))
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, "Can't TODOS/UNDO with role viewer in list 1",
+		response.ActionToSyncIdToRejection["5"])
+	assert.Equal(t, []int{1, 2}, todoIds(listById(response.Lists, 1).Todos))
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+)
+
+// undoAction reverses the changes made by the device's action with
+// actionToSync.UndoneId, using each todo's history, and returns the number of
+// todos changed.  Changes made since by other actions win:
+//   - undoing TODOS/ADD_TODO deletes the todo, unless another device changed
+//     it since
+//   - undoing TODO/UPDATE_TODO or TODOS/TOGGLE_ALL restores each field's
+//     earlier value, unless a later action set the field
+//   - undoing TODOS/DELETE_TODO or TODOS/CLEAR_COMPLETED re-creates the todo,
+//     with the same id, in its list if that's still there, unless it was
+//     restored since
+//
+// Undoing an action that changed nothing, a TODO/MOVE_TODO (moves aren't in
+// the history), a TODOS/UNDO, or an action on lists, does nothing; to redo,
+// the client sends the original action again.
+func undoAction(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, source actionSource) (int, error) {
+	if actionToSync.UndoneId == nil {
+		return 0, fmt.Errorf("Missing undoneId in action %v", actionToSync)
+	}
+	undoneChanges, err := model.ListTodoChangesByAction(ctx, source.DeviceId,
+		*actionToSync.UndoneId)
+	if err != nil {
+		return 0, fmt.Errorf("Error from ListTodoChangesByAction: %w", err)
+	}
+
+	output := 0
+	for _, undone := range undoneChanges {
+		numUndone, err := undoTodoChange(ctx, actionToSync, model, source, undone)
+		if err != nil {
+			return 0, err
+		}
+		output += numUndone
+	}
+	return output, nil
+}
+
+// undoTodoChange reverses one change of the action being undone, and returns
+// the number of todos changed, 0 or 1.  It acts as the todo's owner, which
+// isn't source.UserId if it's in a shared list; actingUserId has checked the
+// user may still change it.
+func undoTodoChange(ctx context.Context, actionToSync models.ActionToSync,
+	model models.Model, source actionSource, undone models.TodoChange) (int,
+	error) {
+	source.UserId = undone.UserId
+	history, err := model.ListTodoChanges(ctx, source.UserId, undone.TodoId)
+	if err != nil {
+		return 0, fmt.Errorf("Error from ListTodoChanges: %w", err)
+	}
+	earlier, later := splitHistory(history, undone.Id)
+
+	undo := models.ActionToSync{Id: actionToSync.Id, Type: actionToSync.Type}
+	output := 0
+	switch undone.Type {
+	case "TODOS/ADD_TODO":
+		for _, change := range later {
+			if change.DeviceId != source.DeviceId {
+				log.Printf("  Not undoing: device %d changed todo %d since",
+					change.DeviceId, undone.TodoId)
+				return 0, nil
+			}
+		}
+		log.Printf("  Calling DeleteTodo to undo action %d", undone.ActionToSyncId)
+		output, err = model.DeleteTodo(ctx, source.UserId, undone.TodoId)
+		if err != nil {
+			return 0, fmt.Errorf("Error from DeleteTodo: %w", err)
+		}
+
+	case "TODO/UPDATE_TODO", "TODOS/TOGGLE_ALL":
+		if undone.Title != nil && latestTitle(later) == nil {
+			undo.Title = latestTitle(earlier)
+		}
+		if undone.Completed != nil && latestCompleted(later) == nil {
+			undo.Completed = latestCompleted(earlier)
+		}
+		if undo.Title == nil && undo.Completed == nil {
+			return 0, nil
+		}
+		log.Printf("  Calling UpdateTodo(%v) to undo action %d", undo,
+			undone.ActionToSyncId)
+		output, err = model.UpdateTodo(ctx, source.UserId, undo, undone.TodoId)
+		if err != nil {
+			return 0, fmt.Errorf("Error from UpdateTodo: %w", err)
+		}
+
+	case "TODOS/DELETE_TODO", "TODOS/CLEAR_COMPLETED":
+		undo.Title = latestTitle(earlier)
+		undo.Completed = latestCompleted(earlier)
+		if len(later) > 0 || undo.Title == nil || undo.Completed == nil {
+			return 0, nil
+		}
+		listId, err := existingListId(ctx, model, source.UserId,
+			addedToListId(earlier))
+		if err != nil {
+			return 0, err
+		}
+		log.Printf("  Calling RestoreTodo to undo action %d", undone.ActionToSyncId)
+		_, err = model.RestoreTodo(ctx, models.Todo{
+			Id:        undone.TodoId,
+			UserId:    source.UserId,
+			ListId:    listId,
+			Title:     *undo.Title,
+			Completed: *undo.Completed,
+			// Each Version came with a change, so this is above all of them
+			Version: len(earlier) + 1,
+		})
+		if errors.Is(err, models.ErrNotFound) {
+			return 0, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("Error from RestoreTodo: %w", err)
+		}
+		output = 1
+
+	default:
+		return 0, nil
+	}
+
+	if output > 0 {
+		if err := recordTodoChange(ctx, model, source, undo,
+			undone.TodoId); err != nil {
+			return 0, err
+		}
+	}
+	return output, nil
+}
+
+// splitHistory returns the changes before and after the one with changeId
+func splitHistory(history []models.TodoChange,
+	changeId int) ([]models.TodoChange, []models.TodoChange) {
+	earlier := []models.TodoChange{}
+	later := []models.TodoChange{}
+	for _, change := range history {
+		if change.Id < changeId {
+			earlier = append(earlier, change)
+		} else if change.Id > changeId {
+			later = append(later, change)
+		}
+	}
+	return earlier, later
+}
+
+// latestTitle returns the last title set by changes, or nil if none set it
+func latestTitle(changes []models.TodoChange) *string {
+	var title *string
+	for _, change := range changes {
+		if change.Title != nil {
+			title = change.Title
+		}
+	}
+	return title
+}
+
+// addedToListId returns the list the todo was added to, or 0 if none (or if
+// its TODOS/ADD_TODO isn't in changes)
+func addedToListId(changes []models.TodoChange) int {
+	for _, change := range changes {
+		if change.Type == "TODOS/ADD_TODO" {
+			return change.ListId
+		}
+	}
+	return 0
+}
+
+// latestCompleted returns the last completed set by changes, or nil if none
+// set it
+func latestCompleted(changes []models.TodoChange) *bool {
+	var completed *bool
+	for _, change := range changes {
+		if change.Completed != nil {
+			completed = change.Completed
+		}
+	}
+	return completed
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func undoOf(id int, undoneId int) models.ActionToSync {
+	return models.ActionToSync{Id: id, Type: "TODOS/UNDO", UndoneId: &undoneId}
+}
+
+// Syncs the actions from the device, and returns the response
+func mustSync(t *testing.T, model models.Model, deviceUid string,
+	token string, actions ...models.ActionToSync) *Response {
+	response, err := HandleBody(context.Background(), Body{
+		DeviceUid:     deviceUid,
+		Token:         token,
+		ActionsToSync: actions,
+	}, model, Config{})
+	if err != nil {
+		t.Fatalf("Error from HandleBody: %s", err)
+	}
+	return response
+}
+
+func TestUndoUpdate(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("first"), Completed: boolPtr(false)},
+		models.ActionToSync{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+			Title: stringPtr("renamed"), Completed: boolPtr(true)})
+
+	response := mustSync(t, model, "A", tokenA, undoOf(3, 2))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["3"])
+	assert.Equal(t, "first", response.Todos[0].Title)
+	assert.Equal(t, false, response.Todos[0].Completed)
+	assert.Equal(t, 3, response.Todos[0].Version)
+
+	// Sending it again is ignored like any action, and a second undo of the
+	// same action finds nothing left to undo
+	response = mustSync(t, model, "A", tokenA, undoOf(3, 2), undoOf(4, 2))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["3"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, 3, response.Todos[0].Version)
+}
+
+func TestUndoUpdateKeepsLaterChanges(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("first"), Completed: boolPtr(false)},
+		models.ActionToSync{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+			Title: stringPtr("renamed by A"), Completed: boolPtr(true)})
+	mustSync(t, model, "B", tokenB,
+		models.ActionToSync{Id: 1, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+			Title: stringPtr("renamed by B")})
+
+	// B's title stays, but A's completed is undone
+	response := mustSync(t, model, "A", tokenA, undoOf(3, 2))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["3"])
+	assert.Equal(t, "renamed by B", response.Todos[0].Title)
+	assert.Equal(t, false, response.Todos[0].Completed)
+
+	// Devices can only undo their own actions
+	response = mustSync(t, model, "B", tokenB, undoOf(2, 2))
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["2"])
+	assert.Equal(t, "renamed by B", response.Todos[0].Title)
+}
+
+func TestUndoDelete(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("first"), Completed: boolPtr(false)},
+		models.ActionToSync{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 1,
+			Completed: boolPtr(true)},
+		models.ActionToSync{Id: 3, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -2,
+			Title: stringPtr("second"), Completed: boolPtr(false)},
+		models.ActionToSync{Id: 4, Type: "TODOS/DELETE_TODO", TodoIdMaybeTemp: 1})
+
+	response := mustSync(t, model, "A", tokenA, undoOf(5, 4), undoOf(6, 4))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["6"])
+	assert.Equal(t, 2, len(response.Todos))
+	// At the end of the list
+	restored := response.Todos[1]
+	assert.Equal(t, 1, restored.Id)
+	assert.Equal(t, "first", restored.Title)
+	assert.Equal(t, true, restored.Completed)
+	// Above the version 2 it was deleted at, so stale updates conflict
+	assert.Equal(t, true, restored.Version > 2)
+
+	// Undoing the undo does nothing; the client deletes again instead
+	response = mustSync(t, model, "A", tokenA, undoOf(7, 5))
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["7"])
+	assert.Equal(t, 2, len(response.Todos))
+}
+
+func TestUndoAdd(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	tokenB := mustRegister(t, model, "B", "U", tokenA)
+	mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("first"), Completed: boolPtr(false)},
+		models.ActionToSync{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("renamed")},
+		models.ActionToSync{Id: 3, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -2,
+			Title: stringPtr("second"), Completed: boolPtr(false)})
+	mustSync(t, model, "B", tokenB,
+		models.ActionToSync{Id: 1, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: 2,
+			Completed: boolPtr(true)})
+
+	// The first was only changed by A, but B changed the second
+	response := mustSync(t, model, "A", tokenA, undoOf(4, 1), undoOf(5, 3))
+	assert.Equal(t, 1, response.ActionToSyncIdToOutput["4"])
+	assert.Equal(t, 0, response.ActionToSyncIdToOutput["5"])
+	assert.Equal(t, 1, len(response.Todos))
+	assert.Equal(t, 2, response.Todos[0].Id)
+}
+
+func TestUndoMissingUndoneId(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	_, err := HandleBody(context.Background(), Body{
+		DeviceUid:     "A",
+		Token:         tokenA,
+		ActionsToSync: []models.ActionToSync{{Id: 1, Type: "TODOS/UNDO"}},
+	}, model, Config{})
+	assert.EqualError(t, err, "Error from handleActionToSync: "+
+		"Missing undoneId in action {1 TODOS/UNDO 0 <nil> <nil> <nil> <nil> "+
+		"<nil> <nil> <nil> <nil> <nil> <nil> <nil> <nil> <nil>}")
+}
+
+func TestRebuildTodosReplaysUndos(t *testing.T) {
+	model := models.NewMemoryModel()
+	tokenA := mustRegister(t, model, "A", "U", "")
+	mustSync(t, model, "A", tokenA,
+		models.ActionToSync{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: stringPtr("first"), Completed: boolPtr(false)},
+		models.ActionToSync{Id: 2, Type: "TODO/UPDATE_TODO", TodoIdMaybeTemp: -1,
+			Completed: boolPtr(true)},
+		undoOf(3, 2),
+		models.ActionToSync{Id: 4, Type: "TODOS/DELETE_TODO", TodoIdMaybeTemp: 1},
+		undoOf(5, 4))
+	todos := model.Todos
+
+	assert.Equal(t, nil, RebuildTodos(context.Background(), model, Config{}))
+	assert.Equal(t, 1, len(model.Todos))
+	assert.Equal(t, todos[0].Title, model.Todos[0].Title)
+	assert.Equal(t, todos[0].Completed, model.Todos[0].Completed)
+	assert.Equal(t, todos[0].Version, model.Todos[0].Version)
+}
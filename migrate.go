@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const migrateUsage = "Usage: todomvc-backend-go " +
+	"-postgres_credentials_path PATH|-sqlite_path PATH migrate up|down|status"
+
+// mustRunMigrateCommand handles `migrate up`, `migrate down` and
+// `migrate status`; subcommandArgs are the arguments after `migrate`
+func mustRunMigrateCommand(args CommandLineArgs, subcommandArgs []string) {
+	if len(subcommandArgs) != 1 {
+		log.Fatal(migrateUsage)
+	}
+	var db *sql.DB
+	var dialect *models.Dialect
+	if args.postgresCredentialsPath != "" {
+		creds := readPostgresCredentials(args.postgresCredentialsPath)
+		db, dialect = models.MustConnectPostgres(creds), models.PostgresDialect
+	} else if args.sqlitePath != "" {
+		var err error
+		db, err = models.ConnectSqlite(args.sqlitePath)
+		if err != nil {
+			log.Fatalf("Error from ConnectSqlite: %s", err)
+		}
+		dialect = models.SqliteDialect
+	} else {
+		log.Fatal(migrateUsage)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	switch subcommandArgs[0] {
+	case "up":
+		applied, err := models.MigrateUp(ctx, db, dialect)
+		for _, migration := range applied {
+			log.Printf("Applied %04d_%s", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatalf("Error from MigrateUp: %s", err)
+		}
+		if len(applied) == 0 {
+			log.Printf("Schema was already up to date")
+		}
+	case "down":
+		reverted, err := models.MigrateDown(ctx, db, dialect)
+		if err != nil {
+			log.Fatalf("Error from MigrateDown: %s", err)
+		}
+		if reverted == nil {
+			log.Printf("No migrations to revert")
+		} else {
+			log.Printf("Reverted %04d_%s", reverted.Version, reverted.Name)
+		}
+	case "status":
+		statuses, err := models.ListMigrationStatuses(ctx, db, dialect)
+		if err != nil {
+			log.Fatalf("Error from ListMigrationStatuses: %s", err)
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(writer, "%04d_%s\t%s\n", status.Version, status.Name,
+				appliedAt)
+		}
+		writer.Flush()
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
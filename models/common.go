@@ -1,15 +1,179 @@
 package models
 
+import (
+	"context"
+	"time"
+)
+
+type User struct {
+	Id  int
+	Uid string
+}
+
 type Device struct {
-	Id                     int
-	Uid                    string
+	Id     int
+	Uid    string
+	UserId int
+	// TokenHash is the SHA-256 of the device's bearer token in hex, or blank
+	// if the token was revoked
+	TokenHash              string
 	ActionToSyncIdToOutput map[int]int
 }
 
 type Todo struct {
-	Id        int    `json:"id"`
+	Id     int `json:"id"`
+	UserId int `json:"-"`
+	// ListId is the TodoList the todo is in, or 0 if it isn't in any
+	ListId    int    `json:"listId"`
 	Title     string `json:"title"`
 	Completed bool   `json:"completed"`
+	// Position orders the user's todos, lowest first, with ties broken by Id.
+	// Todos are added at the end, TodoPositionGap after the last one.
+	Position int `json:"position"`
+	// Revision is the value of the model-wide change counter when this todo
+	// was last created or updated.  The counter only goes up, but may skip
+	// values, e.g. for rolled-back transactions.
+	Revision int `json:"revision"`
+	// CreatedRevision is the Revision when this todo was created, restored or
+	// replaced, so syncs since a cursor can tell new todos from updated ones
+	CreatedRevision int `json:"-"`
+	// Version starts at 1 and counts this todo's updates; clients send it
+	// back as ActionToSync.BaseVersion
+	Version int `json:"version"`
+
+	// The Version when each field was last set, for merging conflicts
+	TitleVersion     int `json:"-"`
+	CompletedVersion int `json:"-"`
+	// The ClientTimestamp of the last action to set a field, if it had one
+	ClientUpdatedAt int64 `json:"-"`
+}
+
+// TodoPositionGap separates the Positions of todos added at the end, or
+// renumbered, leaving room to move todos between them
+const TodoPositionGap = 1024
+
+// DeletedTodo is a tombstone, kept so clients syncing from an earlier
+// revision find out the todo is gone
+type DeletedTodo struct {
+	Id     int
+	UserId int
+	// ListId is the list the todo was in, so members it's shared with find out
+	ListId   int
+	Revision int
+}
+
+// TodoList groups some of a user's todos under a name.  Archived lists keep
+// their todos, but clients hide them.
+type TodoList struct {
+	Id       int    `json:"id"`
+	UserId   int    `json:"-"`
+	Name     string `json:"name"`
+	Archived bool   `json:"archived"`
+	// Revision is from the same counter as Todo.Revision
+	Revision int `json:"revision"`
+}
+
+// DeletedTodoList is a tombstone, like DeletedTodo.  A list shared with
+// other users leaves one for each member when it's deleted, and one for a
+// member who's removed from it.
+type DeletedTodoList struct {
+	Id       int
+	UserId   int
+	Revision int
+}
+
+// Roles of ListMembers
+const (
+	// RoleOwner is for the list's UserId, who can also rename, archive, delete
+	// and share the list
+	RoleOwner = "owner"
+	// RoleEditor can add, change and delete the list's todos
+	RoleEditor = "editor"
+	// RoleViewer can only see the list and its todos
+	RoleViewer = "viewer"
+)
+
+// ListMember shares a TodoList with a user.  The list's todos still belong
+// to its owner, who's a member with RoleOwner.
+type ListMember struct {
+	ListId int `json:"-"`
+	UserId int `json:"-"`
+	// UserUid is looked up when members are read, and ignored otherwise
+	UserUid string `json:"userUid"`
+	Role    string `json:"role"`
+	// Revision is from when the user joined the list or last changed role
+	Revision int `json:"-"`
+}
+
+// ListInvite lets whoever has the Code join the list, once, with the Role
+type ListInvite struct {
+	Code   string `json:"code"`
+	ListId int    `json:"-"`
+	Role   string `json:"role"`
+}
+
+// StreamToken lets whoever has the token open one push session for the
+// device, e.g. an event stream, without the device's token.  Only its hash
+// is stored, like the device's token.
+type StreamToken struct {
+	TokenHash string
+	DeviceId  int
+	IssuedAt  time.Time
+}
+
+// ResetRecord says which admin wiped the model with Reset, and when
+type ResetRecord struct {
+	Id        int
+	AdminName string
+	ResetAt   time.Time
+}
+
+// ActionEvent records an ActionToSync applied by a device.  They're never
+// changed or deleted (except by Reset), so replaying them in Id order
+// rebuilds the todos.
+type ActionEvent struct {
+	Id int
+	// UserId is the user whose todos and lists the action applied to: the
+	// device's, or the owner of a list shared with the device's user
+	UserId   int
+	DeviceId int
+	// TodoId is the todo the action applied to, with a temporary id replaced
+	// by the real one.  For TODOS/ADD_TODO, it's the todo created, and for
+	// actions on any number of todos, like TODOS/UNDO, or on lists, 0.
+	TodoId int
+	// Action is as the device sent it, except that temporary ids of other
+	// todos and lists it refers to, like BeforeTodoIdMaybeTemp, are replaced
+	Action     ActionToSync
+	ServerTime time.Time
+	// Output is the action's entry in Device.ActionToSyncIdToOutput
+	Output int
+}
+
+// TodoChange records who changed a todo's fields, or deleted it, so users
+// can find out.  Title and Completed are the values the change set, or nil if
+// it didn't set them; TODOS/ADD_TODO sets both.
+type TodoChange struct {
+	Id     int `json:"id"`
+	UserId int `json:"-"`
+	TodoId int `json:"todoId"`
+	// ListId is, for TODOS/ADD_TODO, the list the todo was added to
+	ListId         int       `json:"listId,omitempty"`
+	DeviceId       int       `json:"deviceId"`
+	ActionToSyncId int       `json:"actionToSyncId"`
+	Type           string    `json:"type"`
+	Title          *string   `json:"title,omitempty"`
+	Completed      *bool     `json:"completed,omitempty"`
+	ServerTime     time.Time `json:"serverTime"`
+}
+
+// Changes lists the todos and lists created, updated or deleted after some
+// revision, up to and including Revision
+type Changes struct {
+	Todos          []Todo
+	DeletedTodoIds []int
+	Lists          []TodoList
+	DeletedListIds []int
+	Revision       int
 }
 
 type ActionToSync struct {
@@ -18,14 +182,214 @@ type ActionToSync struct {
 	TodoIdMaybeTemp int     `json:"todoIdMaybeTemp"`
 	Title           *string `json:"title,omitempty"`
 	Completed       *bool   `json:"completed,omitempty"`
+	// BaseVersion is the Todo.Version the client last saw before making this
+	// update, to detect updates from other devices in the meantime
+	BaseVersion *int `json:"baseVersion,omitempty"`
+	// ClientTimestamp is when the user made the change, in milliseconds since
+	// the Unix epoch according to the device's clock
+	ClientTimestamp *int64 `json:"clientTimestamp,omitempty"`
+	// For TODO/MOVE_TODO, exactly one is set, to the id (maybe temporary) of
+	// the todo to move this one before or after
+	BeforeTodoIdMaybeTemp *int `json:"beforeTodoIdMaybeTemp,omitempty"`
+	AfterTodoIdMaybeTemp  *int `json:"afterTodoIdMaybeTemp,omitempty"`
+	// ListIdMaybeTemp is the id (maybe temporary) of the list that
+	// LISTS/ADD_LIST creates, or that LIST/UPDATE_LIST, LISTS/DELETE_LIST,
+	// LIST/INVITE_TO_LIST or LIST/UPDATE_MEMBER applies to.  For
+	// TODOS/ADD_TODO, it's the list to add the todo to, with nil or 0 meaning
+	// none; for TODOS/TOGGLE_ALL and TODOS/CLEAR_COMPLETED, it limits them to
+	// that list's todos, with 0 meaning those in no list.
+	ListIdMaybeTemp *int `json:"listIdMaybeTemp,omitempty"`
+	// Name and Archived are set by LISTS/ADD_LIST and LIST/UPDATE_LIST
+	Name     *string `json:"name,omitempty"`
+	Archived *bool   `json:"archived,omitempty"`
+	// UndoneId is, for TODOS/UNDO, the Id of the earlier action from the same
+	// device to reverse
+	UndoneId *int `json:"undoneId,omitempty"`
+	// Role is the ListMember.Role that LIST/INVITE_TO_LIST invites someone
+	// with, or that LIST/UPDATE_MEMBER gives MemberUserUid; for the latter, ""
+	// removes them from the list
+	Role          *string `json:"role,omitempty"`
+	MemberUserUid *string `json:"memberUserUid,omitempty"`
+	// InviteCode is the ListInvite.Code that LISTS/JOIN_LIST uses
+	InviteCode *string `json:"inviteCode,omitempty"`
 }
 
+// Model is implemented by every storage backend.  Errors returned by its
+// methods wrap ErrNotFound, ErrConflict or ErrUnavailable when the cause is
+// known; see errors.go.
+//
+// Methods with a userId only see and change that user's todos and lists;
+// other users' are treated as if they didn't exist.  The todos in a list
+// shared with other users belong to its owner, so callers check the others'
+// ListMember.Role, then pass the owner's id.  Methods given an action
+// read list ids from ListIdMaybeTemp, with any temporary id already replaced.
 type Model interface {
-	Reset()
-	FindOrCreateDeviceByUid(uid string) Device
-	UpdateDeviceActionToSyncIdToOutputJson(device Device)
-	CreateTodo(action ActionToSync) Todo
-	UpdateTodo(action ActionToSync, todoId int) int
-	ListTodos() []Todo
-	DeleteTodo(todoInt int) int
+	// WithTx calls fn with a Model whose changes are applied all-or-nothing:
+	// committed if fn returns nil, discarded if it returns an error.  Calling
+	// WithTx on the Model passed to fn just calls fn again in the same
+	// transaction.
+	WithTx(ctx context.Context, fn func(tx Model) error) error
+	// LockForWrite makes the transaction wait until no other transaction can
+	// change todos or lists, and keeps others from doing so until it ends.
+	// Methods that change them take the lock themselves, but transactions
+	// that read something they then change call it first, so what they read
+	// can't be changed in the meantime.  Read-only transactions don't need it.
+	LockForWrite(ctx context.Context) error
+
+	// Reset deletes everything except the ResetRecords
+	Reset(ctx context.Context) error
+	CreateResetRecord(ctx context.Context, adminName string,
+		resetAt time.Time) (ResetRecord, error)
+	// FindUserByUid returns ErrNotFound if there's no such user
+	FindUserByUid(ctx context.Context, uid string) (User, error)
+	// CreateUser returns ErrConflict if the uid is taken
+	CreateUser(ctx context.Context, uid string) (User, error)
+	// CreateDevice returns ErrConflict if the uid or a non-blank tokenHash is
+	// taken
+	CreateDevice(ctx context.Context, uid string, userId int,
+		tokenHash string) (Device, error)
+	// FindDeviceByUid returns ErrNotFound if there's no such device
+	FindDeviceByUid(ctx context.Context, uid string) (Device, error)
+	// FindDeviceByTokenHash returns ErrNotFound if no device has the hash
+	FindDeviceByTokenHash(ctx context.Context, tokenHash string) (Device, error)
+	// UpdateDeviceTokenHash replaces the device's token; a blank tokenHash
+	// revokes it.  Returns ErrNotFound if there's no such device, or
+	// ErrConflict if another device has the tokenHash.
+	UpdateDeviceTokenHash(ctx context.Context, deviceId int,
+		tokenHash string) error
+	// UpdateDeviceActionToSyncIdToOutputJson saves the map of the device with
+	// device.Id, or returns ErrNotFound
+	UpdateDeviceActionToSyncIdToOutputJson(ctx context.Context, device Device) error
+	// CreateTodo adds the todo to the list action.ListIdMaybeTemp, if set,
+	// which the caller checks exists
+	CreateTodo(ctx context.Context, userId int, action ActionToSync) (Todo, error)
+	// FindTodoById returns any user's todo, or ErrNotFound, for finding out
+	// whose it is
+	FindTodoById(ctx context.Context, todoId int) (Todo, error)
+	// FindTodo returns ErrNotFound if there's no such todo.  In a transaction,
+	// it also keeps other transactions from changing the todo until this one
+	// ends.
+	FindTodo(ctx context.Context, userId int, todoId int) (Todo, error)
+	// UpdateTodo returns the number of todos updated: 0 if there's no such
+	// todo, or if the action doesn't set any fields
+	UpdateTodo(ctx context.Context, userId int, action ActionToSync,
+		todoId int) (int, error)
+	// ListTodos returns the user's todos ordered by Position, then Id
+	ListTodos(ctx context.Context, userId int) ([]Todo, error)
+	// MoveTodo sets the todo's Position and gives it a new Revision, but
+	// leaves its Version alone, since moves don't conflict with updates.
+	// Returns the number of todos moved, 0 or 1.
+	MoveTodo(ctx context.Context, userId int, todoId int,
+		position int) (int, error)
+	// RenumberTodos sets the Positions of the user's todos TodoPositionGap
+	// apart, keeping their order, and gives them a new Revision
+	RenumberTodos(ctx context.Context, userId int) error
+	// DeleteTodo returns the number of todos deleted, 0 or 1
+	DeleteTodo(ctx context.Context, userId int, todoInt int) (int, error)
+	// SetAllTodosCompleted sets Completed to *action.Completed, and
+	// ClientUpdatedAt to *action.ClientTimestamp if given, on each of the
+	// user's todos whose Completed differs, and returns their ids in order.
+	// If action.ListIdMaybeTemp is set, only todos in that list change.
+	SetAllTodosCompleted(ctx context.Context, userId int,
+		action ActionToSync) ([]int, error)
+	// DeleteCompletedTodos deletes the user's completed todos and returns
+	// their ids in order.  If action.ListIdMaybeTemp is set, only todos in
+	// that list are deleted.
+	DeleteCompletedTodos(ctx context.Context, userId int,
+		action ActionToSync) ([]int, error)
+	// RestoreTodo re-creates a deleted todo with todo's Id, ListId, Title,
+	// Completed and Version, which is also given to both fields, and a new
+	// Revision, at the end of the list.  Returns ErrNotFound unless
+	// todo.UserId has a tombstone with that Id.
+	RestoreTodo(ctx context.Context, todo Todo) (Todo, error)
+
+	// CreateTodoList returns the list named *action.Name, and makes the user
+	// its member with RoleOwner
+	CreateTodoList(ctx context.Context, userId int,
+		action ActionToSync) (TodoList, error)
+	// FindTodoListById returns any user's list, or ErrNotFound, like
+	// FindTodoById
+	FindTodoListById(ctx context.Context, listId int) (TodoList, error)
+	// FindTodoList returns ErrNotFound if there's no such list
+	FindTodoList(ctx context.Context, userId int, listId int) (TodoList, error)
+	// UpdateTodoList sets the list's Name and Archived to action's, for those
+	// set, and returns the number of lists updated: 0 if there's no such
+	// list, or if the action doesn't set either
+	UpdateTodoList(ctx context.Context, userId int, action ActionToSync,
+		listId int) (int, error)
+	// DeleteTodoList returns the number of lists deleted, 0 or 1, and removes
+	// its members and invites.  It leaves the list's todos alone, so delete
+	// them first.
+	DeleteTodoList(ctx context.Context, userId int, listId int) (int, error)
+	// ListTodoLists returns the user's lists ordered by Id
+	ListTodoLists(ctx context.Context, userId int) ([]TodoList, error)
+
+	// FindListMember returns ErrNotFound if the user isn't a member of the list
+	FindListMember(ctx context.Context, listId int,
+		userId int) (ListMember, error)
+	// ListListMembers returns the list's members ordered by UserId
+	ListListMembers(ctx context.Context, listId int) ([]ListMember, error)
+	// ListMemberships returns the user's memberships in any lists, including
+	// their own, ordered by ListId
+	ListMemberships(ctx context.Context, userId int) ([]ListMember, error)
+	// SetListMember adds member.UserId to the list, which must exist, or
+	// changes their Role.  Both the member and the list get a new Revision, so
+	// every member's next sync fetches the list.
+	SetListMember(ctx context.Context, member ListMember) error
+	// DeleteListMember removes the user from the list, leaving them a
+	// DeletedTodoList, and gives the list a new Revision.  Returns the number
+	// of members removed, 0 or 1.
+	DeleteListMember(ctx context.Context, listId int, userId int) (int, error)
+	// CreateListInvite saves the invite to a list, which must exist, and
+	// gives the list a new Revision, so its owner's devices fetch the invite.
+	// Returns ErrConflict if the code is taken.
+	CreateListInvite(ctx context.Context, invite ListInvite) error
+	// ListListInvites returns the list's unused invites ordered by Code
+	ListListInvites(ctx context.Context, listId int) ([]ListInvite, error)
+	// TakeListInvite deletes and returns the invite with the code, or returns
+	// ErrNotFound
+	TakeListInvite(ctx context.Context, code string) (ListInvite, error)
+
+	// CreateStreamToken saves the token, replacing the device's previous one,
+	// so each device has at most one.  Returns ErrConflict if the hash is
+	// taken.
+	CreateStreamToken(ctx context.Context, token StreamToken) error
+	// TakeStreamToken deletes and returns the token with the hash, or returns
+	// ErrNotFound
+	TakeStreamToken(ctx context.Context, tokenHash string) (StreamToken, error)
+
+	// ReplaceTodos deletes every todo and tombstone, and saves todos and
+	// deletedTodos instead with their Ids but a new Revision, so every
+	// client's next sync fetches them all.  Todos created later get Ids
+	// above any of theirs.
+	ReplaceTodos(ctx context.Context, todos []Todo,
+		deletedTodos []DeletedTodo) error
+
+	// CreateActionEvent ignores event.Id and returns the event with its Id
+	// set, or ErrConflict if the device already has an event for the action
+	CreateActionEvent(ctx context.Context, event ActionEvent) (ActionEvent, error)
+	// ListActionEvents returns every user's events, ordered by Id
+	ListActionEvents(ctx context.Context) ([]ActionEvent, error)
+
+	// CreateTodoChange ignores change.Id and returns the change with its Id
+	// set
+	CreateTodoChange(ctx context.Context, change TodoChange) (TodoChange, error)
+	// ListTodoChangesByAction returns the changes made by the device's action,
+	// ordered by Id
+	ListTodoChangesByAction(ctx context.Context, deviceId int,
+		actionToSyncId int) ([]TodoChange, error)
+	// ListTodoChanges returns the changes to one of the user's todos, deleted
+	// or not, ordered by Id
+	ListTodoChanges(ctx context.Context, userId int,
+		todoId int) ([]TodoChange, error)
+
+	// LatestRevision returns the revision of the most recent change to any
+	// user's todos or lists, or 0 if there haven't been any
+	LatestRevision(ctx context.Context) (int, error)
+	ListChangesSince(ctx context.Context, userId int,
+		revision int) (Changes, error)
+	// ListChangesInListSince is like ListChangesSince, but for the todos in a
+	// list, and the list itself, whoever they belong to
+	ListChangesInListSince(ctx context.Context, listId int,
+		revision int) (Changes, error)
 }
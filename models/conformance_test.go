@@ -0,0 +1,1078 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+// Points at a JSON file of PostgresCredentials for a database that
+// TestDbModelConformance may wipe; the test is skipped if it's unset.  See
+// `make test-postgres`.
+const testPostgresCredentialsPathEnv = "TEST_POSTGRES_CREDENTIALS_PATH"
+
+// newModelFunc returns an empty Model for one conformance test
+type newModelFunc func(t *testing.T) Model
+
+// testModelConformance runs every conformance test against models from
+// newModel, so every Model implementation is held to the same behavior
+func testModelConformance(t *testing.T, newModel newModelFunc) {
+	for _, test := range []struct {
+		name string
+		run  func(t *testing.T, model Model)
+	}{
+		{"Users", testUsers},
+		{"Devices", testDevices},
+		{"DeviceTokenHashes", testDeviceTokenHashes},
+		{"CreateTodo", testCreateTodo},
+		{"UpdateTodo", testUpdateTodo},
+		{"DeleteTodo", testDeleteTodo},
+		{"RestoreTodo", testRestoreTodo},
+		{"SetAllTodosCompleted", testSetAllTodosCompleted},
+		{"DeleteCompletedTodos", testDeleteCompletedTodos},
+		{"TodoLists", testTodoLists},
+		{"TodosInLists", testTodosInLists},
+		{"ListMembers", testListMembers},
+		{"ListInvites", testListInvites},
+		{"StreamTokens", testStreamTokens},
+		{"ListChangesInListSince", testListChangesInListSince},
+		{"MoveTodo", testMoveTodo},
+		{"RenumberTodos", testRenumberTodos},
+		{"ListChangesSince", testListChangesSince},
+		{"ReplaceTodos", testReplaceTodos},
+		{"ActionEvents", testActionEvents},
+		{"TodoChanges", testTodoChanges},
+		{"WithTx", testWithTx},
+		{"Reset", testReset},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, newModel(t))
+		})
+	}
+}
+
+func TestMemoryModelConformance(t *testing.T) {
+	testModelConformance(t, func(t *testing.T) Model {
+		return NewMemoryModel()
+	})
+}
+
+// testPostgresCredentials skips the test unless the credentials are set
+func testPostgresCredentials(t *testing.T) PostgresCredentials {
+	credsPath := os.Getenv(testPostgresCredentialsPathEnv)
+	if credsPath == "" {
+		t.Skipf("Set %s to run against PostgreSQL", testPostgresCredentialsPathEnv)
+	}
+	credsFile, err := os.Open(credsPath)
+	if err != nil {
+		t.Fatalf("Error from os.Open: %s", err)
+	}
+	defer credsFile.Close()
+	var creds PostgresCredentials
+	if err := json.NewDecoder(credsFile).Decode(&creds); err != nil {
+		t.Fatalf("Error decoding %s: %s", credsPath, err)
+	}
+	return creds
+}
+
+func TestDbModelConformance(t *testing.T) {
+	creds := testPostgresCredentials(t)
+	db, err := ConnectPostgres(creds)
+	if err != nil {
+		t.Fatalf("Error from ConnectPostgres: %s", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := MigrateUp(ctx, db, PostgresDialect); err != nil {
+		t.Fatalf("Error from MigrateUp: %s", err)
+	}
+
+	testModelConformance(t, func(t *testing.T) Model {
+		model := NewDbModel(db)
+		// Unlike Reset, start the ResetRecords over too
+		if err := model.Reset(ctx); err != nil {
+			t.Fatalf("Error from Reset: %s", err)
+		}
+		if err := model.deleteFrom(ctx, "reset_records"); err != nil {
+			t.Fatalf("Error from deleteFrom: %s", err)
+		}
+		if _, err := model.conn.ExecContext(ctx,
+			"ALTER SEQUENCE reset_records_id_seq RESTART WITH 1;"); err != nil {
+			t.Fatalf("Error from ExecContext: %s", err)
+		}
+		return model
+	})
+}
+
+func testUsers(t *testing.T, model Model) {
+	ctx := context.Background()
+	_, err := model.FindUserByUid(ctx, "U")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	user, err := model.CreateUser(ctx, "U")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, User{Id: 1, Uid: "U"}, user)
+	user, err = model.CreateUser(ctx, "V")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, User{Id: 2, Uid: "V"}, user)
+	_, err = model.CreateUser(ctx, "U")
+	assert.Equal(t, true, errors.Is(err, ErrConflict))
+
+	user, err = model.FindUserByUid(ctx, "U")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, User{Id: 1, Uid: "U"}, user)
+}
+
+func testDevices(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	device, err := model.CreateDevice(ctx, "A", user.Id, "hash")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Device{Id: 1, Uid: "A", UserId: 1, TokenHash: "hash",
+		ActionToSyncIdToOutput: map[int]int{}}, device)
+	_, err = model.CreateDevice(ctx, "A", user.Id, "other hash")
+	assert.Equal(t, true, errors.Is(err, ErrConflict))
+	other, err := model.CreateDevice(ctx, "B", user.Id, "")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, other.Id)
+	_, err = model.FindDeviceByUid(ctx, "C")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	device.ActionToSyncIdToOutput[3] = 4
+	assert.Equal(t, nil,
+		model.UpdateDeviceActionToSyncIdToOutputJson(ctx, device))
+	found, err := model.FindDeviceByUid(ctx, "A")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[int]int{3: 4}, found.ActionToSyncIdToOutput)
+
+	// Changing a found device's map doesn't change the stored one
+	found.ActionToSyncIdToOutput[5] = 6
+	found, _ = model.FindDeviceByUid(ctx, "A")
+	assert.Equal(t, map[int]int{3: 4}, found.ActionToSyncIdToOutput)
+	found, _ = model.FindDeviceByUid(ctx, "B")
+	assert.Equal(t, map[int]int{}, found.ActionToSyncIdToOutput)
+
+	err = model.UpdateDeviceActionToSyncIdToOutputJson(ctx, Device{Id: 99})
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+}
+
+func testDeviceTokenHashes(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	device, _ := model.CreateDevice(ctx, "A", user.Id, "hash")
+	model.CreateDevice(ctx, "B", user.Id, "")
+	model.CreateDevice(ctx, "C", user.Id, "")
+
+	found, err := model.FindDeviceByTokenHash(ctx, "hash")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "A", found.Uid)
+	_, err = model.FindDeviceByTokenHash(ctx, "")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	_, err = model.CreateDevice(ctx, "D", user.Id, "hash")
+	assert.Equal(t, true, errors.Is(err, ErrConflict))
+
+	assert.Equal(t, nil, model.UpdateDeviceTokenHash(ctx, device.Id, "new hash"))
+	_, err = model.FindDeviceByTokenHash(ctx, "hash")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	found, _ = model.FindDeviceByTokenHash(ctx, "new hash")
+	assert.Equal(t, "A", found.Uid)
+	err = model.UpdateDeviceTokenHash(ctx, 2, "new hash")
+	assert.Equal(t, true, errors.Is(err, ErrConflict))
+
+	// Revoking
+	assert.Equal(t, nil, model.UpdateDeviceTokenHash(ctx, device.Id, ""))
+	_, err = model.FindDeviceByTokenHash(ctx, "new hash")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	found, _ = model.FindDeviceByUid(ctx, "A")
+	assert.Equal(t, "", found.TokenHash)
+
+	err = model.UpdateDeviceTokenHash(ctx, 99, "hash")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+}
+
+func testCreateTodo(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	revision, err := model.LatestRevision(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, revision)
+
+	clientTimestamp := int64(1500000000000)
+	first, err := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:           pointToString("first"),
+		Completed:       pointToBool(true),
+		ClientTimestamp: &clientTimestamp,
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Todo{Id: 1, UserId: 1, Title: "first", Completed: true,
+		Position: TodoPositionGap, Revision: 1, CreatedRevision: 1, Version: 1,
+		TitleVersion: 1, CompletedVersion: 1, ClientUpdatedAt: clientTimestamp},
+		first)
+	second, err := model.CreateTodo(ctx, otherUser.Id, ActionToSync{
+		Title:     pointToString("second"),
+		Completed: pointToBool(false),
+	})
+	assert.Equal(t, nil, err)
+	// Positions are per user
+	assert.Equal(t, Todo{Id: 2, UserId: 2, Title: "second", Completed: false,
+		Position: TodoPositionGap, Revision: 2, CreatedRevision: 2, Version: 1,
+		TitleVersion: 1, CompletedVersion: 1}, second)
+	third, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("third"),
+		Completed: pointToBool(false),
+	})
+	assert.Equal(t, 3, third.Id)
+	assert.Equal(t, 2*TodoPositionGap, third.Position)
+
+	found, err := model.FindTodo(ctx, user.Id, first.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first, found)
+	_, err = model.FindTodo(ctx, user.Id, second.Id)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	_, err = model.FindTodo(ctx, user.Id, 99)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	todos, err := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Todo{first, third}, todos)
+	todos, err = model.ListTodos(ctx, 99)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Todo{}, todos)
+
+	revision, _ = model.LatestRevision(ctx)
+	assert.Equal(t, 3, revision)
+}
+
+func testUpdateTodo(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	todo, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("t"),
+		Completed: pointToBool(false),
+	})
+
+	// Each field's version is the todo's version when it was last set
+	numUpdated, err := model.UpdateTodo(ctx, user.Id,
+		ActionToSync{Completed: pointToBool(true)}, todo.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, numUpdated)
+	numUpdated, err = model.UpdateTodo(ctx, user.Id,
+		ActionToSync{Title: pointToString("u")}, todo.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, numUpdated)
+	clientTimestamp := int64(1500000000000)
+	numUpdated, err = model.UpdateTodo(ctx, user.Id,
+		ActionToSync{ClientTimestamp: &clientTimestamp}, todo.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, numUpdated)
+	updated, _ := model.FindTodo(ctx, user.Id, todo.Id)
+	assert.Equal(t, Todo{Id: 1, UserId: 1, Title: "u", Completed: true,
+		Position: TodoPositionGap, Revision: 4, CreatedRevision: 1, Version: 4,
+		TitleVersion: 3, CompletedVersion: 2, ClientUpdatedAt: clientTimestamp},
+		updated)
+
+	// Updates that change nothing
+	numUpdated, err = model.UpdateTodo(ctx, user.Id, ActionToSync{}, todo.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, numUpdated)
+	numUpdated, err = model.UpdateTodo(ctx, user.Id,
+		ActionToSync{Completed: pointToBool(false)}, 99)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, numUpdated)
+	numUpdated, err = model.UpdateTodo(ctx, otherUser.Id,
+		ActionToSync{Completed: pointToBool(false)}, todo.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, numUpdated)
+	found, _ := model.FindTodo(ctx, user.Id, todo.Id)
+	assert.Equal(t, updated, found)
+	revision, _ := model.LatestRevision(ctx)
+	assert.Equal(t, 4, revision)
+}
+
+func testDeleteTodo(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	todo, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("t"),
+		Completed: pointToBool(false),
+	})
+
+	numDeleted, err := model.DeleteTodo(ctx, otherUser.Id, todo.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, numDeleted)
+	numDeleted, err = model.DeleteTodo(ctx, user.Id, todo.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, numDeleted)
+	numDeleted, err = model.DeleteTodo(ctx, user.Id, todo.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, numDeleted)
+
+	_, err = model.FindTodo(ctx, user.Id, todo.Id)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	todos, _ := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, []Todo{}, todos)
+
+	// Ids aren't reused
+	next, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("t"),
+		Completed: pointToBool(false),
+	})
+	assert.Equal(t, 2, next.Id)
+}
+
+// Creates the user's todos, completed or not, in order
+func createTodos(t *testing.T, model Model, userId int,
+	completeds ...bool) []Todo {
+	todos := []Todo{}
+	for _, completed := range completeds {
+		todo, err := model.CreateTodo(context.Background(), userId, ActionToSync{
+			Title:     pointToString("t"),
+			Completed: pointToBool(completed),
+		})
+		assert.Equal(t, nil, err)
+		todos = append(todos, todo)
+	}
+	return todos
+}
+
+func testSetAllTodosCompleted(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	todos := createTodos(t, model, user.Id, false, true, false)
+	otherTodos := createTodos(t, model, otherUser.Id, false)
+	revision, _ := model.LatestRevision(ctx)
+
+	todoIds, err := model.SetAllTodosCompleted(ctx, user.Id, ActionToSync{
+		Completed:       pointToBool(true),
+		ClientTimestamp: pointToInt64(123),
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{todos[0].Id, todos[2].Id}, todoIds)
+	for _, i := range []int{0, 2} {
+		updated, _ := model.FindTodo(ctx, user.Id, todos[i].Id)
+		assert.Equal(t, true, updated.Completed)
+		assert.Equal(t, 2, updated.Version)
+		assert.Equal(t, 2, updated.CompletedVersion)
+		assert.Equal(t, 1, updated.TitleVersion)
+		assert.Equal(t, int64(123), updated.ClientUpdatedAt)
+		assert.Equal(t, true, updated.Revision > revision)
+	}
+	unchanged, _ := model.FindTodo(ctx, user.Id, todos[1].Id)
+	assert.Equal(t, todos[1], unchanged)
+	unchanged, _ = model.FindTodo(ctx, otherUser.Id, otherTodos[0].Id)
+	assert.Equal(t, otherTodos[0], unchanged)
+
+	todoIds, err = model.SetAllTodosCompleted(ctx, user.Id, ActionToSync{
+		Completed: pointToBool(true),
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{}, todoIds)
+	todoIds, err = model.SetAllTodosCompleted(ctx, user.Id, ActionToSync{
+		Completed: pointToBool(false),
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{todos[0].Id, todos[1].Id, todos[2].Id}, todoIds)
+	updated, _ := model.FindTodo(ctx, user.Id, todos[1].Id)
+	assert.Equal(t, int64(0), updated.ClientUpdatedAt)
+}
+
+func testDeleteCompletedTodos(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	todos := createTodos(t, model, user.Id, true, false, true)
+	otherTodos := createTodos(t, model, otherUser.Id, true)
+	revision, _ := model.LatestRevision(ctx)
+
+	todoIds, err := model.DeleteCompletedTodos(ctx, user.Id, ActionToSync{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{todos[0].Id, todos[2].Id}, todoIds)
+	left, _ := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, []Todo{todos[1]}, left)
+	left, _ = model.ListTodos(ctx, otherUser.Id)
+	assert.Equal(t, otherTodos, left)
+	changes, _ := model.ListChangesSince(ctx, user.Id, revision)
+	assert.Equal(t, []int{todos[0].Id, todos[2].Id}, changes.DeletedTodoIds)
+
+	todoIds, err = model.DeleteCompletedTodos(ctx, user.Id, ActionToSync{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{}, todoIds)
+}
+
+func testMoveTodo(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	todos := createTodos(t, model, user.Id, false, false, false)
+	revision, _ := model.LatestRevision(ctx)
+
+	output, err := model.MoveTodo(ctx, user.Id, todos[2].Id,
+		todos[0].Position-TodoPositionGap)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, output)
+	moved, _ := model.FindTodo(ctx, user.Id, todos[2].Id)
+	assert.Equal(t, todos[0].Position-TodoPositionGap, moved.Position)
+	assert.Equal(t, todos[2].Version, moved.Version)
+	assert.Equal(t, revision+1, moved.Revision)
+	listed, _ := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, []Todo{moved, todos[0], todos[1]}, listed)
+
+	// Ties in position are broken by id
+	output, err = model.MoveTodo(ctx, user.Id, todos[1].Id, todos[0].Position)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, output)
+	listed, _ = model.ListTodos(ctx, user.Id)
+	assert.Equal(t, []int{todos[2].Id, todos[0].Id, todos[1].Id},
+		[]int{listed[0].Id, listed[1].Id, listed[2].Id})
+
+	output, err = model.MoveTodo(ctx, otherUser.Id, todos[0].Id, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, output)
+}
+
+func testRenumberTodos(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	todos := createTodos(t, model, user.Id, false, false, false)
+	otherTodos := createTodos(t, model, otherUser.Id, false)
+	model.MoveTodo(ctx, user.Id, todos[2].Id, todos[0].Position)
+	model.MoveTodo(ctx, user.Id, todos[1].Id, todos[0].Position-1)
+	revision, _ := model.LatestRevision(ctx)
+
+	assert.Equal(t, nil, model.RenumberTodos(ctx, user.Id))
+	listed, _ := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, 3, len(listed))
+	for i, id := range []int{todos[1].Id, todos[0].Id, todos[2].Id} {
+		assert.Equal(t, id, listed[i].Id)
+		assert.Equal(t, (i+1)*TodoPositionGap, listed[i].Position)
+		assert.Equal(t, 1, listed[i].Version)
+		assert.Equal(t, true, listed[i].Revision > revision)
+	}
+	listed, _ = model.ListTodos(ctx, otherUser.Id)
+	assert.Equal(t, otherTodos, listed)
+}
+
+func testTodoLists(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+
+	first, err := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("first")})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, TodoList{Id: 1, UserId: user.Id, Name: "first",
+		Revision: 1}, first)
+	second, _ := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("second")})
+	other, _ := model.CreateTodoList(ctx, otherUser.Id,
+		ActionToSync{Name: pointToString("other")})
+
+	found, err := model.FindTodoList(ctx, user.Id, first.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first, found)
+	_, err = model.FindTodoList(ctx, user.Id, other.Id)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	output, err := model.UpdateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("renamed")}, first.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, output)
+	output, err = model.UpdateTodoList(ctx, user.Id,
+		ActionToSync{Archived: pointToBool(true)}, first.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, output)
+	output, _ = model.UpdateTodoList(ctx, user.Id, ActionToSync{}, first.Id)
+	assert.Equal(t, 0, output)
+	output, _ = model.UpdateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("stolen")}, other.Id)
+	assert.Equal(t, 0, output)
+	first, _ = model.FindTodoList(ctx, user.Id, first.Id)
+	assert.Equal(t, "renamed", first.Name)
+	assert.Equal(t, true, first.Archived)
+	assert.Equal(t, true, first.Revision > other.Revision)
+
+	lists, err := model.ListTodoLists(ctx, user.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []TodoList{first, second}, lists)
+
+	output, err = model.DeleteTodoList(ctx, user.Id, second.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, output)
+	output, _ = model.DeleteTodoList(ctx, user.Id, second.Id)
+	assert.Equal(t, 0, output)
+	output, _ = model.DeleteTodoList(ctx, user.Id, other.Id)
+	assert.Equal(t, 0, output)
+	lists, _ = model.ListTodoLists(ctx, user.Id)
+	assert.Equal(t, []TodoList{first}, lists)
+
+	revision, _ := model.LatestRevision(ctx)
+	assert.Equal(t, true, revision > first.Revision)
+	changes, _ := model.ListChangesSince(ctx, user.Id, other.Revision)
+	assert.Equal(t, Changes{Todos: []Todo{}, DeletedTodoIds: []int{},
+		Lists: []TodoList{first}, DeletedListIds: []int{second.Id},
+		Revision: revision}, changes)
+}
+
+func testTodosInLists(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	list, _ := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("list")})
+	todos := []Todo{}
+	for _, listId := range []*int{nil, pointToInt(list.Id), pointToInt(0),
+		pointToInt(list.Id)} {
+		todo, err := model.CreateTodo(ctx, user.Id, ActionToSync{
+			Title:           pointToString("t"),
+			Completed:       pointToBool(false),
+			ListIdMaybeTemp: listId,
+		})
+		assert.Equal(t, nil, err)
+		todos = append(todos, todo)
+	}
+	listIds := []int{}
+	for _, todo := range todos {
+		found, _ := model.FindTodo(ctx, user.Id, todo.Id)
+		assert.Equal(t, todo, found)
+		listIds = append(listIds, found.ListId)
+	}
+	assert.Equal(t, []int{0, list.Id, 0, list.Id}, listIds)
+
+	todoIds, err := model.SetAllTodosCompleted(ctx, user.Id, ActionToSync{
+		Completed:       pointToBool(true),
+		ListIdMaybeTemp: pointToInt(list.Id),
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{todos[1].Id, todos[3].Id}, todoIds)
+	todoIds, err = model.SetAllTodosCompleted(ctx, user.Id, ActionToSync{
+		Completed:       pointToBool(true),
+		ListIdMaybeTemp: pointToInt(0),
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{todos[0].Id, todos[2].Id}, todoIds)
+
+	todoIds, err = model.DeleteCompletedTodos(ctx, user.Id,
+		ActionToSync{ListIdMaybeTemp: pointToInt(list.Id)})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{todos[1].Id, todos[3].Id}, todoIds)
+	left, _ := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, []int{todos[0].Id, todos[2].Id},
+		[]int{left[0].Id, left[1].Id})
+
+	// Restoring puts the todo back in its list
+	restored, err := model.RestoreTodo(ctx, Todo{Id: todos[1].Id,
+		UserId: user.Id, ListId: list.Id, Title: "t", Version: 3})
+	assert.Equal(t, nil, err)
+	found, _ := model.FindTodo(ctx, user.Id, todos[1].Id)
+	assert.Equal(t, restored, found)
+	assert.Equal(t, list.Id, found.ListId)
+}
+
+func testListMembers(t *testing.T, model Model) {
+	ctx := context.Background()
+	owner, _ := model.CreateUser(ctx, "U")
+	editor, _ := model.CreateUser(ctx, "V")
+	list, _ := model.CreateTodoList(ctx, owner.Id,
+		ActionToSync{Name: pointToString("shared")})
+	other, _ := model.CreateTodoList(ctx, editor.Id,
+		ActionToSync{Name: pointToString("other")})
+
+	found, err := model.FindTodoListById(ctx, list.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, list, found)
+	_, err = model.FindTodoListById(ctx, 99)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	// The creator is the owner
+	members, err := model.ListListMembers(ctx, list.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []ListMember{{ListId: list.Id, UserId: owner.Id,
+		UserUid: "U", Role: RoleOwner, Revision: list.Revision}}, members)
+	_, err = model.FindListMember(ctx, list.Id, editor.Id)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	assert.Equal(t, nil, model.SetListMember(ctx, ListMember{ListId: list.Id,
+		UserId: editor.Id, Role: RoleViewer}))
+	assert.Equal(t, nil, model.SetListMember(ctx, ListMember{ListId: list.Id,
+		UserId: editor.Id, Role: RoleEditor}))
+	member, err := model.FindListMember(ctx, list.Id, editor.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "V", member.UserUid)
+	assert.Equal(t, RoleEditor, member.Role)
+	// Every member's next sync fetches the list
+	found, _ = model.FindTodoListById(ctx, list.Id)
+	assert.Equal(t, member.Revision, found.Revision)
+	members, _ = model.ListListMembers(ctx, list.Id)
+	assert.Equal(t, []int{owner.Id, editor.Id},
+		[]int{members[0].UserId, members[1].UserId})
+	memberships, err := model.ListMemberships(ctx, editor.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []int{list.Id, other.Id},
+		[]int{memberships[0].ListId, memberships[1].ListId})
+	err = model.SetListMember(ctx, ListMember{ListId: 99, UserId: editor.Id,
+		Role: RoleViewer})
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	output, err := model.DeleteListMember(ctx, list.Id, editor.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, output)
+	output, _ = model.DeleteListMember(ctx, list.Id, editor.Id)
+	assert.Equal(t, 0, output)
+	changes, _ := model.ListChangesSince(ctx, editor.Id, other.Revision)
+	assert.Equal(t, []int{list.Id}, changes.DeletedListIds)
+	found, _ = model.FindTodoListById(ctx, list.Id)
+	assert.Equal(t, true, found.Revision > member.Revision)
+
+	// Rejoining takes back the tombstone, and deleting the list leaves one
+	// for every member
+	model.SetListMember(ctx, ListMember{ListId: list.Id, UserId: editor.Id,
+		Role: RoleViewer})
+	changes, _ = model.ListChangesSince(ctx, editor.Id, other.Revision)
+	assert.Equal(t, []int{}, changes.DeletedListIds)
+	output, err = model.DeleteTodoList(ctx, owner.Id, list.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, output)
+	for _, userId := range []int{owner.Id, editor.Id} {
+		changes, _ = model.ListChangesSince(ctx, userId, other.Revision)
+		assert.Equal(t, []int{list.Id}, changes.DeletedListIds)
+	}
+	members, _ = model.ListListMembers(ctx, list.Id)
+	assert.Equal(t, []ListMember{}, members)
+}
+
+func testListInvites(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	list, _ := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("shared")})
+
+	for _, code := range []string{"b", "a"} {
+		err := model.CreateListInvite(ctx, ListInvite{Code: code,
+			ListId: list.Id, Role: RoleViewer})
+		assert.Equal(t, nil, err)
+	}
+	err := model.CreateListInvite(ctx, ListInvite{Code: "a", ListId: list.Id,
+		Role: RoleEditor})
+	assert.Equal(t, true, errors.Is(err, ErrConflict))
+	err = model.CreateListInvite(ctx, ListInvite{Code: "c", ListId: 99,
+		Role: RoleEditor})
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	invites, err := model.ListListInvites(ctx, list.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []ListInvite{
+		{Code: "a", ListId: list.Id, Role: RoleViewer},
+		{Code: "b", ListId: list.Id, Role: RoleViewer},
+	}, invites)
+	found, _ := model.FindTodoListById(ctx, list.Id)
+	assert.Equal(t, true, found.Revision > list.Revision)
+
+	invite, err := model.TakeListInvite(ctx, "a")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ListInvite{Code: "a", ListId: list.Id, Role: RoleViewer},
+		invite)
+	_, err = model.TakeListInvite(ctx, "a")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	model.DeleteTodoList(ctx, user.Id, list.Id)
+	_, err = model.TakeListInvite(ctx, "b")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+}
+
+func testStreamTokens(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	device, _ := model.CreateDevice(ctx, "A", user.Id, "")
+	otherDevice, _ := model.CreateDevice(ctx, "B", user.Id, "")
+	issuedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, tokenHash := range []string{"a", "b"} {
+		err := model.CreateStreamToken(ctx, StreamToken{TokenHash: tokenHash,
+			DeviceId: device.Id, IssuedAt: issuedAt})
+		assert.Equal(t, nil, err)
+	}
+	err := model.CreateStreamToken(ctx, StreamToken{TokenHash: "b",
+		DeviceId: otherDevice.Id, IssuedAt: issuedAt})
+	assert.Equal(t, true, errors.Is(err, ErrConflict))
+
+	// Only the device's latest token is kept
+	_, err = model.TakeStreamToken(ctx, "a")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	token, err := model.TakeStreamToken(ctx, "b")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "b", token.TokenHash)
+	assert.Equal(t, device.Id, token.DeviceId)
+	assert.Equal(t, true, issuedAt.Equal(token.IssuedAt))
+	_, err = model.TakeStreamToken(ctx, "b")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+}
+
+func testListChangesInListSince(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	list, _ := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("shared")})
+	todos := []Todo{}
+	for _, listId := range []int{list.Id, 0, list.Id} {
+		todo, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+			Title:           pointToString("t"),
+			Completed:       pointToBool(true),
+			ListIdMaybeTemp: pointToInt(listId),
+		})
+		todos = append(todos, todo)
+	}
+
+	found, err := model.FindTodoById(ctx, todos[1].Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, todos[1], found)
+	_, err = model.FindTodoById(ctx, 99)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	changes, err := model.ListChangesInListSince(ctx, list.Id, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Changes{Todos: []Todo{todos[0], todos[2]},
+		DeletedTodoIds: []int{}, Lists: []TodoList{list},
+		DeletedListIds: []int{}, Revision: todos[2].Revision}, changes)
+
+	model.DeleteTodo(ctx, user.Id, todos[0].Id)
+	model.DeleteTodo(ctx, user.Id, todos[1].Id)
+	changes, _ = model.ListChangesInListSince(ctx, list.Id, todos[2].Revision)
+	assert.Equal(t, []Todo{}, changes.Todos)
+	assert.Equal(t, []int{todos[0].Id}, changes.DeletedTodoIds)
+	assert.Equal(t, []TodoList{}, changes.Lists)
+	model.DeleteCompletedTodos(ctx, user.Id, ActionToSync{})
+	changes, _ = model.ListChangesInListSince(ctx, list.Id, todos[2].Revision)
+	assert.Equal(t, []int{todos[0].Id, todos[2].Id}, changes.DeletedTodoIds)
+}
+
+func testRestoreTodo(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	first, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("first"),
+		Completed: pointToBool(false),
+	})
+	second, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("second"),
+		Completed: pointToBool(false),
+	})
+	model.DeleteTodo(ctx, user.Id, first.Id)
+	deletedRevision, _ := model.LatestRevision(ctx)
+
+	restore := Todo{Id: first.Id, UserId: user.Id, Title: "restored",
+		Completed: true, Version: 3}
+	_, err := model.RestoreTodo(ctx, Todo{Id: second.Id, UserId: user.Id,
+		Title: "not deleted", Version: 3})
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	otherUsers := restore
+	otherUsers.UserId = otherUser.Id
+	_, err = model.RestoreTodo(ctx, otherUsers)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	restored, err := model.RestoreTodo(ctx, restore)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, deletedRevision+1, restored.Revision)
+	restore.Revision = restored.Revision
+	// Restored todos are new again to clients that synced since the deletion
+	restore.CreatedRevision = restored.Revision
+	restore.TitleVersion = 3
+	restore.CompletedVersion = 3
+	// At the end, whatever position it had before
+	restore.Position = second.Position + TodoPositionGap
+	assert.Equal(t, restore, restored)
+	_, err = model.RestoreTodo(ctx, restore)
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	todos, _ := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, []Todo{second, restored}, todos)
+	changes, _ := model.ListChangesSince(ctx, user.Id, deletedRevision)
+	assert.Equal(t, Changes{Todos: []Todo{restored}, DeletedTodoIds: []int{},
+		Lists: []TodoList{}, DeletedListIds: []int{},
+		Revision: restored.Revision}, changes)
+}
+
+func testListChangesSince(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	first, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("first"),
+		Completed: pointToBool(false),
+	})
+	second, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("second"),
+		Completed: pointToBool(false),
+	})
+	model.UpdateTodo(ctx, user.Id,
+		ActionToSync{Completed: pointToBool(true)}, second.Id)
+	model.DeleteTodo(ctx, user.Id, first.Id)
+	other, _ := model.CreateTodo(ctx, otherUser.Id, ActionToSync{
+		Title:     pointToString("other"),
+		Completed: pointToBool(false),
+	})
+
+	changes, err := model.ListChangesSince(ctx, user.Id, 1)
+	assert.Equal(t, nil, err)
+	second, _ = model.FindTodo(ctx, user.Id, second.Id)
+	assert.Equal(t, Changes{Todos: []Todo{second},
+		DeletedTodoIds: []int{first.Id}, Lists: []TodoList{},
+		DeletedListIds: []int{}, Revision: 5}, changes)
+
+	changes, err = model.ListChangesSince(ctx, user.Id, 5)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Changes{Todos: []Todo{}, DeletedTodoIds: []int{},
+		Lists: []TodoList{}, DeletedListIds: []int{}, Revision: 5}, changes)
+
+	changes, err = model.ListChangesSince(ctx, otherUser.Id, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Changes{Todos: []Todo{other}, DeletedTodoIds: []int{},
+		Lists: []TodoList{}, DeletedListIds: []int{}, Revision: 5}, changes)
+}
+
+func testReplaceTodos(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	for _, title := range []string{"first", "second", "third"} {
+		model.CreateTodo(ctx, user.Id, ActionToSync{
+			Title:     pointToString(title),
+			Completed: pointToBool(false),
+		})
+	}
+
+	err := model.ReplaceTodos(ctx, []Todo{{Id: 2, UserId: 1, Title: "second",
+		Completed: true, Version: 3, TitleVersion: 1, CompletedVersion: 3,
+		ClientUpdatedAt: 5}}, []DeletedTodo{{Id: 7, UserId: 1}})
+	assert.Equal(t, nil, err)
+
+	// Everything gets the same new revision
+	changes, err := model.ListChangesSince(ctx, user.Id, 3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Changes{Todos: []Todo{{Id: 2, UserId: 1, Title: "second",
+		Completed: true, Revision: 4, CreatedRevision: 4, Version: 3,
+		TitleVersion: 1, CompletedVersion: 3, ClientUpdatedAt: 5}},
+		DeletedTodoIds: []int{7}, Lists: []TodoList{}, DeletedListIds: []int{},
+		Revision: 4}, changes)
+
+	todo, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("after"),
+		Completed: pointToBool(false),
+	})
+	assert.Equal(t, 8, todo.Id)
+}
+
+func testActionEvents(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	device, _ := model.CreateDevice(ctx, "A", user.Id, "")
+	serverTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	event := ActionEvent{
+		UserId:   user.Id,
+		DeviceId: device.Id,
+		TodoId:   1,
+		Action: ActionToSync{Id: 3, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1,
+			Title: pointToString("t"), Completed: pointToBool(false)},
+		ServerTime: serverTime,
+		Output:     1,
+	}
+	created, err := model.CreateActionEvent(ctx, event)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, created.Id)
+	_, err = model.CreateActionEvent(ctx, event)
+	assert.Equal(t, true, errors.Is(err, ErrConflict))
+	event.Action.Id = 4
+	created, err = model.CreateActionEvent(ctx, event)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, created.Id)
+
+	events, err := model.ListActionEvents(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(events))
+	for i, found := range events {
+		// Databases may return another time zone
+		assert.Equal(t, true, found.ServerTime.Equal(serverTime))
+		found.ServerTime = serverTime
+		event.Id = i + 1
+		event.Action.Id = i + 3
+		assert.Equal(t, event, found)
+	}
+}
+
+func testTodoChanges(t *testing.T, model Model) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	otherUser, _ := model.CreateUser(ctx, "V")
+	device, _ := model.CreateDevice(ctx, "A", user.Id, "")
+	otherDevice, _ := model.CreateDevice(ctx, "B", otherUser.Id, "")
+	serverTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	expected := []TodoChange{
+		{UserId: user.Id, TodoId: 1, DeviceId: device.Id, ActionToSyncId: 1,
+			Type: "TODOS/ADD_TODO", Title: pointToString("t"),
+			Completed: pointToBool(false), ServerTime: serverTime},
+		{UserId: user.Id, TodoId: 1, DeviceId: device.Id, ActionToSyncId: 2,
+			Type: "TODO/UPDATE_TODO", Completed: pointToBool(true),
+			ServerTime: serverTime},
+		{UserId: user.Id, TodoId: 1, DeviceId: device.Id, ActionToSyncId: 3,
+			Type: "TODOS/CLEAR_COMPLETED", ServerTime: serverTime},
+	}
+	for i, change := range expected {
+		created, err := model.CreateTodoChange(ctx, change)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, i+1, created.Id)
+		expected[i].Id = created.Id
+	}
+	// Another todo's from the same action, and the same todo id under another
+	// user
+	otherTodos, _ := model.CreateTodoChange(ctx, TodoChange{UserId: user.Id,
+		TodoId: 2, DeviceId: device.Id, ActionToSyncId: 3,
+		Type: "TODOS/CLEAR_COMPLETED", ServerTime: serverTime})
+	model.CreateTodoChange(ctx, TodoChange{UserId: otherUser.Id, TodoId: 1,
+		DeviceId: otherDevice.Id, ActionToSyncId: 1, Type: "TODOS/DELETE_TODO",
+		ServerTime: serverTime})
+
+	byAction, err := model.ListTodoChangesByAction(ctx, device.Id, 3)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(byAction))
+	for i, found := range byAction {
+		assert.Equal(t, true, found.ServerTime.Equal(serverTime))
+		found.ServerTime = serverTime
+		assert.Equal(t, []TodoChange{expected[2], otherTodos}[i], found)
+	}
+	byAction, err = model.ListTodoChangesByAction(ctx, otherDevice.Id, 2)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []TodoChange{}, byAction)
+
+	changes, err := model.ListTodoChanges(ctx, user.Id, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(expected), len(changes))
+	for i, found := range changes {
+		// Databases may return another time zone
+		assert.Equal(t, true, found.ServerTime.Equal(serverTime))
+		found.ServerTime = serverTime
+		assert.Equal(t, expected[i], found)
+	}
+	changes, err = model.ListTodoChanges(ctx, user.Id, 99)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []TodoChange{}, changes)
+}
+
+func testWithTx(t *testing.T, model Model) {
+	ctx := context.Background()
+	err := model.WithTx(ctx, func(tx Model) error {
+		if _, err := tx.CreateUser(ctx, "U"); err != nil {
+			return err
+		}
+		return errors.New("Fail after creating user")
+	})
+	assert.EqualError(t, err, "Fail after creating user")
+	_, err = model.FindUserByUid(ctx, "U")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	err = model.WithTx(ctx, func(tx Model) error {
+		if _, err := tx.CreateUser(ctx, "U"); err != nil {
+			return err
+		}
+		// A nested WithTx is part of the same transaction
+		return tx.WithTx(ctx, func(nestedTx Model) error {
+			_, err := nestedTx.CreateUser(ctx, "V")
+			return err
+		})
+	})
+	assert.Equal(t, nil, err)
+	_, err = model.FindUserByUid(ctx, "U")
+	assert.Equal(t, nil, err)
+	_, err = model.FindUserByUid(ctx, "V")
+	assert.Equal(t, nil, err)
+
+	err = model.WithTx(ctx, func(tx Model) error {
+		tx.WithTx(ctx, func(nestedTx Model) error {
+			_, err := nestedTx.CreateUser(ctx, "W")
+			return err
+		})
+		return errors.New("Fail after nested WithTx")
+	})
+	assert.EqualError(t, err, "Fail after nested WithTx")
+	_, err = model.FindUserByUid(ctx, "W")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+}
+
+func testReset(t *testing.T, model Model) {
+	ctx := context.Background()
+	record, err := model.CreateResetRecord(ctx, "admin", time.Now())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, record.Id)
+	assert.Equal(t, "admin", record.AdminName)
+
+	user, _ := model.CreateUser(ctx, "U")
+	device, _ := model.CreateDevice(ctx, "A", user.Id, "hash")
+	model.CreateStreamToken(ctx, StreamToken{TokenHash: "s",
+		DeviceId: device.Id, IssuedAt: time.Now()})
+	todo, _ := model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("t"),
+		Completed: pointToBool(false),
+	})
+	model.DeleteTodo(ctx, user.Id, todo.Id)
+	model.CreateActionEvent(ctx, ActionEvent{UserId: user.Id, DeviceId: 1,
+		Action: ActionToSync{Id: 1}, ServerTime: time.Now()})
+	model.CreateTodoChange(ctx, TodoChange{UserId: user.Id, TodoId: todo.Id,
+		DeviceId: 1, ActionToSyncId: 1, Type: "TODOS/DELETE_TODO",
+		ServerTime: time.Now()})
+	list, _ := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("l")})
+	kept, _ := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("m")})
+	model.DeleteTodoList(ctx, user.Id, list.Id)
+	otherUser, _ := model.CreateUser(ctx, "W")
+	model.SetListMember(ctx, ListMember{ListId: kept.Id, UserId: otherUser.Id,
+		Role: RoleViewer})
+	model.CreateListInvite(ctx, ListInvite{Code: "c", ListId: kept.Id,
+		Role: RoleEditor})
+	assert.Equal(t, nil, model.Reset(ctx))
+
+	_, err = model.FindUserByUid(ctx, "U")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	_, err = model.FindDeviceByUid(ctx, "A")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	revision, _ := model.LatestRevision(ctx)
+	assert.Equal(t, 0, revision)
+	changes, _ := model.ListChangesSince(ctx, user.Id, 0)
+	assert.Equal(t, Changes{Todos: []Todo{}, DeletedTodoIds: []int{},
+		Lists: []TodoList{}, DeletedListIds: []int{}}, changes)
+	events, _ := model.ListActionEvents(ctx)
+	assert.Equal(t, []ActionEvent{}, events)
+	todoChanges, _ := model.ListTodoChanges(ctx, user.Id, todo.Id)
+	assert.Equal(t, []TodoChange{}, todoChanges)
+	lists, _ := model.ListTodoLists(ctx, user.Id)
+	assert.Equal(t, []TodoList{}, lists)
+	members, _ := model.ListMemberships(ctx, otherUser.Id)
+	assert.Equal(t, []ListMember{}, members)
+	_, err = model.TakeListInvite(ctx, "c")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+	_, err = model.TakeStreamToken(ctx, "s")
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+
+	// Ids and revisions start over, but ResetRecords are kept
+	user, _ = model.CreateUser(ctx, "V")
+	assert.Equal(t, 1, user.Id)
+	device, _ = model.CreateDevice(ctx, "B", user.Id, "")
+	assert.Equal(t, 1, device.Id)
+	todo, _ = model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("t"),
+		Completed: pointToBool(false),
+	})
+	assert.Equal(t, 1, todo.Id)
+	assert.Equal(t, 1, todo.Revision)
+	list, _ = model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("l")})
+	assert.Equal(t, 1, list.Id)
+	record, _ = model.CreateResetRecord(ctx, "admin", time.Now())
+	assert.Equal(t, 2, record.Id)
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestKindOfDbError(t *testing.T) {
+	assert.Equal(t, ErrNotFound, kindOfDbError(sql.ErrNoRows))
+	assert.Equal(t, ErrConflict, kindOfDbError(&pq.Error{Code: "23505"}))
+	assert.Equal(t, ErrUnavailable, kindOfDbError(&pq.Error{Code: "57P01"}))
+	assert.Equal(t, ErrUnavailable, kindOfDbError(driver.ErrBadConn))
+	assert.Equal(t, nil, kindOfDbError(&pq.Error{Code: "42601"}))
+}
+
+func TestWrapDbError(t *testing.T) {
+	err := wrapDbError(&pq.Error{Code: "08006", Message: "gone"},
+		"Error from db.Exec with sql=%s", "SELECT 1")
+	assert.Equal(t, true, errors.Is(err, ErrUnavailable))
+	assert.Equal(t,
+		"Storage unavailable: Error from db.Exec with sql=SELECT 1: pq: gone",
+		err.Error())
+}
+
+func TestListenForChanges(t *testing.T) {
+	creds := testPostgresCredentials(t)
+	db, err := ConnectPostgres(creds)
+	if err != nil {
+		t.Fatalf("Error from ConnectPostgres: %s", err)
+	}
+	defer db.Close()
+	payloads := make(chan string, 10)
+	listener, err := ListenForChanges(creds, func(payload string) {
+		payloads <- payload
+	})
+	if err != nil {
+		t.Fatalf("Error from ListenForChanges: %s", err)
+	}
+	defer listener.Close()
+
+	// Only sent once the transaction commits
+	model := NewDbModel(db)
+	ctx := context.Background()
+	err = model.WithTx(ctx, func(tx Model) error {
+		if err := tx.(*DbModel).NotifyChange(ctx, "first"); err != nil {
+			return err
+		}
+		return errors.New("roll back")
+	})
+	assert.Equal(t, "roll back", err.Error())
+	assert.Equal(t, nil, model.WithTx(ctx, func(tx Model) error {
+		return tx.(*DbModel).NotifyChange(ctx, "second")
+	}))
+	select {
+	case payload := <-payloads:
+		assert.Equal(t, "second", payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No notification")
+	}
+}
+
+func TestReadsDontWaitForWrites(t *testing.T) {
+	creds := testPostgresCredentials(t)
+	db, err := ConnectPostgres(creds)
+	if err != nil {
+		t.Fatalf("Error from ConnectPostgres: %s", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := MigrateUp(ctx, db, PostgresDialect); err != nil {
+		t.Fatalf("Error from MigrateUp: %s", err)
+	}
+	model := NewDbModel(db)
+
+	locked, release := make(chan struct{}), make(chan struct{})
+	written := make(chan error, 1)
+	go func() {
+		written <- model.WithTx(ctx, func(tx Model) error {
+			if err := tx.LockForWrite(ctx); err != nil {
+				return err
+			}
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	select {
+	case <-locked:
+	case err := <-written:
+		t.Fatalf("Error from WithTx: %s", err)
+	}
+
+	readCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	assert.Equal(t, nil, model.WithTx(readCtx, func(tx Model) error {
+		_, err := tx.LatestRevision(readCtx)
+		return err
+	}))
+	close(release)
+	assert.Equal(t, nil, <-written)
+}
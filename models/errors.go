@@ -0,0 +1,21 @@
+package models
+
+import (
+	"errors"
+)
+
+// Every Model method returns errors that wrap one of these sentinels (checked
+// with errors.Is) when the cause is known, so callers can react to the kind of
+// failure without parsing messages.
+var (
+	// ErrNotFound means the row the caller asked about doesn't exist
+	ErrNotFound = errors.New("Not found")
+
+	// ErrConflict means the change collides with existing data, e.g. a
+	// duplicate key
+	ErrConflict = errors.New("Conflict")
+
+	// ErrUnavailable means the storage couldn't be reached or gave up;
+	// retrying the same request later may succeed
+	ErrUnavailable = errors.New("Storage unavailable")
+)
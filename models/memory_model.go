@@ -1,95 +1,1223 @@
 package models
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryModel is safe for concurrent use: each method call, and each WithTx
+// as a whole, has the model to itself.
 type MemoryModel struct {
+	mutex sync.Mutex
+	// inTx is true for the copy of the model passed to WithTx's fn
+	inTx bool
+	// persistence is nil unless the model was opened with
+	// OpenPersistentMemoryModel
+	persistence *memoryPersistence
+	// pendingMutations are written to the WAL if the transaction commits
+	pendingMutations []json.RawMessage
+
+	Users        []User
+	NextUserId   int
 	Devices      []Device
 	NextDeviceId int
 	Todos        []Todo
 	NextTodoId   int
+	DeletedTodos []DeletedTodo
+	Revision     int // of the latest change
+	ResetRecords []ResetRecord
+
+	TodoLists        []TodoList
+	NextTodoListId   int
+	DeletedTodoLists []DeletedTodoList
+	ListMembers      []ListMember
+	ListInvites      []ListInvite
+	StreamTokens     []StreamToken
+
+	ActionEvents      []ActionEvent
+	NextActionEventId int
+	TodoChanges       []TodoChange
+	NextTodoChangeId  int
 }
 
 func NewMemoryModel() *MemoryModel {
-	model := MemoryModel{}
-	model.Reset()
+	model := MemoryModel{ResetRecords: []ResetRecord{}}
+	model.Reset(context.Background())
 	return &model
 }
 
-func (model *MemoryModel) Reset() {
+// WithTx runs fn against a copy of the model, then replaces the model's
+// contents with the copy's only if fn succeeds.  Transactions take turns, so
+// fn must only use tx; calling the original model would deadlock.
+func (model *MemoryModel) WithTx(ctx context.Context,
+	fn func(tx Model) error) error {
+	if model.inTx {
+		return fn(model)
+	}
+
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+
+	txModel := model.clone()
+	txModel.inTx = true
+	txModel.persistence = model.persistence
+	if err := fn(txModel); err != nil {
+		return err
+	}
+
+	// Like a database, don't commit if the caller gave up in the meantime
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if model.persistence != nil && len(txModel.pendingMutations) > 0 {
+		if err := model.persistence.appendToWal(
+			txModel.pendingMutations); err != nil {
+			return err
+		}
+	}
+	model.copyContentsFrom(txModel)
+	return nil
+}
+
+// Copies the slices so changes to the copy don't show up in model.  Each
+// Device's ActionToSyncIdToOutput is shared, since it's replaced rather than
+// modified in place.  So are ActionEvents and TodoChanges, which would cost
+// more to copy with every transaction as they grow: they're only appended
+// to, so the copy's appends land past the lengths that model keeps, and
+// rolling back leaves them out.
+func (model *MemoryModel) clone() *MemoryModel {
+	modelCopy := &MemoryModel{}
+	modelCopy.copyContentsFrom(model)
+	modelCopy.Users = make([]User, len(model.Users))
+	copy(modelCopy.Users, model.Users)
+	modelCopy.Devices = make([]Device, len(model.Devices))
+	copy(modelCopy.Devices, model.Devices)
+	modelCopy.Todos = make([]Todo, len(model.Todos))
+	copy(modelCopy.Todos, model.Todos)
+	modelCopy.DeletedTodos = make([]DeletedTodo, len(model.DeletedTodos))
+	copy(modelCopy.DeletedTodos, model.DeletedTodos)
+	modelCopy.ResetRecords = make([]ResetRecord, len(model.ResetRecords))
+	copy(modelCopy.ResetRecords, model.ResetRecords)
+	modelCopy.TodoLists = make([]TodoList, len(model.TodoLists))
+	copy(modelCopy.TodoLists, model.TodoLists)
+	modelCopy.DeletedTodoLists = make([]DeletedTodoList,
+		len(model.DeletedTodoLists))
+	copy(modelCopy.DeletedTodoLists, model.DeletedTodoLists)
+	modelCopy.ListMembers = make([]ListMember, len(model.ListMembers))
+	copy(modelCopy.ListMembers, model.ListMembers)
+	modelCopy.ListInvites = make([]ListInvite, len(model.ListInvites))
+	copy(modelCopy.ListInvites, model.ListInvites)
+	modelCopy.StreamTokens = make([]StreamToken, len(model.StreamTokens))
+	copy(modelCopy.StreamTokens, model.StreamTokens)
+	return modelCopy
+}
+
+// Shallow-copies every exported field
+func (model *MemoryModel) copyContentsFrom(other *MemoryModel) {
+	model.Users = other.Users
+	model.NextUserId = other.NextUserId
+	model.Devices = other.Devices
+	model.NextDeviceId = other.NextDeviceId
+	model.Todos = other.Todos
+	model.NextTodoId = other.NextTodoId
+	model.DeletedTodos = other.DeletedTodos
+	model.Revision = other.Revision
+	model.ResetRecords = other.ResetRecords
+	model.TodoLists = other.TodoLists
+	model.NextTodoListId = other.NextTodoListId
+	model.DeletedTodoLists = other.DeletedTodoLists
+	model.ListMembers = other.ListMembers
+	model.ListInvites = other.ListInvites
+	model.StreamTokens = other.StreamTokens
+	model.ActionEvents = other.ActionEvents
+	model.NextActionEventId = other.NextActionEventId
+	model.TodoChanges = other.TodoChanges
+	model.NextTodoChangeId = other.NextTodoChangeId
+}
+
+// LockForWrite does nothing, since WithTx holds the mutex throughout anyway
+func (model *MemoryModel) LockForWrite(ctx context.Context) error {
+	return nil
+}
+
+func (model *MemoryModel) Reset(ctx context.Context) error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "Reset"}); err != nil {
+		return err
+	}
+	model.Users = []User{}
+	model.NextUserId = 1
 	model.Devices = []Device{}
 	model.NextDeviceId = 1
 	model.Todos = []Todo{}
 	model.NextTodoId = 1
+	model.DeletedTodos = []DeletedTodo{}
+	model.Revision = 0
+	model.TodoLists = []TodoList{}
+	model.NextTodoListId = 1
+	model.DeletedTodoLists = []DeletedTodoList{}
+	model.ListMembers = []ListMember{}
+	model.ListInvites = []ListInvite{}
+	model.StreamTokens = []StreamToken{}
+	model.ActionEvents = []ActionEvent{}
+	model.NextActionEventId = 1
+	model.TodoChanges = []TodoChange{}
+	model.NextTodoChangeId = 1
+	return nil
 }
 
-func (model *MemoryModel) FindOrCreateDeviceByUid(uid string) Device {
-	for _, device := range model.Devices {
-		if device.Uid == uid {
-			return device
+func (model *MemoryModel) CreateResetRecord(ctx context.Context,
+	adminName string, resetAt time.Time) (ResetRecord, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "CreateResetRecord",
+		AdminName: adminName, ResetAt: &resetAt}); err != nil {
+		return ResetRecord{}, err
+	}
+	record := ResetRecord{
+		Id:        len(model.ResetRecords) + 1,
+		AdminName: adminName,
+		ResetAt:   resetAt,
+	}
+	model.ResetRecords = append(model.ResetRecords, record)
+	return record, nil
+}
+
+func (model *MemoryModel) FindUserByUid(ctx context.Context,
+	uid string) (User, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if user, found := model.findUser(uid); found {
+		return user, nil
+	}
+	return User{}, fmt.Errorf("%w: No user with uid=%s", ErrNotFound, uid)
+}
+
+func (model *MemoryModel) findUser(uid string) (User, bool) {
+	for _, user := range model.Users {
+		if user.Uid == uid {
+			return user, true
 		}
 	}
+	return User{}, false
+}
+
+func (model *MemoryModel) CreateUser(ctx context.Context,
+	uid string) (User, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if _, found := model.findUser(uid); found {
+		return User{}, fmt.Errorf("%w: User uid=%s already exists", ErrConflict, uid)
+	}
+	if err := model.log(memoryMutation{Method: "CreateUser",
+		Uid: uid}); err != nil {
+		return User{}, err
+	}
+
+	newUser := User{Id: model.NextUserId, Uid: uid}
+	model.Users = append(model.Users, newUser)
+	model.NextUserId += 1
+	return newUser, nil
+}
+
+func (model *MemoryModel) CreateDevice(ctx context.Context, uid string,
+	userId int, tokenHash string) (Device, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if _, found := model.findDevice(func(device Device) bool {
+		return device.Uid == uid
+	}); found {
+		return Device{},
+			fmt.Errorf("%w: Device uid=%s already exists", ErrConflict, uid)
+	}
+	if model.isTokenHashTaken(tokenHash, 0) {
+		return Device{}, fmt.Errorf("%w: Another device has that token", ErrConflict)
+	}
+	if err := model.log(memoryMutation{Method: "CreateDevice", Uid: uid,
+		UserId: userId, TokenHash: tokenHash}); err != nil {
+		return Device{}, err
+	}
 
 	newDevice := Device{
-		Id:  model.NextDeviceId,
-		Uid: uid,
+		Id:                     model.NextDeviceId,
+		Uid:                    uid,
+		UserId:                 userId,
+		TokenHash:              tokenHash,
 		ActionToSyncIdToOutput: map[int]int{},
 	}
 	model.Devices = append(model.Devices, newDevice)
 	model.NextDeviceId += 1
-	return newDevice
+	newDevice.ActionToSyncIdToOutput = map[int]int{}
+	return newDevice, nil
 }
 
-func (model *MemoryModel) CreateTodo(action ActionToSync) Todo {
+func (model *MemoryModel) FindDeviceByUid(ctx context.Context,
+	uid string) (Device, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if device, found := model.findDevice(func(device Device) bool {
+		return device.Uid == uid
+	}); found {
+		return device, nil
+	}
+	return Device{}, fmt.Errorf("%w: No device with uid=%s", ErrNotFound, uid)
+}
+
+func (model *MemoryModel) FindDeviceByTokenHash(ctx context.Context,
+	tokenHash string) (Device, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if device, found := model.findDevice(func(device Device) bool {
+		return tokenHash != "" && device.TokenHash == tokenHash
+	}); found {
+		return device, nil
+	}
+	return Device{}, fmt.Errorf("%w: No device with that token", ErrNotFound)
+}
+
+// findDevice returns the first device matching, with its own copy of
+// ActionToSyncIdToOutput so the caller can change it freely
+func (model *MemoryModel) findDevice(matches func(Device) bool) (Device, bool) {
+	for _, device := range model.Devices {
+		if matches(device) {
+			device.ActionToSyncIdToOutput =
+				copyMapIntInt(device.ActionToSyncIdToOutput)
+			return device, true
+		}
+	}
+	return Device{}, false
+}
+
+func copyMapIntInt(input map[int]int) map[int]int {
+	output := map[int]int{}
+	for k, v := range input {
+		output[k] = v
+	}
+	return output
+}
+
+func (model *MemoryModel) UpdateDeviceTokenHash(ctx context.Context,
+	deviceId int, tokenHash string) error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if model.isTokenHashTaken(tokenHash, deviceId) {
+		return fmt.Errorf("%w: Another device has that token", ErrConflict)
+	}
+	index := model.indexOfDevice(deviceId)
+	if index == -1 {
+		return fmt.Errorf("%w: No device with id=%d", ErrNotFound, deviceId)
+	}
+	if err := model.log(memoryMutation{Method: "UpdateDeviceTokenHash",
+		DeviceId: deviceId, TokenHash: tokenHash}); err != nil {
+		return err
+	}
+	model.Devices[index].TokenHash = tokenHash
+	return nil
+}
+
+// indexOfDevice returns the index in Devices of the device, or -1
+func (model *MemoryModel) indexOfDevice(deviceId int) int {
+	for i, device := range model.Devices {
+		if device.Id == deviceId {
+			return i
+		}
+	}
+	return -1
+}
+
+// isTokenHashTaken returns true if a device other than exceptDeviceId has
+// tokenHash.  Blank hashes are never taken, like NULLs in a unique index.
+func (model *MemoryModel) isTokenHashTaken(tokenHash string,
+	exceptDeviceId int) bool {
+	if tokenHash == "" {
+		return false
+	}
+	_, found := model.findDevice(func(device Device) bool {
+		return device.TokenHash == tokenHash && device.Id != exceptDeviceId
+	})
+	return found
+}
+
+func (model *MemoryModel) CreateTodo(ctx context.Context, userId int,
+	action ActionToSync) (Todo, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "CreateTodo", UserId: userId,
+		Action: &action}); err != nil {
+		return Todo{}, err
+	}
 	newTodo := Todo{
-		Id:        model.NextTodoId,
-		Title:     *action.Title,
-		Completed: *action.Completed,
+		Id:               model.NextTodoId,
+		UserId:           userId,
+		ListId:           listIdOf(action),
+		Title:            *action.Title,
+		Completed:        *action.Completed,
+		Position:         model.lastPosition(userId) + TodoPositionGap,
+		Revision:         model.nextRevision(),
+		Version:          1,
+		TitleVersion:     1,
+		CompletedVersion: 1,
+	}
+	newTodo.CreatedRevision = newTodo.Revision
+	if action.ClientTimestamp != nil {
+		newTodo.ClientUpdatedAt = *action.ClientTimestamp
 	}
 	model.Todos = append(model.Todos, newTodo)
 	model.NextTodoId += 1
-	return newTodo
+	return newTodo, nil
 }
 
 func (model *MemoryModel) UpdateDeviceActionToSyncIdToOutputJson(
-	updatedDevice Device) {
-	for i, device := range model.Devices {
-		if device.Uid == updatedDevice.Uid {
-			device.ActionToSyncIdToOutput = updatedDevice.ActionToSyncIdToOutput
-			model.Devices[i] = device
-		}
+	ctx context.Context, updatedDevice Device) error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	index := model.indexOfDevice(updatedDevice.Id)
+	if index == -1 {
+		return fmt.Errorf("%w: No device with id=%d", ErrNotFound,
+			updatedDevice.Id)
+	}
+	if err := model.log(memoryMutation{
+		Method: "UpdateDeviceActionToSyncIdToOutputJson",
+		Device: &updatedDevice}); err != nil {
+		return err
 	}
+	model.Devices[index].ActionToSyncIdToOutput =
+		copyMapIntInt(updatedDevice.ActionToSyncIdToOutput)
+	return nil
 }
 
-func (model *MemoryModel) UpdateTodo(action ActionToSync, todoId int) int {
+func (model *MemoryModel) UpdateTodo(ctx context.Context, userId int,
+	action ActionToSync, todoId int) (int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "UpdateTodo", UserId: userId,
+		Action: &action, TodoId: todoId}); err != nil {
+		return 0, err
+	}
+	if action.Completed == nil && action.Title == nil &&
+		action.ClientTimestamp == nil {
+		return 0, nil
+	}
 	for i, todo := range model.Todos {
-		if todo.Id == todoId {
+		if todo.Id == todoId && todo.UserId == userId {
+			todo.Version += 1
 			if action.Completed != nil {
 				todo.Completed = *action.Completed
+				todo.CompletedVersion = todo.Version
 			}
 			if action.Title != nil {
 				todo.Title = *action.Title
+				todo.TitleVersion = todo.Version
+			}
+			if action.ClientTimestamp != nil {
+				todo.ClientUpdatedAt = *action.ClientTimestamp
 			}
+			todo.Revision = model.nextRevision()
 			model.Todos[i] = todo
-			return 1
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (model *MemoryModel) FindTodoById(ctx context.Context,
+	todoId int) (Todo, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	for _, todo := range model.Todos {
+		if todo.Id == todoId {
+			return todo, nil
+		}
+	}
+	return Todo{}, fmt.Errorf("%w: No todo with id=%d", ErrNotFound, todoId)
+}
+
+func (model *MemoryModel) FindTodo(ctx context.Context, userId int,
+	todoId int) (Todo, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	for _, todo := range model.Todos {
+		if todo.Id == todoId && todo.UserId == userId {
+			return todo, nil
+		}
+	}
+	return Todo{}, fmt.Errorf("%w: No todo with id=%d", ErrNotFound, todoId)
+}
+
+func (model *MemoryModel) ListTodos(ctx context.Context,
+	userId int) ([]Todo, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	return model.listTodos(userId), nil
+}
+
+// listTodos returns the user's todos ordered by Position, then Id
+func (model *MemoryModel) listTodos(userId int) []Todo {
+	todos := []Todo{}
+	for _, todo := range model.Todos {
+		if todo.UserId == userId {
+			todos = append(todos, todo)
 		}
 	}
-	return 0
+	// Todos is ordered by Id, so a stable sort breaks ties by Id
+	sort.SliceStable(todos, func(i, j int) bool {
+		return todos[i].Position < todos[j].Position
+	})
+	return todos
 }
 
-func (model *MemoryModel) ListTodos() []Todo {
-	todosCopy := make([]Todo, len(model.Todos))
-	copy(todosCopy, model.Todos)
-	return todosCopy
+// lastPosition returns the highest Position of the user's todos, or 0 if
+// there are none
+func (model *MemoryModel) lastPosition(userId int) int {
+	todos := model.listTodos(userId)
+	if len(todos) == 0 {
+		return 0
+	}
+	return todos[len(todos)-1].Position
 }
 
-func (model *MemoryModel) DeleteTodo(todoId int) int {
+func (model *MemoryModel) MoveTodo(ctx context.Context, userId int,
+	todoId int, position int) (int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "MoveTodo", UserId: userId,
+		TodoId: todoId, Position: position}); err != nil {
+		return 0, err
+	}
+	for i, todo := range model.Todos {
+		if todo.Id == todoId && todo.UserId == userId {
+			model.Todos[i].Position = position
+			model.Todos[i].Revision = model.nextRevision()
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (model *MemoryModel) RenumberTodos(ctx context.Context,
+	userId int) error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "RenumberTodos",
+		UserId: userId}); err != nil {
+		return err
+	}
+	idToPosition := map[int]int{}
+	for i, todo := range model.listTodos(userId) {
+		idToPosition[todo.Id] = (i + 1) * TodoPositionGap
+	}
+	revision := model.nextRevision()
+	for i, todo := range model.Todos {
+		if position, ok := idToPosition[todo.Id]; ok {
+			model.Todos[i].Position = position
+			model.Todos[i].Revision = revision
+		}
+	}
+	return nil
+}
+
+func (model *MemoryModel) DeleteTodo(ctx context.Context, userId int,
+	todoId int) (int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "DeleteTodo", UserId: userId,
+		TodoId: todoId}); err != nil {
+		return 0, err
+	}
 	numRowsDeleted := 0
 	newTodos := []Todo{}
 	for _, todo := range model.Todos {
-		if todo.Id == todoId {
+		if todo.Id == todoId && todo.UserId == userId {
 			numRowsDeleted += 1
+			model.DeletedTodos = append(model.DeletedTodos, DeletedTodo{
+				Id:       todoId,
+				UserId:   userId,
+				ListId:   todo.ListId,
+				Revision: model.nextRevision(),
+			})
 		} else {
 			newTodos = append(newTodos, todo)
 		}
 	}
 	model.Todos = newTodos
-	return numRowsDeleted
+	return numRowsDeleted, nil
+}
+
+func (model *MemoryModel) SetAllTodosCompleted(ctx context.Context,
+	userId int, action ActionToSync) ([]int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "SetAllTodosCompleted",
+		UserId: userId, Action: &action}); err != nil {
+		return nil, err
+	}
+
+	todoIds := []int{}
+	revision := 0
+	for i, todo := range model.Todos {
+		if todo.UserId == userId && isInList(todo, action) &&
+			todo.Completed != *action.Completed {
+			if revision == 0 {
+				revision = model.nextRevision()
+			}
+			todo.Version += 1
+			todo.Completed = *action.Completed
+			todo.CompletedVersion = todo.Version
+			if action.ClientTimestamp != nil {
+				todo.ClientUpdatedAt = *action.ClientTimestamp
+			}
+			todo.Revision = revision
+			model.Todos[i] = todo
+			todoIds = append(todoIds, todo.Id)
+		}
+	}
+	return todoIds, nil
+}
+
+func (model *MemoryModel) DeleteCompletedTodos(ctx context.Context,
+	userId int, action ActionToSync) ([]int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "DeleteCompletedTodos",
+		UserId: userId, Action: &action}); err != nil {
+		return nil, err
+	}
+
+	todoIds := []int{}
+	revision := 0
+	newTodos := []Todo{}
+	for _, todo := range model.Todos {
+		if todo.UserId == userId && isInList(todo, action) && todo.Completed {
+			if revision == 0 {
+				revision = model.nextRevision()
+			}
+			model.DeletedTodos = append(model.DeletedTodos, DeletedTodo{
+				Id:       todo.Id,
+				UserId:   userId,
+				ListId:   todo.ListId,
+				Revision: revision,
+			})
+			todoIds = append(todoIds, todo.Id)
+		} else {
+			newTodos = append(newTodos, todo)
+		}
+	}
+	model.Todos = newTodos
+	return todoIds, nil
+}
+
+// listIdOf returns the list action adds a todo to, or 0 for none
+func listIdOf(action ActionToSync) int {
+	if action.ListIdMaybeTemp == nil {
+		return 0
+	}
+	return *action.ListIdMaybeTemp
+}
+
+// isInList returns whether the todo is in the list that action limits a bulk
+// change to, if any
+func isInList(todo Todo, action ActionToSync) bool {
+	return action.ListIdMaybeTemp == nil ||
+		todo.ListId == *action.ListIdMaybeTemp
+}
+
+func (model *MemoryModel) RestoreTodo(ctx context.Context,
+	todo Todo) (Todo, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	newDeletedTodos := []DeletedTodo{}
+	for _, deletedTodo := range model.DeletedTodos {
+		if deletedTodo.Id != todo.Id || deletedTodo.UserId != todo.UserId {
+			newDeletedTodos = append(newDeletedTodos, deletedTodo)
+		}
+	}
+	if len(newDeletedTodos) == len(model.DeletedTodos) {
+		return Todo{}, fmt.Errorf("%w: No deleted todo with id=%d", ErrNotFound,
+			todo.Id)
+	}
+	walTodo := walTodo(todo)
+	if err := model.log(memoryMutation{Method: "RestoreTodo",
+		Todo: &walTodo}); err != nil {
+		return Todo{}, err
+	}
+	model.DeletedTodos = newDeletedTodos
+
+	todo.TitleVersion = todo.Version
+	todo.CompletedVersion = todo.Version
+	todo.Position = model.lastPosition(todo.UserId) + TodoPositionGap
+	todo.Revision = model.nextRevision()
+	todo.CreatedRevision = todo.Revision
+	model.Todos = append(model.Todos, todo)
+	// Keep them ordered by Id for ListTodos
+	sort.Slice(model.Todos, func(i, j int) bool {
+		return model.Todos[i].Id < model.Todos[j].Id
+	})
+	return todo, nil
+}
+
+func (model *MemoryModel) ReplaceTodos(ctx context.Context, todos []Todo,
+	deletedTodos []DeletedTodo) error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "ReplaceTodos",
+		Todos: todosToWalTodos(todos), DeletedTodos: deletedTodos}); err != nil {
+		return err
+	}
+
+	revision := model.nextRevision()
+	model.Todos = []Todo{}
+	for _, todo := range todos {
+		todo.Revision = revision
+		todo.CreatedRevision = revision
+		model.Todos = append(model.Todos, todo)
+		if todo.Id >= model.NextTodoId {
+			model.NextTodoId = todo.Id + 1
+		}
+	}
+	model.DeletedTodos = []DeletedTodo{}
+	for _, deletedTodo := range deletedTodos {
+		deletedTodo.Revision = revision
+		model.DeletedTodos = append(model.DeletedTodos, deletedTodo)
+		if deletedTodo.Id >= model.NextTodoId {
+			model.NextTodoId = deletedTodo.Id + 1
+		}
+	}
+	return nil
+}
+
+func (model *MemoryModel) CreateTodoList(ctx context.Context, userId int,
+	action ActionToSync) (TodoList, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "CreateTodoList", UserId: userId,
+		Action: &action}); err != nil {
+		return TodoList{}, err
+	}
+	list := TodoList{
+		Id:       model.NextTodoListId,
+		UserId:   userId,
+		Name:     *action.Name,
+		Revision: model.nextRevision(),
+	}
+	model.TodoLists = append(model.TodoLists, list)
+	model.NextTodoListId += 1
+	model.ListMembers = append(model.ListMembers, ListMember{
+		ListId:   list.Id,
+		UserId:   userId,
+		Role:     RoleOwner,
+		Revision: list.Revision,
+	})
+	return list, nil
+}
+
+func (model *MemoryModel) FindTodoListById(ctx context.Context,
+	listId int) (TodoList, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if index := model.indexOfTodoList(listId); index != -1 {
+		return model.TodoLists[index], nil
+	}
+	return TodoList{}, fmt.Errorf("%w: No list with id=%d", ErrNotFound, listId)
+}
+
+// indexOfTodoList returns the index in TodoLists of any user's list, or -1
+func (model *MemoryModel) indexOfTodoList(listId int) int {
+	for i, list := range model.TodoLists {
+		if list.Id == listId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (model *MemoryModel) FindTodoList(ctx context.Context, userId int,
+	listId int) (TodoList, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	for _, list := range model.TodoLists {
+		if list.Id == listId && list.UserId == userId {
+			return list, nil
+		}
+	}
+	return TodoList{}, fmt.Errorf("%w: No list with id=%d", ErrNotFound, listId)
+}
+
+func (model *MemoryModel) UpdateTodoList(ctx context.Context, userId int,
+	action ActionToSync, listId int) (int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "UpdateTodoList", UserId: userId,
+		Action: &action, ListId: listId}); err != nil {
+		return 0, err
+	}
+	if action.Name == nil && action.Archived == nil {
+		return 0, nil
+	}
+	for i, list := range model.TodoLists {
+		if list.Id == listId && list.UserId == userId {
+			if action.Name != nil {
+				list.Name = *action.Name
+			}
+			if action.Archived != nil {
+				list.Archived = *action.Archived
+			}
+			list.Revision = model.nextRevision()
+			model.TodoLists[i] = list
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func (model *MemoryModel) DeleteTodoList(ctx context.Context, userId int,
+	listId int) (int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "DeleteTodoList", UserId: userId,
+		ListId: listId}); err != nil {
+		return 0, err
+	}
+	numRowsDeleted := 0
+	newLists := []TodoList{}
+	for _, list := range model.TodoLists {
+		if list.Id == listId && list.UserId == userId {
+			numRowsDeleted += 1
+			revision := model.nextRevision()
+			model.DeletedTodoLists = append(model.DeletedTodoLists,
+				DeletedTodoList{Id: listId, UserId: userId, Revision: revision})
+			for _, member := range model.ListMembers {
+				if member.ListId == listId && member.UserId != userId {
+					model.DeletedTodoLists = append(model.DeletedTodoLists,
+						DeletedTodoList{
+							Id:       listId,
+							UserId:   member.UserId,
+							Revision: revision,
+						})
+				}
+			}
+		} else {
+			newLists = append(newLists, list)
+		}
+	}
+	model.TodoLists = newLists
+	if numRowsDeleted > 0 {
+		newMembers := []ListMember{}
+		for _, member := range model.ListMembers {
+			if member.ListId != listId {
+				newMembers = append(newMembers, member)
+			}
+		}
+		model.ListMembers = newMembers
+		newInvites := []ListInvite{}
+		for _, invite := range model.ListInvites {
+			if invite.ListId != listId {
+				newInvites = append(newInvites, invite)
+			}
+		}
+		model.ListInvites = newInvites
+	}
+	return numRowsDeleted, nil
+}
+
+func (model *MemoryModel) ListTodoLists(ctx context.Context,
+	userId int) ([]TodoList, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	lists := []TodoList{}
+	for _, list := range model.TodoLists {
+		if list.UserId == userId {
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
+
+func (model *MemoryModel) FindListMember(ctx context.Context, listId int,
+	userId int) (ListMember, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	for _, member := range model.ListMembers {
+		if member.ListId == listId && member.UserId == userId {
+			return model.withUserUid(member), nil
+		}
+	}
+	return ListMember{}, fmt.Errorf("%w: User id=%d isn't a member of list %d",
+		ErrNotFound, userId, listId)
+}
+
+// withUserUid fills in member.UserUid
+func (model *MemoryModel) withUserUid(member ListMember) ListMember {
+	for _, user := range model.Users {
+		if user.Id == member.UserId {
+			member.UserUid = user.Uid
+		}
+	}
+	return member
+}
+
+func (model *MemoryModel) ListListMembers(ctx context.Context,
+	listId int) ([]ListMember, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	members := []ListMember{}
+	for _, member := range model.ListMembers {
+		if member.ListId == listId {
+			members = append(members, model.withUserUid(member))
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserId < members[j].UserId
+	})
+	return members, nil
+}
+
+func (model *MemoryModel) ListMemberships(ctx context.Context,
+	userId int) ([]ListMember, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	members := []ListMember{}
+	for _, member := range model.ListMembers {
+		if member.UserId == userId {
+			members = append(members, model.withUserUid(member))
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ListId < members[j].ListId
+	})
+	return members, nil
+}
+
+func (model *MemoryModel) SetListMember(ctx context.Context,
+	member ListMember) error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	index := model.indexOfTodoList(member.ListId)
+	if index == -1 {
+		return fmt.Errorf("%w: No list with id=%d", ErrNotFound, member.ListId)
+	}
+	// member's JSON leaves out ListId and UserId
+	if err := model.log(memoryMutation{Method: "SetListMember",
+		ListId: member.ListId, UserId: member.UserId,
+		ListMember: &member}); err != nil {
+		return err
+	}
+
+	member.UserUid = ""
+	member.Revision = model.nextRevision()
+	model.TodoLists[index].Revision = member.Revision
+
+	newMembers := []ListMember{member}
+	for _, existing := range model.ListMembers {
+		if existing.ListId != member.ListId || existing.UserId != member.UserId {
+			newMembers = append(newMembers, existing)
+		}
+	}
+	model.ListMembers = newMembers
+	// In case they were removed before
+	newDeletedLists := []DeletedTodoList{}
+	for _, deletedList := range model.DeletedTodoLists {
+		if deletedList.Id != member.ListId ||
+			deletedList.UserId != member.UserId {
+			newDeletedLists = append(newDeletedLists, deletedList)
+		}
+	}
+	model.DeletedTodoLists = newDeletedLists
+	return nil
+}
+
+func (model *MemoryModel) DeleteListMember(ctx context.Context, listId int,
+	userId int) (int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if err := model.log(memoryMutation{Method: "DeleteListMember",
+		ListId: listId, UserId: userId}); err != nil {
+		return 0, err
+	}
+
+	numRowsDeleted := 0
+	newMembers := []ListMember{}
+	for _, member := range model.ListMembers {
+		if member.ListId == listId && member.UserId == userId {
+			numRowsDeleted += 1
+		} else {
+			newMembers = append(newMembers, member)
+		}
+	}
+	if numRowsDeleted == 0 {
+		return 0, nil
+	}
+	model.ListMembers = newMembers
+	revision := model.nextRevision()
+	model.DeletedTodoLists = append(model.DeletedTodoLists,
+		DeletedTodoList{Id: listId, UserId: userId, Revision: revision})
+	if index := model.indexOfTodoList(listId); index != -1 {
+		model.TodoLists[index].Revision = revision
+	}
+	return numRowsDeleted, nil
+}
+
+func (model *MemoryModel) CreateListInvite(ctx context.Context,
+	invite ListInvite) error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	for _, existing := range model.ListInvites {
+		if existing.Code == invite.Code {
+			return fmt.Errorf("%w: Invite code is taken", ErrConflict)
+		}
+	}
+	index := model.indexOfTodoList(invite.ListId)
+	if index == -1 {
+		return fmt.Errorf("%w: No list with id=%d", ErrNotFound, invite.ListId)
+	}
+	// invite's JSON leaves out ListId
+	if err := model.log(memoryMutation{Method: "CreateListInvite",
+		ListId: invite.ListId, ListInvite: &invite}); err != nil {
+		return err
+	}
+
+	model.TodoLists[index].Revision = model.nextRevision()
+	model.ListInvites = append(model.ListInvites, invite)
+	return nil
+}
+
+func (model *MemoryModel) ListListInvites(ctx context.Context,
+	listId int) ([]ListInvite, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	invites := []ListInvite{}
+	for _, invite := range model.ListInvites {
+		if invite.ListId == listId {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].Code < invites[j].Code
+	})
+	return invites, nil
+}
+
+func (model *MemoryModel) TakeListInvite(ctx context.Context,
+	code string) (ListInvite, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	var taken *ListInvite
+	newInvites := []ListInvite{}
+	for i, invite := range model.ListInvites {
+		if invite.Code == code {
+			taken = &model.ListInvites[i]
+		} else {
+			newInvites = append(newInvites, invite)
+		}
+	}
+	if taken == nil {
+		return ListInvite{}, fmt.Errorf("%w: No invite with that code",
+			ErrNotFound)
+	}
+	if err := model.log(memoryMutation{Method: "TakeListInvite",
+		InviteCode: code}); err != nil {
+		return ListInvite{}, err
+	}
+	model.ListInvites = newInvites
+	return *taken, nil
+}
+
+func (model *MemoryModel) CreateStreamToken(ctx context.Context,
+	token StreamToken) error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	for _, existing := range model.StreamTokens {
+		if existing.TokenHash == token.TokenHash {
+			return fmt.Errorf("%w: Stream token is taken", ErrConflict)
+		}
+	}
+	if err := model.log(memoryMutation{Method: "CreateStreamToken",
+		StreamToken: &token}); err != nil {
+		return err
+	}
+
+	newTokens := []StreamToken{}
+	for _, existing := range model.StreamTokens {
+		if existing.DeviceId != token.DeviceId {
+			newTokens = append(newTokens, existing)
+		}
+	}
+	model.StreamTokens = append(newTokens, token)
+	return nil
+}
+
+func (model *MemoryModel) TakeStreamToken(ctx context.Context,
+	tokenHash string) (StreamToken, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	var taken *StreamToken
+	newTokens := []StreamToken{}
+	for i, token := range model.StreamTokens {
+		if token.TokenHash == tokenHash {
+			taken = &model.StreamTokens[i]
+		} else {
+			newTokens = append(newTokens, token)
+		}
+	}
+	if taken == nil {
+		return StreamToken{}, fmt.Errorf("%w: No stream token with that hash",
+			ErrNotFound)
+	}
+	if err := model.log(memoryMutation{Method: "TakeStreamToken",
+		TokenHash: tokenHash}); err != nil {
+		return StreamToken{}, err
+	}
+	model.StreamTokens = newTokens
+	return *taken, nil
+}
+
+func (model *MemoryModel) CreateActionEvent(ctx context.Context,
+	event ActionEvent) (ActionEvent, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	for _, existing := range model.ActionEvents {
+		if existing.DeviceId == event.DeviceId &&
+			existing.Action.Id == event.Action.Id {
+			return ActionEvent{}, fmt.Errorf(
+				"%w: Device id=%d already has an event for action %d",
+				ErrConflict, event.DeviceId, event.Action.Id)
+		}
+	}
+	if err := model.log(memoryMutation{Method: "CreateActionEvent",
+		ActionEvent: &event}); err != nil {
+		return ActionEvent{}, err
+	}
+	event.Id = model.NextActionEventId
+	model.ActionEvents = append(model.ActionEvents, event)
+	model.NextActionEventId += 1
+	return event, nil
+}
+
+func (model *MemoryModel) ListActionEvents(
+	ctx context.Context) ([]ActionEvent, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	events := make([]ActionEvent, len(model.ActionEvents))
+	copy(events, model.ActionEvents)
+	return events, nil
+}
+
+func (model *MemoryModel) CreateTodoChange(ctx context.Context,
+	change TodoChange) (TodoChange, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	// change's JSON leaves out UserId
+	if err := model.log(memoryMutation{Method: "CreateTodoChange",
+		UserId: change.UserId, TodoChange: &change}); err != nil {
+		return TodoChange{}, err
+	}
+
+	change.Id = model.NextTodoChangeId
+	model.TodoChanges = append(model.TodoChanges, change)
+	model.NextTodoChangeId += 1
+	return change, nil
+}
+
+func (model *MemoryModel) ListTodoChangesByAction(ctx context.Context,
+	deviceId int, actionToSyncId int) ([]TodoChange, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	changes := []TodoChange{}
+	for _, change := range model.TodoChanges {
+		if change.DeviceId == deviceId && change.ActionToSyncId == actionToSyncId {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (model *MemoryModel) ListTodoChanges(ctx context.Context, userId int,
+	todoId int) ([]TodoChange, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	changes := []TodoChange{}
+	for _, change := range model.TodoChanges {
+		if change.UserId == userId && change.TodoId == todoId {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+func (model *MemoryModel) nextRevision() int {
+	model.Revision += 1
+	return model.Revision
+}
+
+func (model *MemoryModel) LatestRevision(ctx context.Context) (int, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	return model.Revision, nil
+}
+
+func (model *MemoryModel) ListChangesSince(ctx context.Context, userId int,
+	revision int) (Changes, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	changes := Changes{
+		Todos:          []Todo{},
+		DeletedTodoIds: []int{},
+		Lists:          []TodoList{},
+		DeletedListIds: []int{},
+		Revision:       model.Revision,
+	}
+	for _, todo := range model.Todos {
+		if todo.UserId == userId && todo.Revision > revision {
+			changes.Todos = append(changes.Todos, todo)
+		}
+	}
+	for _, deletedTodo := range model.DeletedTodos {
+		if deletedTodo.UserId == userId && deletedTodo.Revision > revision {
+			changes.DeletedTodoIds = append(changes.DeletedTodoIds, deletedTodo.Id)
+		}
+	}
+	for _, list := range model.TodoLists {
+		if list.UserId == userId && list.Revision > revision {
+			changes.Lists = append(changes.Lists, list)
+		}
+	}
+	for _, deletedList := range model.DeletedTodoLists {
+		if deletedList.UserId == userId && deletedList.Revision > revision {
+			changes.DeletedListIds = append(changes.DeletedListIds, deletedList.Id)
+		}
+	}
+	return changes, nil
+}
+
+func (model *MemoryModel) ListChangesInListSince(ctx context.Context,
+	listId int, revision int) (Changes, error) {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	changes := Changes{
+		Todos:          []Todo{},
+		DeletedTodoIds: []int{},
+		Lists:          []TodoList{},
+		DeletedListIds: []int{},
+		Revision:       model.Revision,
+	}
+	for _, todo := range model.Todos {
+		if todo.ListId == listId && todo.Revision > revision {
+			changes.Todos = append(changes.Todos, todo)
+		}
+	}
+	for _, deletedTodo := range model.DeletedTodos {
+		if deletedTodo.ListId == listId && deletedTodo.Revision > revision {
+			changes.DeletedTodoIds = append(changes.DeletedTodoIds, deletedTodo.Id)
+		}
+	}
+	for _, list := range model.TodoLists {
+		if list.Id == listId && list.Revision > revision {
+			changes.Lists = append(changes.Lists, list)
+		}
+	}
+	return changes, nil
 }
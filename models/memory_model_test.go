@@ -1,12 +1,17 @@
 package models
 
 import (
+	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"sync"
 	"testing"
 )
 
 func pointToString(s string) *string { return &s }
 func pointToBool(b bool) *bool       { return &b }
+func pointToInt64(i int64) *int64    { return &i }
+func pointToInt(i int) *int          { return &i }
 
 func TestCreateTodo(t *testing.T) {
 	model := NewMemoryModel()
@@ -14,16 +19,177 @@ func TestCreateTodo(t *testing.T) {
 		Title     string
 		Completed bool
 	}{"t", true}
-	newTodo := model.CreateTodo(ActionToSync{
+	newTodo, err := model.CreateTodo(context.Background(), 1, ActionToSync{
 		Title:     &spec.Title,
 		Completed: &spec.Completed,
 	})
+	assert.Equal(t, nil, err)
 	assert.Equal(t, spec.Title, newTodo.Title)
 	assert.Equal(t, spec.Completed, newTodo.Completed)
 	assert.Equal(t, []Todo{{
-		Id:        1,
-		Title:     spec.Title,
-		Completed: spec.Completed,
+		Id:               1,
+		UserId:           1,
+		Title:            spec.Title,
+		Completed:        spec.Completed,
+		Position:         TodoPositionGap,
+		Revision:         1,
+		CreatedRevision:  1,
+		Version:          1,
+		TitleVersion:     1,
+		CompletedVersion: 1,
 	}}, model.Todos)
 	assert.Equal(t, 2, model.NextTodoId)
 }
+
+func TestUpdateMissingDevice(t *testing.T) {
+	model := NewMemoryModel()
+	err := model.UpdateDeviceActionToSyncIdToOutputJson(
+		context.Background(), Device{Id: 1, Uid: "A"})
+	assert.Equal(t, true, errors.Is(err, ErrNotFound))
+}
+
+func TestWithTxRollsBack(t *testing.T) {
+	model := NewMemoryModel()
+	err := model.WithTx(context.Background(), func(tx Model) error {
+		if _, err := tx.CreateTodo(context.Background(), 1, ActionToSync{
+			Title:     pointToString("t"),
+			Completed: pointToBool(false),
+		}); err != nil {
+			return err
+		}
+		return errors.New("Fail after creating todo")
+	})
+	assert.EqualError(t, err, "Fail after creating todo")
+	assert.Equal(t, []Todo{}, model.Todos)
+	assert.Equal(t, 1, model.NextTodoId)
+}
+
+func TestWithTxRollsBackAppendsToLogs(t *testing.T) {
+	ctx := context.Background()
+	model := NewMemoryModel()
+	createEvent := func(tx Model, actionId int) {
+		_, err := tx.CreateActionEvent(ctx, ActionEvent{DeviceId: 1,
+			Action: ActionToSync{Id: actionId}})
+		assert.Equal(t, nil, err)
+		_, err = tx.CreateTodoChange(ctx, TodoChange{TodoId: actionId})
+		assert.Equal(t, nil, err)
+	}
+	assert.Equal(t, nil, model.WithTx(ctx, func(tx Model) error {
+		createEvent(tx, 1)
+		return nil
+	}))
+	err := model.WithTx(ctx, func(tx Model) error {
+		createEvent(tx, 2)
+		return errors.New("Fail after logging")
+	})
+	assert.EqualError(t, err, "Fail after logging")
+	assert.Equal(t, 1, len(model.ActionEvents))
+	assert.Equal(t, 1, len(model.TodoChanges))
+
+	assert.Equal(t, nil, model.WithTx(ctx, func(tx Model) error {
+		createEvent(tx, 3)
+		return nil
+	}))
+	events, _ := model.ListActionEvents(ctx)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, 3, events[1].Action.Id)
+	assert.Equal(t, 2, events[1].Id)
+	assert.Equal(t, 3, model.TodoChanges[1].TodoId)
+}
+
+func TestWithTxCommits(t *testing.T) {
+	model := NewMemoryModel()
+	err := model.WithTx(context.Background(), func(tx Model) error {
+		_, err := tx.CreateTodo(context.Background(), 1, ActionToSync{
+			Title:     pointToString("t"),
+			Completed: pointToBool(false),
+		})
+		return err
+	})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []Todo{
+		{Id: 1, UserId: 1, Title: "t", Completed: false,
+			Position: TodoPositionGap, Revision: 1, CreatedRevision: 1, Version: 1,
+			TitleVersion: 1, CompletedVersion: 1},
+	}, model.Todos)
+}
+
+func TestListChangesSince(t *testing.T) {
+	ctx := context.Background()
+	model := NewMemoryModel()
+	first, _ := model.CreateTodo(ctx, 1, ActionToSync{
+		Title:     pointToString("first"),
+		Completed: pointToBool(false),
+	})
+	second, _ := model.CreateTodo(ctx, 1, ActionToSync{
+		Title:     pointToString("second"),
+		Completed: pointToBool(false),
+	})
+	model.DeleteTodo(ctx, 1, first.Id)
+
+	changes, err := model.ListChangesSince(ctx, 1, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, Changes{
+		Todos:          []Todo{second},
+		DeletedTodoIds: []int{first.Id},
+		Lists:          []TodoList{},
+		DeletedListIds: []int{},
+		Revision:       3,
+	}, changes)
+
+	latestRevision, err := model.LatestRevision(ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, latestRevision)
+}
+
+func TestConcurrentCreateTodo(t *testing.T) {
+	ctx := context.Background()
+	model := NewMemoryModel()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Half in transactions, half not, since both have to take turns
+			if i%2 == 0 {
+				model.CreateTodo(ctx, 1, ActionToSync{
+					Title:     pointToString("t"),
+					Completed: pointToBool(false),
+				})
+			} else {
+				model.WithTx(ctx, func(tx Model) error {
+					_, err := tx.CreateTodo(ctx, 1, ActionToSync{
+						Title:     pointToString("t"),
+						Completed: pointToBool(false),
+					})
+					return err
+				})
+			}
+			model.ListTodos(ctx, 1)
+		}(i)
+	}
+	wg.Wait()
+
+	todos, err := model.ListTodos(ctx, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 50, len(todos))
+	ids := map[int]bool{}
+	for _, todo := range todos {
+		ids[todo.Id] = true
+	}
+	assert.Equal(t, 50, len(ids))
+}
+
+func TestFoundDeviceHasOwnOutputMap(t *testing.T) {
+	ctx := context.Background()
+	model := NewMemoryModel()
+	device, err := model.CreateDevice(ctx, "A", 1, "")
+	assert.Equal(t, nil, err)
+	device.ActionToSyncIdToOutput[1] = 1
+
+	found, err := model.FindDeviceByUid(ctx, "A")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[int]int{}, found.ActionToSyncIdToOutput)
+	found.ActionToSyncIdToOutput[2] = 2
+	assert.Equal(t, map[int]int{}, model.Devices[0].ActionToSyncIdToOutput)
+}
@@ -0,0 +1,393 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files in the data directory of a persistent MemoryModel
+const (
+	memorySnapshotFilename = "snapshot.gob"
+	memoryWalFilename      = "wal.jsonl"
+)
+
+// memoryPersistence keeps a MemoryModel's contents in a directory.
+// snapshot.gob has the whole model as of some WAL batch, and wal.jsonl (the
+// write-ahead log) has a line of JSON for each batch of changes since.
+type memoryPersistence struct {
+	dataDir string
+	wal     *os.File
+	walSize int64
+	// lastSeq numbers the latest batch written to the WAL
+	lastSeq int
+}
+
+// memorySnapshot is the contents of snapshot.gob.  It's a gob rather than
+// JSON since Todo's JSON tags leave out fields clients don't see.
+type memorySnapshot struct {
+	// LastSeq numbers the latest WAL batch whose changes are in Model
+	LastSeq int
+	Model   *MemoryModel
+}
+
+// memoryWalBatch is a line of wal.jsonl: the changes made by a transaction,
+// or by a single method call outside one
+type memoryWalBatch struct {
+	Seq       int
+	Mutations []json.RawMessage
+}
+
+// memoryMutation is a call to a MemoryModel method that changes it.  Only the
+// arguments of that method are set.
+type memoryMutation struct {
+	Method    string
+	Uid       string        `json:",omitempty"`
+	UserId    int           `json:",omitempty"`
+	DeviceId  int           `json:",omitempty"`
+	TodoId    int           `json:",omitempty"`
+	ListId    int           `json:",omitempty"`
+	Position  int           `json:",omitempty"`
+	TokenHash string        `json:",omitempty"`
+	AdminName string        `json:",omitempty"`
+	ResetAt   *time.Time    `json:",omitempty"`
+	Action    *ActionToSync `json:",omitempty"`
+	Device    *Device       `json:",omitempty"`
+
+	Todo         *walTodo      `json:",omitempty"`
+	Todos        []walTodo     `json:",omitempty"`
+	DeletedTodos []DeletedTodo `json:",omitempty"`
+	ActionEvent  *ActionEvent  `json:",omitempty"`
+	TodoChange   *TodoChange   `json:",omitempty"`
+	ListMember   *ListMember   `json:",omitempty"`
+	ListInvite   *ListInvite   `json:",omitempty"`
+	InviteCode   string        `json:",omitempty"`
+	StreamToken  *StreamToken  `json:",omitempty"`
+}
+
+// walTodo is a Todo with JSON for every field, since Todo's JSON leaves out
+// the ones clients don't see
+type walTodo struct {
+	Id               int
+	UserId           int
+	ListId           int
+	Title            string
+	Completed        bool
+	Position         int
+	Revision         int
+	CreatedRevision  int
+	Version          int
+	TitleVersion     int
+	CompletedVersion int
+	ClientUpdatedAt  int64
+}
+
+func todosToWalTodos(todos []Todo) []walTodo {
+	walTodos := []walTodo{}
+	for _, todo := range todos {
+		walTodos = append(walTodos, walTodo(todo))
+	}
+	return walTodos
+}
+
+func walTodosToTodos(walTodos []walTodo) []Todo {
+	todos := []Todo{}
+	for _, walTodo := range walTodos {
+		todos = append(todos, Todo(walTodo))
+	}
+	return todos
+}
+
+// OpenPersistentMemoryModel loads a MemoryModel from the snapshot and WAL in
+// dataDir, creating the directory if needed, and from then on appends every
+// change to the WAL before making it.  Call Snapshot now and then to keep the
+// WAL short, and Close when done.
+func OpenPersistentMemoryModel(dataDir string) (*MemoryModel, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, fmt.Errorf("Error from MkdirAll: %w", err)
+	}
+
+	model := NewMemoryModel()
+	lastSeq := 0
+	snapshotGob, err := ioutil.ReadFile(
+		filepath.Join(dataDir, memorySnapshotFilename))
+	if err == nil {
+		snapshot := memorySnapshot{Model: model}
+		if err := gob.NewDecoder(bytes.NewReader(snapshotGob)).Decode(
+			&snapshot); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %w",
+				memorySnapshotFilename, err)
+		}
+		lastSeq = snapshot.LastSeq
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Error from ReadFile: %w", err)
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dataDir, memoryWalFilename),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error from OpenFile: %w", err)
+	}
+	walSize, lastSeq, err := model.replayWal(wal, lastSeq)
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	model.persistence = &memoryPersistence{
+		dataDir: dataDir,
+		wal:     wal,
+		walSize: walSize,
+		lastSeq: lastSeq,
+	}
+	return model, nil
+}
+
+// replayWal makes the changes in batches after lastSeq, and returns the
+// size of the WAL and the Seq of its latest batch.  A crash while appending
+// can leave the last line incomplete; since that batch was never committed,
+// it's cut off.
+func (model *MemoryModel) replayWal(wal *os.File, lastSeq int) (int64, int,
+	error) {
+	reader := bufio.NewReader(wal)
+	walSize := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, 0, fmt.Errorf("Error reading %s: %w", memoryWalFilename, err)
+		}
+
+		var batch memoryWalBatch
+		if err := json.Unmarshal(line, &batch); err != nil {
+			return 0, 0, fmt.Errorf("Error parsing %s at byte %d: %w",
+				memoryWalFilename, walSize, err)
+		}
+		if batch.Seq > lastSeq {
+			for _, mutationJson := range batch.Mutations {
+				if err := model.replay(mutationJson); err != nil {
+					return 0, 0, fmt.Errorf("Error replaying batch %d: %w",
+						batch.Seq, err)
+				}
+			}
+			lastSeq = batch.Seq
+		}
+		walSize += int64(len(line))
+	}
+
+	if err := wal.Truncate(walSize); err != nil {
+		return 0, 0, fmt.Errorf("Error from Truncate: %w", err)
+	}
+	return walSize, lastSeq, nil
+}
+
+// replay repeats a logged call.  Only calls that were going to succeed are
+// logged, so any error means the WAL doesn't match the snapshot.
+func (model *MemoryModel) replay(mutationJson json.RawMessage) error {
+	var mutation memoryMutation
+	if err := json.Unmarshal(mutationJson, &mutation); err != nil {
+		return fmt.Errorf("Error parsing mutation: %w", err)
+	}
+
+	ctx := context.Background()
+	var err error
+	switch mutation.Method {
+	case "Reset":
+		err = model.Reset(ctx)
+	case "CreateResetRecord":
+		_, err = model.CreateResetRecord(ctx, mutation.AdminName,
+			*mutation.ResetAt)
+	case "CreateUser":
+		_, err = model.CreateUser(ctx, mutation.Uid)
+	case "CreateDevice":
+		_, err = model.CreateDevice(ctx, mutation.Uid, mutation.UserId,
+			mutation.TokenHash)
+	case "UpdateDeviceTokenHash":
+		err = model.UpdateDeviceTokenHash(ctx, mutation.DeviceId,
+			mutation.TokenHash)
+	case "UpdateDeviceActionToSyncIdToOutputJson":
+		err = model.UpdateDeviceActionToSyncIdToOutputJson(ctx, *mutation.Device)
+	case "CreateTodo":
+		_, err = model.CreateTodo(ctx, mutation.UserId, *mutation.Action)
+	case "UpdateTodo":
+		_, err = model.UpdateTodo(ctx, mutation.UserId, *mutation.Action,
+			mutation.TodoId)
+	case "DeleteTodo":
+		_, err = model.DeleteTodo(ctx, mutation.UserId, mutation.TodoId)
+	case "MoveTodo":
+		_, err = model.MoveTodo(ctx, mutation.UserId, mutation.TodoId,
+			mutation.Position)
+	case "RenumberTodos":
+		err = model.RenumberTodos(ctx, mutation.UserId)
+	case "SetAllTodosCompleted":
+		_, err = model.SetAllTodosCompleted(ctx, mutation.UserId, *mutation.Action)
+	case "DeleteCompletedTodos":
+		_, err = model.DeleteCompletedTodos(ctx, mutation.UserId,
+			*mutation.Action)
+	case "RestoreTodo":
+		_, err = model.RestoreTodo(ctx, Todo(*mutation.Todo))
+	case "ReplaceTodos":
+		err = model.ReplaceTodos(ctx, walTodosToTodos(mutation.Todos),
+			mutation.DeletedTodos)
+	case "CreateTodoList":
+		_, err = model.CreateTodoList(ctx, mutation.UserId, *mutation.Action)
+	case "UpdateTodoList":
+		_, err = model.UpdateTodoList(ctx, mutation.UserId, *mutation.Action,
+			mutation.ListId)
+	case "DeleteTodoList":
+		_, err = model.DeleteTodoList(ctx, mutation.UserId, mutation.ListId)
+	case "SetListMember":
+		member := *mutation.ListMember
+		member.ListId = mutation.ListId
+		member.UserId = mutation.UserId
+		err = model.SetListMember(ctx, member)
+	case "DeleteListMember":
+		_, err = model.DeleteListMember(ctx, mutation.ListId, mutation.UserId)
+	case "CreateListInvite":
+		invite := *mutation.ListInvite
+		invite.ListId = mutation.ListId
+		err = model.CreateListInvite(ctx, invite)
+	case "TakeListInvite":
+		_, err = model.TakeListInvite(ctx, mutation.InviteCode)
+	case "CreateStreamToken":
+		err = model.CreateStreamToken(ctx, *mutation.StreamToken)
+	case "TakeStreamToken":
+		_, err = model.TakeStreamToken(ctx, mutation.TokenHash)
+	case "CreateActionEvent":
+		_, err = model.CreateActionEvent(ctx, *mutation.ActionEvent)
+	case "CreateTodoChange":
+		change := *mutation.TodoChange
+		change.UserId = mutation.UserId
+		_, err = model.CreateTodoChange(ctx, change)
+	default:
+		return fmt.Errorf("Unknown method %s", mutation.Method)
+	}
+	return err
+}
+
+// log records a call that's about to change the model, if it's persistent:
+// in a transaction, to append to the WAL on commit, or else right away.
+// Callers check first that the call will succeed, so replay can treat any
+// error as corruption.
+func (model *MemoryModel) log(mutation memoryMutation) error {
+	if model.persistence == nil {
+		return nil
+	}
+
+	// Marshal now, since the caller may change what the arguments point to
+	mutationJson, err := json.Marshal(mutation)
+	if err != nil {
+		return fmt.Errorf("Error from json.Marshal: %w", err)
+	}
+	if model.inTx {
+		model.pendingMutations = append(model.pendingMutations, mutationJson)
+		return nil
+	}
+	return model.persistence.appendToWal([]json.RawMessage{mutationJson})
+}
+
+// appendToWal writes a batch and waits for it to reach the disk
+func (persistence *memoryPersistence) appendToWal(
+	mutations []json.RawMessage) error {
+	batch := memoryWalBatch{Seq: persistence.lastSeq + 1, Mutations: mutations}
+	line, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("Error from json.Marshal: %w", err)
+	}
+	line = append(line, '\n')
+
+	if _, err := persistence.wal.Write(line); err != nil {
+		// Don't leave part of a line for the next batch to be appended to
+		persistence.wal.Truncate(persistence.walSize)
+		return fmt.Errorf("%w: Error appending to %s: %s", ErrUnavailable,
+			memoryWalFilename, err)
+	}
+	if err := persistence.wal.Sync(); err != nil {
+		persistence.wal.Truncate(persistence.walSize)
+		return fmt.Errorf("%w: Error from Sync: %s", ErrUnavailable, err)
+	}
+	persistence.walSize += int64(len(line))
+	persistence.lastSeq = batch.Seq
+	return nil
+}
+
+// Snapshot writes the whole model to snapshot.gob and empties the WAL, so
+// the next startup has less to replay.  Does nothing unless the model is
+// persistent.
+func (model *MemoryModel) Snapshot() error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if model.persistence == nil {
+		return nil
+	}
+	return model.persistence.writeSnapshot(model)
+}
+
+func (persistence *memoryPersistence) writeSnapshot(model *MemoryModel) error {
+	var snapshotGob bytes.Buffer
+	if err := gob.NewEncoder(&snapshotGob).Encode(memorySnapshot{
+		LastSeq: persistence.lastSeq,
+		Model:   model,
+	}); err != nil {
+		return fmt.Errorf("Error from gob Encode: %w", err)
+	}
+
+	// Replace the old snapshot all at once, so a crash leaves one or the other
+	path := filepath.Join(persistence.dataDir, memorySnapshotFilename)
+	if err := writeFileAndSync(path+".tmp", snapshotGob.Bytes()); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("Error from Rename: %w", err)
+	}
+
+	// If a crash comes before this, the batches left in the WAL are skipped
+	// at startup since their Seqs are <= LastSeq
+	if err := persistence.wal.Truncate(0); err != nil {
+		return fmt.Errorf("Error from Truncate: %w", err)
+	}
+	persistence.walSize = 0
+	return nil
+}
+
+func writeFileAndSync(path string, contents []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Error from OpenFile: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(contents); err != nil {
+		return fmt.Errorf("Error writing %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("Error from Sync: %w", err)
+	}
+	return file.Close()
+}
+
+// Close snapshots the model and closes the WAL.  Does nothing unless the model
+// is persistent.
+func (model *MemoryModel) Close() error {
+	model.mutex.Lock()
+	defer model.mutex.Unlock()
+	if model.persistence == nil {
+		return nil
+	}
+	if err := model.persistence.writeSnapshot(model); err != nil {
+		return err
+	}
+	if err := model.persistence.wal.Close(); err != nil {
+		return fmt.Errorf("Error from Close: %w", err)
+	}
+	model.persistence = nil
+	return nil
+}
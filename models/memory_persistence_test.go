@@ -0,0 +1,247 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistentMemoryModelConformance(t *testing.T) {
+	testModelConformance(t, func(t *testing.T) Model {
+		model, err := OpenPersistentMemoryModel(t.TempDir())
+		if err != nil {
+			t.Fatalf("Error from OpenPersistentMemoryModel: %s", err)
+		}
+		t.Cleanup(func() { model.Close() })
+		return model
+	})
+}
+
+func mustOpenPersistentMemoryModel(t *testing.T, dataDir string) *MemoryModel {
+	model, err := OpenPersistentMemoryModel(dataDir)
+	if err != nil {
+		t.Fatalf("Error from OpenPersistentMemoryModel: %s", err)
+	}
+	return model
+}
+
+// Makes changes inside and outside transactions, including ones that fail
+func makeChanges(t *testing.T, model *MemoryModel) {
+	ctx := context.Background()
+	user, _ := model.CreateUser(ctx, "U")
+	model.CreateUser(ctx, "U")
+	err := model.WithTx(ctx, func(tx Model) error {
+		device, err := tx.CreateDevice(ctx, "A", user.Id, "hash")
+		if err != nil {
+			return err
+		}
+		device.ActionToSyncIdToOutput[1] = 1
+		todo, err := tx.CreateTodo(ctx, user.Id, ActionToSync{
+			Title:     pointToString("first"),
+			Completed: pointToBool(false),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateTodoChange(ctx, TodoChange{UserId: user.Id,
+			TodoId: todo.Id, DeviceId: device.Id, ActionToSyncId: 1,
+			Type: "TODOS/ADD_TODO", Title: pointToString("first"),
+			ServerTime: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)})
+		if err != nil {
+			return err
+		}
+		// Changing the map after passing it shouldn't change what's logged
+		err = tx.UpdateDeviceActionToSyncIdToOutputJson(ctx, device)
+		device.ActionToSyncIdToOutput[1] = todo.Id + 100
+		return err
+	})
+	assert.Equal(t, nil, err)
+	err = model.WithTx(ctx, func(tx Model) error {
+		tx.CreateTodo(ctx, user.Id, ActionToSync{
+			Title:     pointToString("rolled back"),
+			Completed: pointToBool(false),
+		})
+		return errors.New("Fail after creating todo")
+	})
+	assert.EqualError(t, err, "Fail after creating todo")
+	model.UpdateTodo(ctx, user.Id, ActionToSync{
+		Completed: pointToBool(true),
+	}, 1)
+	model.DeleteTodo(ctx, user.Id, 1)
+	model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("second"),
+		Completed: pointToBool(false),
+	})
+	model.RestoreTodo(ctx, Todo{Id: 1, UserId: user.Id, Title: "restored",
+		Version: 3})
+	model.SetAllTodosCompleted(ctx, user.Id, ActionToSync{
+		Completed: pointToBool(true),
+	})
+	list, _ := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("list")})
+	model.UpdateTodoList(ctx, user.Id, ActionToSync{Archived: pointToBool(true)},
+		list.Id)
+	model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:           pointToString("in list"),
+		Completed:       pointToBool(true),
+		ListIdMaybeTemp: &list.Id,
+	})
+	model.DeleteCompletedTodos(ctx, user.Id,
+		ActionToSync{ListIdMaybeTemp: &list.Id})
+	model.DeleteTodoList(ctx, user.Id, list.Id)
+	kept, _ := model.CreateTodoList(ctx, user.Id,
+		ActionToSync{Name: pointToString("kept")})
+	member, _ := model.CreateUser(ctx, "V")
+	model.SetListMember(ctx, ListMember{ListId: kept.Id, UserId: member.Id,
+		Role: RoleEditor})
+	model.CreateListInvite(ctx, ListInvite{Code: "a", ListId: kept.Id,
+		Role: RoleViewer})
+	model.CreateListInvite(ctx, ListInvite{Code: "b", ListId: kept.Id,
+		Role: RoleViewer})
+	model.TakeListInvite(ctx, "a")
+	model.DeleteListMember(ctx, kept.Id, member.Id)
+	issuedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tokenHash := range []string{"s", "t"} {
+		model.CreateStreamToken(ctx, StreamToken{TokenHash: tokenHash,
+			DeviceId: 1, IssuedAt: issuedAt})
+	}
+	model.TakeStreamToken(ctx, "s")
+}
+
+func assertSameContents(t *testing.T, expected *MemoryModel,
+	actual *MemoryModel) {
+	assert.Equal(t, expected.Users, actual.Users)
+	assert.Equal(t, expected.NextUserId, actual.NextUserId)
+	assert.Equal(t, expected.Devices, actual.Devices)
+	assert.Equal(t, expected.NextDeviceId, actual.NextDeviceId)
+	assert.Equal(t, expected.Todos, actual.Todos)
+	assert.Equal(t, expected.NextTodoId, actual.NextTodoId)
+	assert.Equal(t, expected.DeletedTodos, actual.DeletedTodos)
+	assert.Equal(t, expected.Revision, actual.Revision)
+	assert.Equal(t, expected.TodoChanges, actual.TodoChanges)
+	assert.Equal(t, expected.TodoLists, actual.TodoLists)
+	assert.Equal(t, expected.NextTodoListId, actual.NextTodoListId)
+	assert.Equal(t, expected.DeletedTodoLists, actual.DeletedTodoLists)
+	assert.Equal(t, expected.ListMembers, actual.ListMembers)
+	assert.Equal(t, expected.ListInvites, actual.ListInvites)
+	assert.Equal(t, expected.StreamTokens, actual.StreamTokens)
+}
+
+func TestPersistentMemoryModelRecoversFromWal(t *testing.T) {
+	dataDir := t.TempDir()
+	model := mustOpenPersistentMemoryModel(t, dataDir)
+	makeChanges(t, model)
+	expected := NewMemoryModel()
+	makeChanges(t, expected)
+
+	// Without Close, as if the process crashed
+	recovered := mustOpenPersistentMemoryModel(t, dataDir)
+	defer recovered.Close()
+	assertSameContents(t, expected, recovered)
+	assert.Equal(t, map[int]int{1: 1},
+		recovered.Devices[0].ActionToSyncIdToOutput)
+}
+
+func TestPersistentMemoryModelSnapshot(t *testing.T) {
+	dataDir := t.TempDir()
+	walPath := filepath.Join(dataDir, memoryWalFilename)
+	model := mustOpenPersistentMemoryModel(t, dataDir)
+	makeChanges(t, model)
+	assert.Equal(t, nil, model.Snapshot())
+	wal, _ := ioutil.ReadFile(walPath)
+	assert.Equal(t, "", string(wal))
+
+	ctx := context.Background()
+	model.CreateUser(ctx, "V")
+	assert.Equal(t, nil, model.Close())
+	model = mustOpenPersistentMemoryModel(t, dataDir)
+	defer model.Close()
+	_, err := model.FindUserByUid(ctx, "V")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(model.Todos))
+}
+
+func TestPersistentMemoryModelSkipsBatchesInSnapshot(t *testing.T) {
+	dataDir := t.TempDir()
+	walPath := filepath.Join(dataDir, memoryWalFilename)
+	model := mustOpenPersistentMemoryModel(t, dataDir)
+	makeChanges(t, model)
+	oldWal, _ := ioutil.ReadFile(walPath)
+	assert.Equal(t, nil, model.Snapshot())
+
+	// As if the process crashed before the snapshot emptied the WAL
+	assert.Equal(t, nil, ioutil.WriteFile(walPath, oldWal, 0600))
+	recovered := mustOpenPersistentMemoryModel(t, dataDir)
+	defer recovered.Close()
+	assertSameContents(t, model, recovered)
+}
+
+func TestPersistentMemoryModelIgnoresIncompleteLastLine(t *testing.T) {
+	dataDir := t.TempDir()
+	walPath := filepath.Join(dataDir, memoryWalFilename)
+	model := mustOpenPersistentMemoryModel(t, dataDir)
+	ctx := context.Background()
+	model.CreateUser(ctx, "U")
+
+	// As if the process crashed while appending the next batch
+	wal, _ := os.OpenFile(walPath, os.O_WRONLY|os.O_APPEND, 0600)
+	wal.Write([]byte(`{"Seq":2,"Mutations":[{"Meth`))
+	wal.Close()
+
+	recovered := mustOpenPersistentMemoryModel(t, dataDir)
+	_, err := recovered.CreateUser(ctx, "V")
+	assert.Equal(t, nil, err)
+	recovered = mustOpenPersistentMemoryModel(t, dataDir)
+	defer recovered.Close()
+	assert.Equal(t, []User{{Id: 1, Uid: "U"}, {Id: 2, Uid: "V"}},
+		recovered.Users)
+}
+
+func TestPersistentMemoryModelRejectsCorruptWal(t *testing.T) {
+	dataDir := t.TempDir()
+	walPath := filepath.Join(dataDir, memoryWalFilename)
+	assert.Equal(t, nil, ioutil.WriteFile(walPath, []byte("garbage\n{}\n"), 0600))
+	_, err := OpenPersistentMemoryModel(dataDir)
+	assert.Error(t, err)
+}
+
+func TestPersistentMemoryModelLogsOnlyCallsThatSucceed(t *testing.T) {
+	dataDir := t.TempDir()
+	walPath := filepath.Join(dataDir, memoryWalFilename)
+	model := mustOpenPersistentMemoryModel(t, dataDir)
+	defer model.Close()
+	ctx := context.Background()
+	model.CreateUser(ctx, "U")
+	_, err := model.CreateUser(ctx, "U")
+	assert.True(t, errors.Is(err, ErrConflict))
+	err = model.WithTx(ctx, func(tx Model) error {
+		// Failures a transaction goes on after aren't logged either
+		_, err := tx.TakeListInvite(ctx, "missing")
+		assert.True(t, errors.Is(err, ErrNotFound))
+		_, err = tx.CreateUser(ctx, "V")
+		return err
+	})
+	assert.Equal(t, nil, err)
+
+	wal, _ := ioutil.ReadFile(walPath)
+	assert.Equal(t,
+		`{"Seq":1,"Mutations":[{"Method":"CreateUser","Uid":"U"}]}`+"\n"+
+			`{"Seq":2,"Mutations":[{"Method":"CreateUser","Uid":"V"}]}`+"\n",
+		string(wal))
+}
+
+func TestPersistentMemoryModelRejectsWalThatFailsToReplay(t *testing.T) {
+	dataDir := t.TempDir()
+	walPath := filepath.Join(dataDir, memoryWalFilename)
+	assert.Equal(t, nil, ioutil.WriteFile(walPath, []byte(
+		`{"Seq":1,"Mutations":[{"Method":"CreateUser","Uid":"U"}]}`+"\n"+
+			`{"Seq":2,"Mutations":[{"Method":"CreateUser","Uid":"U"}]}`+"\n"),
+		0600))
+	_, err := OpenPersistentMemoryModel(dataDir)
+	assert.True(t, errors.Is(err, ErrConflict))
+}
@@ -0,0 +1,310 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ErrSchemaOutOfDate means the database hasn't had every migration applied,
+// or has had migrations this binary doesn't know about
+var ErrSchemaOutOfDate = errors.New("Schema out of date")
+
+// Postgres's migrations; see PostgresDialect
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration changes the schema from Version-1 to Version with Up, and back
+// with Down
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus says whether a migration has been applied, and when
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Like 0001_create_devices.up.sql
+var migrationFileRegexp = regexp.MustCompile(`^([0-9]+)_(\w+)\.(up|down)\.sql$`)
+
+// Migrations returns the dialect's embedded migrations, ordered by Version.
+// Versions count up from 1 with no gaps, and each has both an up and a down
+// file.
+func Migrations(dialect *Dialect) ([]Migration, error) {
+	entries, err := dialect.migrationFiles.ReadDir(dialect.migrationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("Error from ReadDir: %w", err)
+	}
+
+	versionToMigration := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("Unexpected migration filename %s", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("Error from Atoi: %w", err)
+		}
+		contents, err := dialect.migrationFiles.ReadFile(
+			path.Join(dialect.migrationsDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Error from ReadFile: %w", err)
+		}
+
+		migration, ok := versionToMigration[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			versionToMigration[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("Migration %d is named both %s and %s",
+				version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, migration := range versionToMigration {
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("Expected migration %d but found %d",
+				i+1, migration.Version)
+		}
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("Migration %d needs both up and down files",
+				migration.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// MigrateUp applies every migration that hasn't been yet, each in its own
+// transaction, and returns the ones it applied
+func MigrateUp(ctx context.Context, db *sql.DB,
+	dialect *Dialect) ([]Migration, error) {
+	migrations, err := Migrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []Migration{}
+	for _, migration := range migrations {
+		didApply := false
+		err := withMigrationTx(ctx, db, dialect, func(tx dbOrTx,
+			versionToAppliedAt map[int]time.Time) error {
+			if _, ok := versionToAppliedAt[migration.Version]; ok {
+				return nil
+			}
+			if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+				return wrapDbError(err, "Error from migration %d_%s up",
+					migration.Version, migration.Name)
+			}
+			sql := `INSERT INTO schema_migrations(version, name, applied_at)
+				VALUES($1, $2, CURRENT_TIMESTAMP);`
+			if _, err := tx.ExecContext(ctx, sql, migration.Version,
+				migration.Name); err != nil {
+				return wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+			}
+			didApply = true
+			return nil
+		})
+		if err != nil {
+			return applied, err
+		}
+		if didApply {
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// MigrateDown reverts the latest applied migration and returns it, or
+// returns nil if none were applied
+func MigrateDown(ctx context.Context, db *sql.DB,
+	dialect *Dialect) (*Migration, error) {
+	migrations, err := Migrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	var reverted *Migration
+	err = withMigrationTx(ctx, db, dialect, func(tx dbOrTx,
+		versionToAppliedAt map[int]time.Time) error {
+		latestVersion := 0
+		for version := range versionToAppliedAt {
+			if version > latestVersion {
+				latestVersion = version
+			}
+		}
+		if latestVersion == 0 {
+			return nil
+		} else if latestVersion > len(migrations) {
+			return fmt.Errorf("%w: Migration %d is newer than this binary",
+				ErrSchemaOutOfDate, latestVersion)
+		}
+
+		migration := migrations[latestVersion-1]
+		if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+			return wrapDbError(err, "Error from migration %d_%s down",
+				migration.Version, migration.Name)
+		}
+		sql := `DELETE FROM schema_migrations WHERE version = $1;`
+		if _, err := tx.ExecContext(ctx, sql, migration.Version); err != nil {
+			return wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+		}
+		reverted = &migration
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// ListMigrationStatuses returns every embedded migration and whether it's
+// been applied
+func ListMigrationStatuses(ctx context.Context, db *sql.DB,
+	dialect *Dialect) ([]MigrationStatus, error) {
+	migrations, err := Migrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	err = withMigrationTx(ctx, db, dialect, func(tx dbOrTx,
+		versionToAppliedAt map[int]time.Time) error {
+		for _, migration := range migrations {
+			status := MigrationStatus{Migration: migration}
+			if appliedAt, ok := versionToAppliedAt[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// CheckSchema returns ErrSchemaOutOfDate unless exactly the embedded
+// migrations have been applied.  It only reads, so it's safe for a server
+// that lacks permission to change the schema.
+func CheckSchema(ctx context.Context, db *sql.DB, dialect *Dialect) error {
+	migrations, err := Migrations(dialect)
+	if err != nil {
+		return err
+	}
+
+	conn := dialect.conn(db)
+	var exists bool
+	sql := dialect.tableExistsSql
+	if err := conn.QueryRowContext(ctx, sql,
+		"schema_migrations").Scan(&exists); err != nil {
+		return wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	} else if !exists {
+		return fmt.Errorf("%w: No migrations have been applied",
+			ErrSchemaOutOfDate)
+	}
+	versionToAppliedAt, err := readAppliedMigrations(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range migrations {
+		if _, ok := versionToAppliedAt[migration.Version]; !ok {
+			return fmt.Errorf("%w: Migration %d_%s hasn't been applied",
+				ErrSchemaOutOfDate, migration.Version, migration.Name)
+		}
+	}
+	if len(versionToAppliedAt) > len(migrations) {
+		return fmt.Errorf("%w: Database has migrations newer than this binary",
+			ErrSchemaOutOfDate)
+	}
+	return nil
+}
+
+// withMigrationTx calls fn in a transaction, with the versions already
+// applied.  Holds a lock so two migrating processes can't interleave.
+func withMigrationTx(ctx context.Context, db *sql.DB, dialect *Dialect,
+	fn func(tx dbOrTx, versionToAppliedAt map[int]time.Time) error) error {
+	sqlTx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapDbError(err, "Error from db.BeginTx")
+	}
+	defer sqlTx.Rollback()
+	tx := dialect.conn(sqlTx)
+
+	if dialect.lockSql != "" {
+		if _, err := tx.ExecContext(ctx, dialect.lockSql,
+			schemaMigrationsLockKey); err != nil {
+			return wrapDbError(err, "Error from db.Exec with sql=%s",
+				dialect.lockSql)
+		}
+	}
+
+	sql := dialect.schemaMigrationsSql
+	if _, err := tx.ExecContext(ctx, sql); err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+	}
+	versionToAppliedAt, err := readAppliedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx, versionToAppliedAt); err != nil {
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return wrapDbError(err, "Error from tx.Commit")
+	}
+	return nil
+}
+
+// readAppliedMigrations returns when each applied version was applied
+func readAppliedMigrations(ctx context.Context,
+	conn dbOrTx) (map[int]time.Time, error) {
+	sql := `SELECT version, applied_at FROM schema_migrations;`
+	rows, err := conn.QueryContext(ctx, sql)
+	if err != nil {
+		return nil, wrapDbError(err, "Error from db.Query with sql=%s", sql)
+	}
+	defer rows.Close()
+
+	versionToAppliedAt := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, wrapDbError(err, "Error from rows.Scan")
+		}
+		versionToAppliedAt[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDbError(err, "Error from rows.Err")
+	}
+	return versionToAppliedAt, nil
+}
@@ -0,0 +1,2 @@
+DROP TABLE todo_items;
+DROP TABLE devices;
@@ -0,0 +1,14 @@
+-- Databases set up before there were migrations already have these tables,
+-- so they're left alone, and the later migrations bring them up to date
+CREATE TABLE IF NOT EXISTS devices (
+  id SERIAL PRIMARY KEY,
+  uid TEXT NOT NULL UNIQUE,
+  action_to_sync_id_to_output_json TEXT NOT NULL,
+  completed_action_to_sync_id INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS todo_items (
+  id SERIAL PRIMARY KEY,
+  title TEXT NOT NULL,
+  completed BOOLEAN NOT NULL
+);
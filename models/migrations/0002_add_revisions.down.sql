@@ -0,0 +1,3 @@
+DROP TABLE deleted_todo_items;
+ALTER TABLE todo_items DROP COLUMN revision;
+DROP SEQUENCE todo_revisions_seq;
@@ -0,0 +1,11 @@
+CREATE SEQUENCE todo_revisions_seq;
+
+ALTER TABLE todo_items ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX todo_items_revision_idx ON todo_items (revision);
+
+-- Tombstones for deleted todos, so delta syncs can report them
+CREATE TABLE deleted_todo_items (
+  id INTEGER PRIMARY KEY,
+  revision INTEGER NOT NULL
+);
+CREATE INDEX deleted_todo_items_revision_idx ON deleted_todo_items (revision);
@@ -0,0 +1,5 @@
+ALTER TABLE todo_items
+  DROP COLUMN version,
+  DROP COLUMN title_version,
+  DROP COLUMN completed_version,
+  DROP COLUMN client_updated_at;
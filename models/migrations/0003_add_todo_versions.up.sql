@@ -0,0 +1,5 @@
+ALTER TABLE todo_items
+  ADD COLUMN version INTEGER NOT NULL DEFAULT 1,
+  ADD COLUMN title_version INTEGER NOT NULL DEFAULT 1,
+  ADD COLUMN completed_version INTEGER NOT NULL DEFAULT 1,
+  ADD COLUMN client_updated_at BIGINT NOT NULL DEFAULT 0;
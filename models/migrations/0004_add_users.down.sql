@@ -0,0 +1,4 @@
+ALTER TABLE deleted_todo_items DROP COLUMN user_id;
+ALTER TABLE todo_items DROP COLUMN user_id;
+ALTER TABLE devices DROP COLUMN user_id;
+DROP TABLE users;
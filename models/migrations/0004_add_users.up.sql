@@ -0,0 +1,31 @@
+CREATE TABLE users (
+  id SERIAL PRIMARY KEY,
+  uid TEXT NOT NULL UNIQUE
+);
+
+-- Before there were users, every device saw every todo, so rows from then
+-- are given to one user, who's only created if there are any
+INSERT INTO users (uid)
+  SELECT 'before-users'
+  WHERE EXISTS (SELECT 1 FROM devices)
+    OR EXISTS (SELECT 1 FROM todo_items)
+    OR EXISTS (SELECT 1 FROM deleted_todo_items);
+
+ALTER TABLE devices ADD COLUMN user_id INTEGER REFERENCES users (id);
+ALTER TABLE todo_items ADD COLUMN user_id INTEGER REFERENCES users (id);
+ALTER TABLE deleted_todo_items ADD COLUMN user_id INTEGER
+  REFERENCES users (id);
+
+UPDATE devices
+  SET user_id = (SELECT id FROM users WHERE uid = 'before-users');
+UPDATE todo_items
+  SET user_id = (SELECT id FROM users WHERE uid = 'before-users');
+UPDATE deleted_todo_items
+  SET user_id = (SELECT id FROM users WHERE uid = 'before-users');
+
+ALTER TABLE devices ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE todo_items ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE deleted_todo_items ALTER COLUMN user_id SET NOT NULL;
+
+CREATE INDEX todo_items_user_id_idx ON todo_items (user_id);
+CREATE INDEX deleted_todo_items_user_id_idx ON deleted_todo_items (user_id);
@@ -0,0 +1,2 @@
+-- NULL once revoked; UNIQUE allows any number of NULLs
+ALTER TABLE devices ADD COLUMN token_hash TEXT UNIQUE;
@@ -0,0 +1 @@
+DROP TABLE reset_records;
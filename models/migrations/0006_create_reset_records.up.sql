@@ -0,0 +1,5 @@
+CREATE TABLE reset_records (
+  id SERIAL PRIMARY KEY,
+  admin_name TEXT NOT NULL,
+  reset_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
@@ -0,0 +1,13 @@
+-- Every ActionToSync applied, in order; the todos can be rebuilt from it
+CREATE TABLE action_events (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  device_id INTEGER NOT NULL REFERENCES devices (id),
+  action_to_sync_id INTEGER NOT NULL,
+  type TEXT NOT NULL,
+  todo_id INTEGER NOT NULL,
+  payload_json TEXT NOT NULL,
+  server_time TIMESTAMP WITH TIME ZONE NOT NULL,
+  output INTEGER NOT NULL,
+  UNIQUE (device_id, action_to_sync_id)
+);
@@ -0,0 +1 @@
+DROP INDEX todo_changes_device_id_action_to_sync_id;
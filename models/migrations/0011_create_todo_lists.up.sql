@@ -0,0 +1,23 @@
+-- Named lists of todos.  A todo_items.list_id of 0 means the todo isn't in
+-- any list; it has no foreign key since 0 isn't a list, and like todo_id in
+-- todo_changes, the list may since have been deleted.
+CREATE TABLE todo_lists (
+  id SERIAL PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  name TEXT NOT NULL,
+  archived BOOLEAN NOT NULL DEFAULT FALSE,
+  revision INTEGER NOT NULL
+);
+CREATE INDEX todo_lists_user_id_revision_idx ON todo_lists (user_id, revision);
+-- For the latest revision
+CREATE INDEX todo_lists_revision_idx ON todo_lists (revision);
+CREATE TABLE deleted_todo_lists (
+  id INTEGER PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  revision INTEGER NOT NULL
+);
+CREATE INDEX deleted_todo_lists_user_id_revision_idx
+  ON deleted_todo_lists (user_id, revision);
+CREATE INDEX deleted_todo_lists_revision_idx ON deleted_todo_lists (revision);
+ALTER TABLE todo_items ADD COLUMN list_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE todo_changes ADD COLUMN list_id INTEGER NOT NULL DEFAULT 0;
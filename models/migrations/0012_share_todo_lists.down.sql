@@ -0,0 +1,9 @@
+DROP INDEX todo_items_list_id_revision_idx;
+ALTER TABLE deleted_todo_items DROP COLUMN list_id;
+DELETE FROM deleted_todo_lists
+  WHERE user_id <> (SELECT MIN(user_id) FROM deleted_todo_lists AS other
+    WHERE other.id = deleted_todo_lists.id);
+ALTER TABLE deleted_todo_lists DROP CONSTRAINT deleted_todo_lists_pkey;
+ALTER TABLE deleted_todo_lists ADD PRIMARY KEY (id);
+DROP TABLE list_invites;
+DROP TABLE list_members;
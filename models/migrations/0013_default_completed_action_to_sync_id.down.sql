@@ -0,0 +1 @@
+ALTER TABLE devices ALTER COLUMN completed_action_to_sync_id DROP DEFAULT;
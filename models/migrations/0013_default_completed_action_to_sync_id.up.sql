@@ -0,0 +1,2 @@
+-- Unused, and SQLite doesn't have it, so the shared queries leave it out
+ALTER TABLE devices ALTER COLUMN completed_action_to_sync_id SET DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE todo_items DROP COLUMN created_revision;
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	for _, dialect := range []*Dialect{PostgresDialect, SqliteDialect} {
+		migrations, err := Migrations(dialect)
+		assert.Equal(t, nil, err)
+		assert.NotEqual(t, 0, len(migrations))
+		for i, migration := range migrations {
+			assert.Equal(t, i+1, migration.Version)
+			assert.NotEqual(t, "", strings.TrimSpace(migration.Up))
+			assert.NotEqual(t, "", strings.TrimSpace(migration.Down))
+		}
+	}
+	migrations, _ := Migrations(PostgresDialect)
+	assert.Equal(t, "create_devices_and_todo_items", migrations[0].Name)
+}
+
+func TestMigrationsCreateEveryTableReset(t *testing.T) {
+	for _, dialect := range []*Dialect{PostgresDialect, SqliteDialect} {
+		migrations, err := Migrations(dialect)
+		assert.Equal(t, nil, err)
+		allUps := ""
+		for _, migration := range migrations {
+			allUps += migration.Up
+		}
+		for _, tableName := range append(resetTableNames, "reset_records") {
+			assert.Regexp(t, "CREATE TABLE (IF NOT EXISTS )?"+tableName+" ",
+				allUps)
+		}
+	}
+	migrations, _ := Migrations(PostgresDialect)
+	allUps := ""
+	for _, migration := range migrations {
+		allUps += migration.Up
+	}
+	assert.Contains(t, allUps, "CREATE SEQUENCE todo_revisions_seq")
+}
+
+func TestMigrateUpKeepsDataFromBeforeMigrations(t *testing.T) {
+	creds := testPostgresCredentials(t)
+	db, err := ConnectPostgres(creds)
+	if err != nil {
+		t.Fatalf("Error from ConnectPostgres: %s", err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	if _, err := MigrateUp(ctx, db, PostgresDialect); err != nil {
+		t.Fatalf("Error from MigrateUp: %s", err)
+	}
+	for {
+		reverted, err := MigrateDown(ctx, db, PostgresDialect)
+		if err != nil {
+			t.Fatalf("Error from MigrateDown: %s", err)
+		} else if reverted == nil {
+			break
+		}
+	}
+
+	// The tables as they were made by hand before there were migrations
+	for _, sql := range []string{
+		`CREATE TABLE devices (
+			id SERIAL PRIMARY KEY,
+			uid TEXT NOT NULL UNIQUE,
+			action_to_sync_id_to_output_json TEXT NOT NULL,
+			completed_action_to_sync_id INTEGER NOT NULL
+		);`,
+		`CREATE TABLE todo_items (
+			id SERIAL PRIMARY KEY,
+			title TEXT NOT NULL,
+			completed BOOLEAN NOT NULL
+		);`,
+		`INSERT INTO devices(uid, action_to_sync_id_to_output_json,
+			completed_action_to_sync_id) VALUES('A', '{}', 0);`,
+		`INSERT INTO todo_items(title, completed) VALUES('old', false);`,
+	} {
+		if _, err := db.ExecContext(ctx, sql); err != nil {
+			t.Fatalf("Error from db.Exec with sql=%s: %s", sql, err)
+		}
+	}
+
+	if _, err := MigrateUp(ctx, db, PostgresDialect); err != nil {
+		t.Fatalf("Error from MigrateUp: %s", err)
+	}
+	model := NewDbModel(db)
+	device, err := model.FindDeviceByUid(ctx, "A")
+	assert.Equal(t, nil, err)
+	todos, err := model.ListTodos(ctx, device.UserId)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(todos))
+	assert.Equal(t, "old", todos[0].Title)
+	assert.Equal(t, nil, model.Reset(ctx))
+}
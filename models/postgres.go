@@ -1,21 +1,67 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"log"
+	"time"
 )
 
 type PostgresCredentials struct {
+	// Host is a hostname, or a directory holding a Unix socket
+	Host         *string
 	Username     *string
 	Password     *string
 	DatabaseName *string
 	SSLMode      *string
 }
 
+// MustOpenPostgres connects, then refuses to go on unless every migration
+// has been applied, since the queries assume the latest schema
 func MustOpenPostgres(creds PostgresCredentials) *sql.DB {
+	db := MustConnectPostgres(creds)
+	if err := CheckSchema(context.Background(), db,
+		PostgresDialect); err != nil {
+		log.Fatalf("Error from CheckSchema: %s (run the migrate up command)", err)
+	}
+	return db
+}
+
+// MustConnectPostgres connects without checking the schema, for migrating it
+func MustConnectPostgres(creds PostgresCredentials) *sql.DB {
+	db, err := ConnectPostgres(creds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return db
+}
+
+// ConnectPostgres is MustConnectPostgres that returns errors instead of
+// exiting
+func ConnectPostgres(creds PostgresCredentials) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dataSourceName(creds))
+	if err != nil {
+		return nil, fmt.Errorf("Error from sql.Open: %w", err)
+	}
+
+	// Test out the database connection immediately to check the credentials
+	ignored := 0
+	err = db.QueryRow("SELECT 1").Scan(&ignored)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error from db.QueryRow: %w", err)
+	}
+
+	return db, nil
+}
+
+func dataSourceName(creds PostgresCredentials) string {
 	dataSourceName := ""
+	if creds.Host != nil {
+		dataSourceName += " host=" + *creds.Host
+	}
 	if creds.Username != nil {
 		dataSourceName += " user=" + *creds.Username
 	}
@@ -28,18 +74,68 @@ func MustOpenPostgres(creds PostgresCredentials) *sql.DB {
 	if creds.SSLMode != nil {
 		dataSourceName += " sslmode=" + *creds.SSLMode
 	}
+	return dataSourceName
+}
 
-	db, err := sql.Open("postgres", dataSourceName)
-	if err != nil {
-		log.Fatal(fmt.Errorf("Error from sql.Open: %s", err))
+// ChangesChannel is the channel that DbModel.NotifyChange notifies
+const ChangesChannel = "todomvc_changes"
+
+// ChangeListener gets the payloads sent with DbModel.NotifyChange by every
+// process using the database
+type ChangeListener struct {
+	listener *pq.Listener
+	done     chan struct{}
+}
+
+// ListenForChanges calls onPayload with each payload, in order, from its own
+// goroutine.  If the connection drops, it reconnects and then calls onPayload
+// with a blank payload, since any payloads in between were missed.
+func ListenForChanges(creds PostgresCredentials,
+	onPayload func(payload string)) (*ChangeListener, error) {
+	listener := pq.NewListener(dataSourceName(creds), time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("Error from ChangeListener: %s", err)
+			}
+		})
+	if err := listener.Listen(ChangesChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Error from Listen: %w", err)
 	}
 
-	// Test out the database connection immediately to check the credentials
-	ignored := 0
-	err = db.QueryRow("SELECT 1").Scan(&ignored)
-	if err != nil {
-		log.Fatal(fmt.Errorf("Error from db.QueryRow: %s", err))
+	changeListener := &ChangeListener{
+		listener: listener,
+		done:     make(chan struct{}),
 	}
+	go func() {
+		defer close(changeListener.done)
+		for {
+			select {
+			case notification, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				// nil means the connection was reestablished
+				if notification == nil {
+					onPayload("")
+				} else {
+					onPayload(notification.Extra)
+				}
+			case <-time.After(time.Minute):
+				// Notices a dropped connection sooner
+				go listener.Ping()
+			}
+		}
+	}()
+	return changeListener, nil
+}
 
-	return db
+// Close stops listening, and waits for any onPayload call to return
+func (changeListener *ChangeListener) Close() error {
+	err := changeListener.listener.Close()
+	<-changeListener.done
+	if err != nil {
+		return fmt.Errorf("Error from Close: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,1523 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var SqlErrNoRows = sql.ErrNoRows
+
+// Keys for advisory locks; see withTx and withMigrationTx
+const (
+	todoRevisionsLockKey    = 1
+	schemaMigrationsLockKey = 2
+)
+
+// Selected by queries whose rows are read by scanTodo
+const todoColumns = `id, user_id, title, completed, revision, version,
+	title_version, completed_version, client_updated_at, position, list_id,
+	created_revision`
+
+// Tables emptied by Reset, referencing tables before referenced ones for the
+// foreign keys
+var resetTableNames = []string{
+	"stream_tokens",
+	"todo_changes",
+	"action_events",
+	"deleted_todo_items",
+	"todo_items",
+	"deleted_todo_lists",
+	"list_invites",
+	"list_members",
+	"todo_lists",
+	"devices",
+	"users",
+}
+
+// Dialect is what differs between the databases that DbModel and
+// SqliteModel keep data in, for the functions that work with either
+type Dialect struct {
+	// rebind rewrites the $1-style placeholders in a query, or is nil if the
+	// database takes them as they are
+	rebind func(sql string) string
+	// migrationFiles has a .up.sql and a .down.sql file in migrationsDir for
+	// each migration
+	migrationFiles embed.FS
+	migrationsDir  string
+	// schemaMigrationsSql creates the schema_migrations table, if needed
+	schemaMigrationsSql string
+	// tableExistsSql selects whether there's a table named $1
+	tableExistsSql string
+	// lockSql holds the advisory lock numbered $1 until the transaction
+	// ends, or is blank if transactions exclude each other anyway
+	lockSql string
+	// nextRevisionSql selects the next value of the model-wide change counter
+	nextRevisionSql string
+	// resetSqls start the ids and revisions over after Reset empties the
+	// tables
+	resetSqls []string
+	// replaceTodosSqls keep todos created after ReplaceTodos from reusing the
+	// ids of the todos and tombstones it inserted
+	replaceTodosSqls []string
+}
+
+// conn returns conn with the placeholders in its queries rewritten for the
+// dialect
+func (dialect *Dialect) conn(conn dbOrTx) dbOrTx {
+	if dialect.rebind == nil {
+		return conn
+	}
+	return rebindingConn{conn: conn, rebind: dialect.rebind}
+}
+
+// dbOrTx is satisfied by both *sql.DB and *sql.Tx
+type dbOrTx interface {
+	ExecContext(ctx context.Context, query string,
+		args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string,
+		args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string,
+		args ...interface{}) *sql.Row
+}
+
+type rebindingConn struct {
+	conn   dbOrTx
+	rebind func(sql string) string
+}
+
+func (conn rebindingConn) ExecContext(ctx context.Context, query string,
+	args ...interface{}) (sql.Result, error) {
+	return conn.conn.ExecContext(ctx, conn.rebind(query), args...)
+}
+
+func (conn rebindingConn) QueryContext(ctx context.Context, query string,
+	args ...interface{}) (*sql.Rows, error) {
+	return conn.conn.QueryContext(ctx, conn.rebind(query), args...)
+}
+
+func (conn rebindingConn) QueryRowContext(ctx context.Context, query string,
+	args ...interface{}) *sql.Row {
+	return conn.conn.QueryRowContext(ctx, conn.rebind(query), args...)
+}
+
+// sqlModel has the queries that DbModel and SqliteModel share.  They're
+// written for PostgreSQL, and the dialect adapts them for SQLite.
+type sqlModel struct {
+	db *sql.DB
+	// tx is the transaction if this model was passed to WithTx's fn, or nil
+	tx *sql.Tx
+	// conn is tx, or db outside of a transaction
+	conn    dbOrTx
+	dialect *Dialect
+	// locked is whether tx holds the revisions lock yet; see LockForWrite
+	locked *bool
+}
+
+func newSqlModel(db *sql.DB, tx *sql.Tx, dialect *Dialect) sqlModel {
+	var conn dbOrTx = db
+	if tx != nil {
+		conn = tx
+	}
+	return sqlModel{db: db, tx: tx, conn: dialect.conn(conn), dialect: dialect,
+		locked: new(bool)}
+}
+
+// withTx calls fn with a model for a new transaction, or for the current one
+// if there is one
+func (model *sqlModel) withTx(ctx context.Context,
+	fn func(tx sqlModel) error) error {
+	if model.tx != nil {
+		return fn(*model)
+	}
+
+	tx, err := model.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapDbError(err, "Error from db.BeginTx")
+	}
+	defer func() {
+		// Roll back if fn returned an error or panicked; no-op after Commit
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			log.Printf("Error from tx.Rollback: %s", err)
+		}
+	}()
+
+	txModel := newSqlModel(model.db, tx, model.dialect)
+	if err := fn(txModel); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return wrapDbError(err, "Error from tx.Commit")
+	}
+	return nil
+}
+
+// LockForWrite takes the revisions lock, where the dialect has a lockSql,
+// and holds it until the transaction ends.  Transactions take it before
+// taking a revision, so they commit in revision order, and LatestRevision
+// never passes a revision that could still commit.  Read-only transactions
+// don't take it, so they don't wait for each other or for writes.  Writes
+// that check what they read, like a sync's conflict checks, take it before
+// reading, so their reads can't go stale, and before taking row locks, so
+// transactions don't deadlock over it.
+func (model *sqlModel) LockForWrite(ctx context.Context) error {
+	if model.dialect.lockSql == "" || model.tx == nil || *model.locked {
+		return nil
+	}
+	sql := model.dialect.lockSql
+	if _, err := model.conn.ExecContext(ctx, sql,
+		todoRevisionsLockKey); err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+	}
+	*model.locked = true
+	return nil
+}
+
+func (model *sqlModel) Reset(ctx context.Context) error {
+	if err := model.LockForWrite(ctx); err != nil {
+		return err
+	}
+	for _, tableName := range resetTableNames {
+		if err := model.deleteFrom(ctx, tableName); err != nil {
+			return err
+		}
+	}
+	for _, sql := range model.dialect.resetSqls {
+		if _, err := model.conn.ExecContext(ctx, sql); err != nil {
+			return wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+		}
+	}
+	return nil
+}
+
+func (model *sqlModel) CreateResetRecord(ctx context.Context,
+	adminName string, resetAt time.Time) (ResetRecord, error) {
+	record := ResetRecord{AdminName: adminName, ResetAt: resetAt}
+	sql := `INSERT INTO reset_records(admin_name, reset_at)
+		VALUES($1, $2)
+		RETURNING id;`
+	err := model.conn.QueryRowContext(ctx, sql, adminName,
+		resetAt).Scan(&record.Id)
+	if err != nil {
+		return ResetRecord{}, wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	}
+	return record, nil
+}
+
+func (model *sqlModel) deleteFrom(ctx context.Context, tableName string) error {
+	sql := fmt.Sprintf("DELETE FROM \"%s\"", tableName)
+	_, err := model.conn.ExecContext(ctx, sql)
+	if err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+	}
+	return nil
+}
+
+func (model *sqlModel) FindUserByUid(ctx context.Context,
+	uid string) (User, error) {
+	var user User
+	sql := `SELECT id, uid FROM users WHERE uid = $1;`
+	err := model.conn.QueryRowContext(ctx, sql, uid).Scan(&user.Id, &user.Uid)
+	if err != nil {
+		return User{}, wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	}
+	return user, nil
+}
+
+func (model *sqlModel) CreateUser(ctx context.Context, uid string) (User, error) {
+	// A duplicate uid aborts the surrounding transaction, but the caller has
+	// to give up on it anyway
+	user := User{Uid: uid}
+	sql := `INSERT INTO users(uid) VALUES($1) RETURNING id;`
+	err := model.conn.QueryRowContext(ctx, sql, uid).Scan(&user.Id)
+	if err != nil {
+		return User{}, wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	}
+	return user, nil
+}
+
+func (model *sqlModel) CreateDevice(ctx context.Context, uid string,
+	userId int, tokenHash string) (Device, error) {
+	device := Device{
+		Uid:                    uid,
+		UserId:                 userId,
+		TokenHash:              tokenHash,
+		ActionToSyncIdToOutput: map[int]int{},
+	}
+	sql := `INSERT INTO devices(
+			uid,
+			user_id,
+			token_hash,
+			action_to_sync_id_to_output_json
+		) VALUES(
+			$1,
+			$2,
+			$3,
+			'{}'
+		) RETURNING id;`
+	err := model.conn.QueryRowContext(ctx, sql, uid, userId,
+		nullIfBlank(tokenHash)).Scan(&device.Id)
+	if err != nil {
+		return Device{}, wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	}
+	return device, nil
+}
+
+func (model *sqlModel) FindDeviceByUid(ctx context.Context,
+	uid string) (Device, error) {
+	// Concurrent syncs from the same device don't both apply the same
+	// actions, since their transactions take turns; see withTx
+	sql := `SELECT ` + deviceColumns + `
+		FROM devices
+		WHERE uid = $1;`
+	device, err := scanDevice(model.conn.QueryRowContext(ctx, sql, uid))
+	if err != nil {
+		return Device{}, wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	}
+	return device, nil
+}
+
+func (model *sqlModel) FindDeviceByTokenHash(ctx context.Context,
+	tokenHash string) (Device, error) {
+	sql := `SELECT ` + deviceColumns + `
+		FROM devices
+		WHERE token_hash = $1;`
+	device, err := scanDevice(model.conn.QueryRowContext(ctx, sql, tokenHash))
+	if err != nil {
+		return Device{}, wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	}
+	return device, nil
+}
+
+const deviceColumns = "id, uid, user_id, token_hash, action_to_sync_id_to_output_json"
+
+// Reads a row of the columns in deviceColumns
+func scanDevice(row rowScanner) (Device, error) {
+	var device Device
+	var tokenHash sql.NullString
+	var actionToSyncIdToOutputJson string
+	err := row.Scan(&device.Id, &device.Uid, &device.UserId, &tokenHash,
+		&actionToSyncIdToOutputJson)
+	if err != nil {
+		return Device{}, err
+	}
+	device.TokenHash = tokenHash.String
+
+	var actionToSyncIdToOutput map[string]int
+	if err := json.Unmarshal([]byte(actionToSyncIdToOutputJson),
+		&actionToSyncIdToOutput); err != nil {
+		return Device{}, fmt.Errorf("Error from unmarshaling JSON '%s': %s",
+			actionToSyncIdToOutputJson, err)
+	}
+	device.ActionToSyncIdToOutput, err =
+		mapStringIntToMapIntInt(actionToSyncIdToOutput)
+	if err != nil {
+		return Device{}, err
+	}
+	return device, nil
+}
+
+func (model *sqlModel) UpdateDeviceTokenHash(ctx context.Context, deviceId int,
+	tokenHash string) error {
+	sql := `UPDATE devices SET token_hash = $1 WHERE id = $2;`
+	result, err := model.conn.ExecContext(ctx, sql, nullIfBlank(tokenHash),
+		deviceId)
+	if err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s, id=%d",
+			sql, deviceId)
+	}
+
+	numRowsUpdated, err := convertRowsAffectedToInt(result.RowsAffected())
+	if err != nil {
+		return err
+	} else if numRowsUpdated == 0 {
+		return fmt.Errorf("%w: No device with id=%d", ErrNotFound, deviceId)
+	}
+	return nil
+}
+
+// nullIfBlank stores revoked tokens as NULL, so they don't collide in the
+// unique index on token_hash
+func nullIfBlank(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (model *sqlModel) CreateTodo(ctx context.Context, userId int,
+	action ActionToSync) (Todo, error) {
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return Todo{}, err
+	}
+
+	newTodo := Todo{
+		UserId:           userId,
+		ListId:           listIdOf(action),
+		Title:            *action.Title,
+		Completed:        *action.Completed,
+		Revision:         revision,
+		CreatedRevision:  revision,
+		Version:          1,
+		TitleVersion:     1,
+		CompletedVersion: 1,
+	}
+	if action.ClientTimestamp != nil {
+		newTodo.ClientUpdatedAt = *action.ClientTimestamp
+	}
+	sql := `INSERT INTO todo_items(
+			user_id,
+  		title,
+			completed,
+			revision,
+			version,
+			title_version,
+			completed_version,
+			client_updated_at,
+			position,
+			list_id,
+			created_revision
+		) VALUES(
+			$1,
+			$2,
+			$3,
+			$4,
+			1,
+			1,
+			1,
+			$5,
+			(SELECT COALESCE(MAX(position), 0) FROM todo_items WHERE user_id = $1) + $6,
+			$7,
+			$4
+		) RETURNING id, position;`
+	err = model.conn.QueryRowContext(ctx, sql, newTodo.UserId, newTodo.Title,
+		newTodo.Completed, newTodo.Revision, newTodo.ClientUpdatedAt,
+		TodoPositionGap, newTodo.ListId).Scan(&newTodo.Id, &newTodo.Position)
+	if err != nil {
+		return Todo{}, wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+	}
+	return newTodo, nil
+}
+
+func (model *sqlModel) UpdateDeviceActionToSyncIdToOutputJson(ctx context.Context,
+	device Device) error {
+	actionToSyncIdToOutputJson, err :=
+		json.Marshal(mapIntIntToMapStringInt(device.ActionToSyncIdToOutput))
+	if err != nil {
+		return fmt.Errorf("Error marshaling JSON: %s", err)
+	}
+
+	sql := `UPDATE devices SET
+		  action_to_sync_id_to_output_json = $1
+			WHERE id = $2;`
+	result, err := model.conn.ExecContext(ctx, sql,
+		string(actionToSyncIdToOutputJson), device.Id)
+	if err != nil {
+		return wrapDbError(err, `Error from db.Exec with sql=%s,
+			  action_to_sync_id_to_output_json=%s, id=%d`,
+			sql, string(actionToSyncIdToOutputJson), device.Id)
+	}
+
+	numRowsUpdated, err := convertRowsAffectedToInt(result.RowsAffected())
+	if err != nil {
+		return err
+	} else if numRowsUpdated == 0 {
+		return fmt.Errorf("%w: No device with id=%d", ErrNotFound, device.Id)
+	}
+	return nil
+}
+
+// returns number of rows updated (0 or 1)
+func (model *sqlModel) UpdateTodo(ctx context.Context, userId int,
+	action ActionToSync, todoId int) (int, error) {
+	// On the right side of SET, version is still the old version
+	setSqls := []string{"version = version + 1"}
+	values := []interface{}{todoId, userId} // first values are for WHERE
+	if action.Completed != nil {
+		setSqls = append(setSqls, fmt.Sprintf("completed = $%d", len(values)+1),
+			"completed_version = version + 1")
+		values = append(values, action.Completed)
+	}
+	if action.Title != nil {
+		setSqls = append(setSqls, fmt.Sprintf("title = $%d", len(values)+1),
+			"title_version = version + 1")
+		values = append(values, action.Title)
+	}
+	if action.ClientTimestamp != nil {
+		setSqls = append(setSqls,
+			fmt.Sprintf("client_updated_at = $%d", len(values)+1))
+		values = append(values, action.ClientTimestamp)
+	}
+
+	// Leave the todo alone unless something besides the version would change
+	if len(setSqls) > 1 {
+		revision, err := model.nextRevision(ctx)
+		if err != nil {
+			return 0, err
+		}
+		setSqls = append(setSqls, fmt.Sprintf("revision = $%d", len(values)+1))
+		values = append(values, revision)
+
+		sql := "UPDATE todo_items SET " + strings.Join(setSqls, ", ") +
+			" WHERE id = $1 AND user_id = $2;"
+		result, err := model.conn.ExecContext(ctx, sql, values...)
+		if err != nil {
+			return 0, wrapDbError(err, `Error from db.Exec with sql=%s, values=%v, id=%d`,
+				sql, values, todoId)
+		}
+		return convertRowsAffectedToInt(result.RowsAffected())
+	} else {
+		return 0, nil
+	}
+}
+
+func (model *sqlModel) FindTodoById(ctx context.Context,
+	todoId int) (Todo, error) {
+	sql := `SELECT ` + todoColumns + ` FROM todo_items WHERE id = $1;`
+	todo, err := scanTodo(model.conn.QueryRowContext(ctx, sql, todoId))
+	if err != nil {
+		return Todo{}, wrapDbError(err,
+			"Error from db.QueryRow with sql=%s, id=%d", sql, todoId)
+	}
+	return todo, nil
+}
+
+func (model *sqlModel) FindTodo(ctx context.Context, userId int,
+	todoId int) (Todo, error) {
+	sql := `SELECT ` + todoColumns + `
+		FROM todo_items
+		WHERE id = $1 AND user_id = $2;`
+	todo, err := scanTodo(model.conn.QueryRowContext(ctx, sql, todoId, userId))
+	if err != nil {
+		return Todo{}, wrapDbError(err, "Error from db.QueryRow with sql=%s, id=%d",
+			sql, todoId)
+	}
+	return todo, nil
+}
+
+func (model *sqlModel) ListTodos(ctx context.Context,
+	userId int) ([]Todo, error) {
+	sql := `SELECT ` + todoColumns + ` FROM todo_items
+		WHERE user_id = $1
+		ORDER BY position, id;`
+	return queryTodos(ctx, model.conn, sql, userId)
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Reads a row of the columns in todoColumns
+func scanTodo(row rowScanner) (Todo, error) {
+	var todo Todo
+	err := row.Scan(&todo.Id, &todo.UserId, &todo.Title, &todo.Completed,
+		&todo.Revision, &todo.Version, &todo.TitleVersion, &todo.CompletedVersion,
+		&todo.ClientUpdatedAt, &todo.Position, &todo.ListId,
+		&todo.CreatedRevision)
+	return todo, err
+}
+
+func queryTodos(ctx context.Context, conn dbOrTx, sql string,
+	values ...interface{}) ([]Todo, error) {
+	rows, err := conn.QueryContext(ctx, sql, values...)
+	if err != nil {
+		return nil, wrapDbError(err, "Error from db.Query with sql=%s", sql)
+	}
+	defer rows.Close()
+
+	todos := []Todo{}
+	for rows.Next() {
+		todo, err := scanTodo(rows)
+		if err != nil {
+			return nil, wrapDbError(err, "Error from rows.Scan")
+		}
+		todos = append(todos, todo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDbError(err, "Error from rows.Err")
+	}
+	return todos, nil
+}
+
+func (model *sqlModel) DeleteTodo(ctx context.Context, userId int,
+	todoId int) (int, error) {
+	var listId int
+	sql := `DELETE FROM todo_items WHERE id = $1 AND user_id = $2
+		RETURNING list_id;`
+	err := model.conn.QueryRowContext(ctx, sql, todoId, userId).Scan(&listId)
+	if err == SqlErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, wrapDbError(err, "Error from db.QueryRow with sql=%s, todoId=%d",
+			sql, todoId)
+	}
+
+	// Leave a tombstone only if a row was deleted
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sql = `INSERT INTO deleted_todo_items(id, user_id, revision, list_id)
+		VALUES($1, $2, $3, $4);`
+	if _, err := model.conn.ExecContext(ctx, sql, todoId, userId, revision,
+		listId); err != nil {
+		return 0, wrapDbError(err, "Error from db.Exec with sql=%s, todoId=%d",
+			sql, todoId)
+	}
+	return 1, nil
+}
+
+func (model *sqlModel) MoveTodo(ctx context.Context, userId int,
+	todoId int, position int) (int, error) {
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	sql := `UPDATE todo_items SET position = $1, revision = $2
+		WHERE id = $3 AND user_id = $4;`
+	result, err := model.conn.ExecContext(ctx, sql, position, revision, todoId,
+		userId)
+	if err != nil {
+		return 0, wrapDbError(err, "Error from db.Exec with sql=%s, id=%d", sql,
+			todoId)
+	}
+	return convertRowsAffectedToInt(result.RowsAffected())
+}
+
+func (model *sqlModel) RenumberTodos(ctx context.Context, userId int) error {
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return err
+	}
+	sql := `UPDATE todo_items
+		SET position = ordered.row_number * $1, revision = $2
+		FROM (
+			SELECT id, ROW_NUMBER() OVER (ORDER BY position, id) AS row_number
+			FROM todo_items
+			WHERE user_id = $3
+		) AS ordered
+		WHERE todo_items.id = ordered.id;`
+	if _, err := model.conn.ExecContext(ctx, sql, TodoPositionGap, revision,
+		userId); err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+	}
+	return nil
+}
+
+func (model *sqlModel) SetAllTodosCompleted(ctx context.Context,
+	userId int, action ActionToSync) ([]int, error) {
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// On the right side of SET, version is still the old version
+	sql := `UPDATE todo_items
+		SET completed = $1, version = version + 1,
+			completed_version = version + 1,
+			client_updated_at = COALESCE($2, client_updated_at), revision = $3
+		WHERE user_id = $4 AND completed <> $1
+			AND (CAST($5 AS INTEGER) IS NULL OR list_id = $5)
+		RETURNING id;`
+	return queryIds(ctx, model.conn, sql, *action.Completed,
+		action.ClientTimestamp, revision, userId, action.ListIdMaybeTemp)
+}
+
+func (model *sqlModel) DeleteCompletedTodos(ctx context.Context,
+	userId int, action ActionToSync) ([]int, error) {
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Leave the tombstones first, since SQLite can't DELETE in a WITH
+	sql := `INSERT INTO deleted_todo_items(id, user_id, revision, list_id)
+		SELECT id, user_id, $1, list_id FROM todo_items
+			WHERE user_id = $2 AND completed
+				AND (CAST($3 AS INTEGER) IS NULL OR list_id = $3)
+		RETURNING id;`
+	todoIds, err := queryIds(ctx, model.conn, sql, revision, userId,
+		action.ListIdMaybeTemp)
+	if err != nil {
+		return nil, err
+	}
+	sql = `DELETE FROM todo_items
+		WHERE user_id = $1 AND completed
+			AND (CAST($2 AS INTEGER) IS NULL OR list_id = $2);`
+	if _, err := model.conn.ExecContext(ctx, sql, userId,
+		action.ListIdMaybeTemp); err != nil {
+		return nil, wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+	}
+	return todoIds, nil
+}
+
+// queryIds returns the ids from a query's RETURNING clause, which may come
+// in any order, sorted
+func queryIds(ctx context.Context, conn dbOrTx, sql string,
+	values ...interface{}) ([]int, error) {
+	ids, err := queryInts(ctx, conn, sql, values...)
+	if err != nil {
+		return nil, err
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (model *sqlModel) RestoreTodo(ctx context.Context,
+	todo Todo) (Todo, error) {
+	sql := `DELETE FROM deleted_todo_items WHERE id = $1 AND user_id = $2;`
+	result, err := model.conn.ExecContext(ctx, sql, todo.Id, todo.UserId)
+	if err != nil {
+		return Todo{}, wrapDbError(err, "Error from db.Exec with sql=%s, id=%d",
+			sql, todo.Id)
+	}
+	numRowsDeleted, err := convertRowsAffectedToInt(result.RowsAffected())
+	if err != nil {
+		return Todo{}, err
+	} else if numRowsDeleted == 0 {
+		return Todo{}, fmt.Errorf("%w: No deleted todo with id=%d", ErrNotFound,
+			todo.Id)
+	}
+
+	todo.TitleVersion = todo.Version
+	todo.CompletedVersion = todo.Version
+	todo.Revision, err = model.nextRevision(ctx)
+	if err != nil {
+		return Todo{}, err
+	}
+	todo.CreatedRevision = todo.Revision
+	sql = `INSERT INTO todo_items(` + todoColumns + `)
+		SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, COALESCE(MAX(position), 0) + $10,
+			$11, $5
+			FROM todo_items WHERE user_id = $2
+		RETURNING position;`
+	if err := model.conn.QueryRowContext(ctx, sql, todo.Id, todo.UserId,
+		todo.Title, todo.Completed, todo.Revision, todo.Version,
+		todo.TitleVersion, todo.CompletedVersion, todo.ClientUpdatedAt,
+		TodoPositionGap, todo.ListId).Scan(&todo.Position); err != nil {
+		return Todo{}, wrapDbError(err, "Error from db.Exec with sql=%s, id=%d",
+			sql, todo.Id)
+	}
+	return todo, nil
+}
+
+func (model *sqlModel) ReplaceTodos(ctx context.Context, todos []Todo,
+	deletedTodos []DeletedTodo) error {
+	for _, tableName := range []string{"deleted_todo_items", "todo_items"} {
+		if err := model.deleteFrom(ctx, tableName); err != nil {
+			return err
+		}
+	}
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, todo := range todos {
+		sql := `INSERT INTO todo_items(` + todoColumns + `)
+			VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $5);`
+		if _, err := model.conn.ExecContext(ctx, sql, todo.Id, todo.UserId,
+			todo.Title, todo.Completed, revision, todo.Version, todo.TitleVersion,
+			todo.CompletedVersion, todo.ClientUpdatedAt, todo.Position,
+			todo.ListId); err != nil {
+			return wrapDbError(err, "Error from db.Exec with sql=%s, id=%d",
+				sql, todo.Id)
+		}
+	}
+	for _, deletedTodo := range deletedTodos {
+		sql := `INSERT INTO deleted_todo_items(id, user_id, revision, list_id)
+			VALUES($1, $2, $3, $4);`
+		if _, err := model.conn.ExecContext(ctx, sql, deletedTodo.Id,
+			deletedTodo.UserId, revision, deletedTodo.ListId); err != nil {
+			return wrapDbError(err, "Error from db.Exec with sql=%s, id=%d",
+				sql, deletedTodo.Id)
+		}
+	}
+
+	for _, sql := range model.dialect.replaceTodosSqls {
+		if _, err := model.conn.ExecContext(ctx, sql); err != nil {
+			return wrapDbError(err, "Error from db.Exec with sql=%s", sql)
+		}
+	}
+	return nil
+}
+
+// Selected by queries whose rows are read by scanTodoList
+const todoListColumns = `id, user_id, name, archived, revision`
+
+func scanTodoList(row rowScanner) (TodoList, error) {
+	var list TodoList
+	err := row.Scan(&list.Id, &list.UserId, &list.Name, &list.Archived,
+		&list.Revision)
+	return list, err
+}
+
+func queryTodoLists(ctx context.Context, conn dbOrTx, sql string,
+	values ...interface{}) ([]TodoList, error) {
+	rows, err := conn.QueryContext(ctx, sql, values...)
+	if err != nil {
+		return nil, wrapDbError(err, "Error from db.Query with sql=%s", sql)
+	}
+	defer rows.Close()
+
+	lists := []TodoList{}
+	for rows.Next() {
+		list, err := scanTodoList(rows)
+		if err != nil {
+			return nil, wrapDbError(err, "Error from rows.Scan")
+		}
+		lists = append(lists, list)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDbError(err, "Error from rows.Err")
+	}
+	return lists, nil
+}
+
+func (model *sqlModel) CreateTodoList(ctx context.Context, userId int,
+	action ActionToSync) (TodoList, error) {
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return TodoList{}, err
+	}
+
+	list := TodoList{UserId: userId, Name: *action.Name, Revision: revision}
+	sql := `INSERT INTO todo_lists(user_id, name, revision)
+		VALUES($1, $2, $3)
+		RETURNING id;`
+	err = model.conn.QueryRowContext(ctx, sql, list.UserId, list.Name,
+		list.Revision).Scan(&list.Id)
+	if err != nil {
+		return TodoList{}, wrapDbError(err, "Error from db.QueryRow with sql=%s",
+			sql)
+	}
+
+	sql = `INSERT INTO list_members(list_id, user_id, role, revision)
+		VALUES($1, $2, $3, $4);`
+	if _, err := model.conn.ExecContext(ctx, sql, list.Id, userId, RoleOwner,
+		revision); err != nil {
+		return TodoList{}, wrapDbError(err, "Error from db.Exec with sql=%s, id=%d",
+			sql, list.Id)
+	}
+	return list, nil
+}
+
+func (model *sqlModel) FindTodoListById(ctx context.Context,
+	listId int) (TodoList, error) {
+	sql := `SELECT ` + todoListColumns + ` FROM todo_lists WHERE id = $1;`
+	list, err := scanTodoList(model.conn.QueryRowContext(ctx, sql, listId))
+	if err != nil {
+		return TodoList{}, wrapDbError(err,
+			"Error from db.QueryRow with sql=%s, id=%d", sql, listId)
+	}
+	return list, nil
+}
+
+func (model *sqlModel) FindTodoList(ctx context.Context, userId int,
+	listId int) (TodoList, error) {
+	sql := `SELECT ` + todoListColumns + `
+		FROM todo_lists
+		WHERE id = $1 AND user_id = $2;`
+	list, err := scanTodoList(model.conn.QueryRowContext(ctx, sql, listId,
+		userId))
+	if err != nil {
+		return TodoList{}, wrapDbError(err,
+			"Error from db.QueryRow with sql=%s, id=%d", sql, listId)
+	}
+	return list, nil
+}
+
+func (model *sqlModel) UpdateTodoList(ctx context.Context, userId int,
+	action ActionToSync, listId int) (int, error) {
+	if action.Name == nil && action.Archived == nil {
+		return 0, nil
+	}
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	sql := `UPDATE todo_lists
+		SET name = COALESCE($1, name), archived = COALESCE($2, archived),
+			revision = $3
+		WHERE id = $4 AND user_id = $5;`
+	result, err := model.conn.ExecContext(ctx, sql, action.Name,
+		action.Archived, revision, listId, userId)
+	if err != nil {
+		return 0, wrapDbError(err, "Error from db.Exec with sql=%s, id=%d", sql,
+			listId)
+	}
+	return convertRowsAffectedToInt(result.RowsAffected())
+}
+
+func (model *sqlModel) DeleteTodoList(ctx context.Context, userId int,
+	listId int) (int, error) {
+	if _, err := model.FindTodoList(ctx, userId,
+		listId); errors.Is(err, ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// The other members need tombstones too.  Deleting the list deletes its
+	// list_members and list_invites.
+	for _, sql := range []string{
+		`INSERT INTO deleted_todo_lists(id, user_id, revision)
+			SELECT list_id, user_id, $3 FROM list_members
+			WHERE list_id = $1 AND user_id <> $2;`,
+		`INSERT INTO deleted_todo_lists(id, user_id, revision)
+			VALUES($1, $2, $3);`,
+	} {
+		if _, err := model.conn.ExecContext(ctx, sql, listId, userId,
+			revision); err != nil {
+			return 0, wrapDbError(err, "Error from db.Exec with sql=%s, id=%d", sql,
+				listId)
+		}
+	}
+
+	sql := `DELETE FROM todo_lists WHERE id = $1 AND user_id = $2;`
+	result, err := model.conn.ExecContext(ctx, sql, listId, userId)
+	if err != nil {
+		return 0, wrapDbError(err, "Error from db.Exec with sql=%s, id=%d", sql,
+			listId)
+	}
+	return convertRowsAffectedToInt(result.RowsAffected())
+}
+
+func (model *sqlModel) ListTodoLists(ctx context.Context,
+	userId int) ([]TodoList, error) {
+	sql := `SELECT ` + todoListColumns + ` FROM todo_lists
+		WHERE user_id = $1
+		ORDER BY id;`
+	return queryTodoLists(ctx, model.conn, sql, userId)
+}
+
+// Selected from list_members joined to users by queries whose rows are read
+// by scanListMember
+const listMemberColumns = `list_members.list_id, list_members.user_id,
+	users.uid, list_members.role, list_members.revision`
+
+func scanListMember(row rowScanner) (ListMember, error) {
+	var member ListMember
+	err := row.Scan(&member.ListId, &member.UserId, &member.UserUid,
+		&member.Role, &member.Revision)
+	return member, err
+}
+
+func queryListMembers(ctx context.Context, conn dbOrTx, sql string,
+	values ...interface{}) ([]ListMember, error) {
+	rows, err := conn.QueryContext(ctx, sql, values...)
+	if err != nil {
+		return nil, wrapDbError(err, "Error from db.Query with sql=%s", sql)
+	}
+	defer rows.Close()
+
+	members := []ListMember{}
+	for rows.Next() {
+		member, err := scanListMember(rows)
+		if err != nil {
+			return nil, wrapDbError(err, "Error from rows.Scan")
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDbError(err, "Error from rows.Err")
+	}
+	return members, nil
+}
+
+func (model *sqlModel) FindListMember(ctx context.Context, listId int,
+	userId int) (ListMember, error) {
+	sql := `SELECT ` + listMemberColumns + `
+		FROM list_members JOIN users ON users.id = list_members.user_id
+		WHERE list_members.list_id = $1 AND list_members.user_id = $2;`
+	member, err := scanListMember(model.conn.QueryRowContext(ctx, sql, listId,
+		userId))
+	if err != nil {
+		return ListMember{}, wrapDbError(err,
+			"Error from db.QueryRow with sql=%s, listId=%d", sql, listId)
+	}
+	return member, nil
+}
+
+func (model *sqlModel) ListListMembers(ctx context.Context,
+	listId int) ([]ListMember, error) {
+	sql := `SELECT ` + listMemberColumns + `
+		FROM list_members JOIN users ON users.id = list_members.user_id
+		WHERE list_members.list_id = $1
+		ORDER BY list_members.user_id;`
+	return queryListMembers(ctx, model.conn, sql, listId)
+}
+
+func (model *sqlModel) ListMemberships(ctx context.Context,
+	userId int) ([]ListMember, error) {
+	sql := `SELECT ` + listMemberColumns + `
+		FROM list_members JOIN users ON users.id = list_members.user_id
+		WHERE list_members.user_id = $1
+		ORDER BY list_members.list_id;`
+	return queryListMembers(ctx, model.conn, sql, userId)
+}
+
+func (model *sqlModel) SetListMember(ctx context.Context,
+	member ListMember) error {
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := model.touchTodoList(ctx, member.ListId, revision); err != nil {
+		return err
+	}
+	sql := `INSERT INTO list_members(list_id, user_id, role, revision)
+		VALUES($1, $2, $3, $4)
+		ON CONFLICT (list_id, user_id)
+			DO UPDATE SET role = EXCLUDED.role, revision = EXCLUDED.revision;`
+	if _, err := model.conn.ExecContext(ctx, sql, member.ListId, member.UserId,
+		member.Role, revision); err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s, listId=%d", sql,
+			member.ListId)
+	}
+	// In case they were removed before
+	sql = `DELETE FROM deleted_todo_lists WHERE id = $1 AND user_id = $2;`
+	if _, err := model.conn.ExecContext(ctx, sql, member.ListId,
+		member.UserId); err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s, listId=%d", sql,
+			member.ListId)
+	}
+	return nil
+}
+
+// touchTodoList gives any user's list the revision, or returns ErrNotFound
+func (model *sqlModel) touchTodoList(ctx context.Context, listId int,
+	revision int) error {
+	sql := `UPDATE todo_lists SET revision = $1 WHERE id = $2;`
+	result, err := model.conn.ExecContext(ctx, sql, revision, listId)
+	if err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s, id=%d", sql,
+			listId)
+	}
+	numRowsUpdated, err := convertRowsAffectedToInt(result.RowsAffected())
+	if err != nil {
+		return err
+	} else if numRowsUpdated == 0 {
+		return fmt.Errorf("%w: No list with id=%d", ErrNotFound, listId)
+	}
+	return nil
+}
+
+func (model *sqlModel) DeleteListMember(ctx context.Context, listId int,
+	userId int) (int, error) {
+	sql := `DELETE FROM list_members WHERE list_id = $1 AND user_id = $2;`
+	result, err := model.conn.ExecContext(ctx, sql, listId, userId)
+	if err != nil {
+		return 0, wrapDbError(err, "Error from db.Exec with sql=%s, listId=%d",
+			sql, listId)
+	}
+	numRowsDeleted, err := convertRowsAffectedToInt(result.RowsAffected())
+	if err != nil || numRowsDeleted == 0 {
+		return 0, err
+	}
+
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := model.touchTodoList(ctx, listId, revision); err != nil {
+		return 0, err
+	}
+	sql = `INSERT INTO deleted_todo_lists(id, user_id, revision)
+		VALUES($1, $2, $3);`
+	if _, err := model.conn.ExecContext(ctx, sql, listId, userId,
+		revision); err != nil {
+		return 0, wrapDbError(err, "Error from db.Exec with sql=%s, listId=%d",
+			sql, listId)
+	}
+	return numRowsDeleted, nil
+}
+
+func (model *sqlModel) CreateListInvite(ctx context.Context,
+	invite ListInvite) error {
+	revision, err := model.nextRevision(ctx)
+	if err != nil {
+		return err
+	}
+	if err := model.touchTodoList(ctx, invite.ListId, revision); err != nil {
+		return err
+	}
+
+	sql := `INSERT INTO list_invites(code, list_id, role) VALUES($1, $2, $3);`
+	if _, err := model.conn.ExecContext(ctx, sql, invite.Code, invite.ListId,
+		invite.Role); err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s, listId=%d", sql,
+			invite.ListId)
+	}
+	return nil
+}
+
+// Selected by queries whose rows are read by scanListInvite
+const listInviteColumns = `code, list_id, role`
+
+func scanListInvite(row rowScanner) (ListInvite, error) {
+	var invite ListInvite
+	err := row.Scan(&invite.Code, &invite.ListId, &invite.Role)
+	return invite, err
+}
+
+func queryListInvites(ctx context.Context, conn dbOrTx, sql string,
+	values ...interface{}) ([]ListInvite, error) {
+	rows, err := conn.QueryContext(ctx, sql, values...)
+	if err != nil {
+		return nil, wrapDbError(err, "Error from db.Query with sql=%s", sql)
+	}
+	defer rows.Close()
+
+	invites := []ListInvite{}
+	for rows.Next() {
+		invite, err := scanListInvite(rows)
+		if err != nil {
+			return nil, wrapDbError(err, "Error from rows.Scan")
+		}
+		invites = append(invites, invite)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDbError(err, "Error from rows.Err")
+	}
+	return invites, nil
+}
+
+func (model *sqlModel) ListListInvites(ctx context.Context,
+	listId int) ([]ListInvite, error) {
+	sql := `SELECT ` + listInviteColumns + ` FROM list_invites
+		WHERE list_id = $1
+		ORDER BY code;`
+	return queryListInvites(ctx, model.conn, sql, listId)
+}
+
+func (model *sqlModel) TakeListInvite(ctx context.Context,
+	code string) (ListInvite, error) {
+	sql := `DELETE FROM list_invites WHERE code = $1
+		RETURNING ` + listInviteColumns + `;`
+	invite, err := scanListInvite(model.conn.QueryRowContext(ctx, sql, code))
+	if err != nil {
+		return ListInvite{}, wrapDbError(err, "Error from db.QueryRow with sql=%s",
+			sql)
+	}
+	return invite, nil
+}
+
+func (model *sqlModel) CreateStreamToken(ctx context.Context,
+	token StreamToken) error {
+	sql := `DELETE FROM stream_tokens WHERE device_id = $1;`
+	if _, err := model.conn.ExecContext(ctx, sql, token.DeviceId); err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s, deviceId=%d",
+			sql, token.DeviceId)
+	}
+	sql = `INSERT INTO stream_tokens(token_hash, device_id, issued_at)
+		VALUES($1, $2, $3);`
+	if _, err := model.conn.ExecContext(ctx, sql, token.TokenHash,
+		token.DeviceId, token.IssuedAt); err != nil {
+		return wrapDbError(err, "Error from db.Exec with sql=%s, deviceId=%d",
+			sql, token.DeviceId)
+	}
+	return nil
+}
+
+func (model *sqlModel) TakeStreamToken(ctx context.Context,
+	tokenHash string) (StreamToken, error) {
+	sql := `DELETE FROM stream_tokens WHERE token_hash = $1
+		RETURNING token_hash, device_id, issued_at;`
+	var token StreamToken
+	if err := model.conn.QueryRowContext(ctx, sql, tokenHash).Scan(
+		&token.TokenHash, &token.DeviceId, &token.IssuedAt); err != nil {
+		return StreamToken{}, wrapDbError(err,
+			"Error from db.QueryRow with sql=%s", sql)
+	}
+	return token, nil
+}
+
+// Selected by queries whose rows are read by scanActionEvent
+const actionEventColumns = `id, user_id, device_id, todo_id, payload_json,
+	server_time, output`
+
+// Reads a row of the columns in actionEventColumns
+func scanActionEvent(row rowScanner) (ActionEvent, error) {
+	var event ActionEvent
+	var payloadJson string
+	err := row.Scan(&event.Id, &event.UserId, &event.DeviceId, &event.TodoId,
+		&payloadJson, &event.ServerTime, &event.Output)
+	if err != nil {
+		return ActionEvent{}, err
+	}
+	if err := json.Unmarshal([]byte(payloadJson), &event.Action); err != nil {
+		return ActionEvent{}, fmt.Errorf("Error parsing payload_json of event %d: %w",
+			event.Id, err)
+	}
+	return event, nil
+}
+
+func queryActionEvents(ctx context.Context, conn dbOrTx, sql string,
+	values ...interface{}) ([]ActionEvent, error) {
+	rows, err := conn.QueryContext(ctx, sql, values...)
+	if err != nil {
+		return nil, wrapDbError(err, "Error from db.Query with sql=%s", sql)
+	}
+	defer rows.Close()
+
+	events := []ActionEvent{}
+	for rows.Next() {
+		event, err := scanActionEvent(rows)
+		if err != nil {
+			return nil, wrapDbError(err, "Error from rows.Scan")
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDbError(err, "Error from rows.Err")
+	}
+	return events, nil
+}
+
+func (model *sqlModel) CreateActionEvent(ctx context.Context,
+	event ActionEvent) (ActionEvent, error) {
+	payloadJson, err := json.Marshal(event.Action)
+	if err != nil {
+		return ActionEvent{}, fmt.Errorf("Error marshaling JSON: %w", err)
+	}
+
+	sql := `INSERT INTO action_events(user_id, device_id, action_to_sync_id,
+			type, todo_id, payload_json, server_time, output)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id;`
+	err = model.conn.QueryRowContext(ctx, sql, event.UserId, event.DeviceId,
+		event.Action.Id, event.Action.Type, event.TodoId, string(payloadJson),
+		event.ServerTime, event.Output).Scan(&event.Id)
+	if err != nil {
+		return ActionEvent{}, wrapDbError(err, "Error from db.QueryRow with sql=%s",
+			sql)
+	}
+	return event, nil
+}
+
+func (model *sqlModel) ListActionEvents(
+	ctx context.Context) ([]ActionEvent, error) {
+	sql := `SELECT ` + actionEventColumns + ` FROM action_events ORDER BY id;`
+	return queryActionEvents(ctx, model.conn, sql)
+}
+
+// Selected by queries whose rows are read by scanTodoChange
+const todoChangeColumns = `id, user_id, todo_id, device_id, action_to_sync_id,
+	type, title, completed, server_time, list_id`
+
+// Reads a row of the columns in todoChangeColumns
+func scanTodoChange(row rowScanner) (TodoChange, error) {
+	var change TodoChange
+	var title sql.NullString
+	var completed sql.NullBool
+	err := row.Scan(&change.Id, &change.UserId, &change.TodoId, &change.DeviceId,
+		&change.ActionToSyncId, &change.Type, &title, &completed,
+		&change.ServerTime, &change.ListId)
+	if err != nil {
+		return TodoChange{}, err
+	}
+	if title.Valid {
+		change.Title = &title.String
+	}
+	if completed.Valid {
+		change.Completed = &completed.Bool
+	}
+	return change, nil
+}
+
+func queryTodoChanges(ctx context.Context, conn dbOrTx, sql string,
+	values ...interface{}) ([]TodoChange, error) {
+	rows, err := conn.QueryContext(ctx, sql, values...)
+	if err != nil {
+		return nil, wrapDbError(err, "Error from db.Query with sql=%s", sql)
+	}
+	defer rows.Close()
+
+	changes := []TodoChange{}
+	for rows.Next() {
+		change, err := scanTodoChange(rows)
+		if err != nil {
+			return nil, wrapDbError(err, "Error from rows.Scan")
+		}
+		changes = append(changes, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDbError(err, "Error from rows.Err")
+	}
+	return changes, nil
+}
+
+func (model *sqlModel) CreateTodoChange(ctx context.Context,
+	change TodoChange) (TodoChange, error) {
+	sql := `INSERT INTO todo_changes(user_id, todo_id, device_id,
+			action_to_sync_id, type, title, completed, server_time, list_id)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id;`
+	err := model.conn.QueryRowContext(ctx, sql, change.UserId, change.TodoId,
+		change.DeviceId, change.ActionToSyncId, change.Type, change.Title,
+		change.Completed, change.ServerTime, change.ListId).Scan(&change.Id)
+	if err != nil {
+		return TodoChange{}, wrapDbError(err, "Error from db.QueryRow with sql=%s",
+			sql)
+	}
+	return change, nil
+}
+
+func (model *sqlModel) ListTodoChangesByAction(ctx context.Context,
+	deviceId int, actionToSyncId int) ([]TodoChange, error) {
+	sql := `SELECT ` + todoChangeColumns + ` FROM todo_changes
+		WHERE device_id = $1 AND action_to_sync_id = $2
+		ORDER BY id;`
+	return queryTodoChanges(ctx, model.conn, sql, deviceId, actionToSyncId)
+}
+
+func (model *sqlModel) ListTodoChanges(ctx context.Context, userId int,
+	todoId int) ([]TodoChange, error) {
+	sql := `SELECT ` + todoChangeColumns + ` FROM todo_changes
+		WHERE user_id = $1 AND todo_id = $2
+		ORDER BY id;`
+	return queryTodoChanges(ctx, model.conn, sql, userId, todoId)
+}
+
+// Takes the next value of the model-wide change counter.  Callers are in a
+// WithTx transaction, which holds the revisions lock from here until it ends,
+// keeping revisions in order; see LockForWrite.
+func (model *sqlModel) nextRevision(ctx context.Context) (int, error) {
+	if err := model.LockForWrite(ctx); err != nil {
+		return 0, err
+	}
+	var revision int
+	sql := model.dialect.nextRevisionSql
+	if err := model.conn.QueryRowContext(ctx, sql).Scan(&revision); err != nil {
+		return 0, wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	}
+	return revision, nil
+}
+
+func (model *sqlModel) LatestRevision(ctx context.Context) (int, error) {
+	var revision int
+	sql := `SELECT COALESCE(MAX(revision), 0) FROM (
+			SELECT MAX(revision) AS revision FROM todo_items
+			UNION ALL SELECT MAX(revision) FROM deleted_todo_items
+			UNION ALL SELECT MAX(revision) FROM todo_lists
+			UNION ALL SELECT MAX(revision) FROM deleted_todo_lists
+		) AS revisions;`
+	if err := model.conn.QueryRowContext(ctx, sql).Scan(&revision); err != nil {
+		return 0, wrapDbError(err, "Error from db.QueryRow with sql=%s", sql)
+	}
+	return revision, nil
+}
+
+func (model *sqlModel) ListChangesSince(ctx context.Context, userId int,
+	revision int) (Changes, error) {
+	// Read the latest revision first and ignore anything newer, in case more
+	// changes commit between the queries below
+	latestRevision, err := model.LatestRevision(ctx)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	sql := `SELECT ` + todoColumns + `
+		FROM todo_items
+		WHERE user_id = $1 AND revision > $2 AND revision <= $3
+		ORDER BY id;`
+	todos, err := queryTodos(ctx, model.conn, sql, userId, revision,
+		latestRevision)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	sql = `SELECT id
+		FROM deleted_todo_items
+		WHERE user_id = $1 AND revision > $2 AND revision <= $3
+		ORDER BY id;`
+	deletedTodoIds, err := queryInts(ctx, model.conn, sql, userId, revision,
+		latestRevision)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	sql = `SELECT ` + todoListColumns + `
+		FROM todo_lists
+		WHERE user_id = $1 AND revision > $2 AND revision <= $3
+		ORDER BY id;`
+	lists, err := queryTodoLists(ctx, model.conn, sql, userId, revision,
+		latestRevision)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	sql = `SELECT id
+		FROM deleted_todo_lists
+		WHERE user_id = $1 AND revision > $2 AND revision <= $3
+		ORDER BY id;`
+	deletedListIds, err := queryInts(ctx, model.conn, sql, userId, revision,
+		latestRevision)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	return Changes{
+		Todos:          todos,
+		DeletedTodoIds: deletedTodoIds,
+		Lists:          lists,
+		DeletedListIds: deletedListIds,
+		Revision:       latestRevision,
+	}, nil
+}
+
+func (model *sqlModel) ListChangesInListSince(ctx context.Context,
+	listId int, revision int) (Changes, error) {
+	latestRevision, err := model.LatestRevision(ctx)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	sql := `SELECT ` + todoColumns + `
+		FROM todo_items
+		WHERE list_id = $1 AND revision > $2 AND revision <= $3
+		ORDER BY id;`
+	todos, err := queryTodos(ctx, model.conn, sql, listId, revision,
+		latestRevision)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	sql = `SELECT id
+		FROM deleted_todo_items
+		WHERE list_id = $1 AND revision > $2 AND revision <= $3
+		ORDER BY id;`
+	deletedTodoIds, err := queryInts(ctx, model.conn, sql, listId, revision,
+		latestRevision)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	sql = `SELECT ` + todoListColumns + `
+		FROM todo_lists
+		WHERE id = $1 AND revision > $2 AND revision <= $3;`
+	lists, err := queryTodoLists(ctx, model.conn, sql, listId, revision,
+		latestRevision)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	return Changes{
+		Todos:          todos,
+		DeletedTodoIds: deletedTodoIds,
+		Lists:          lists,
+		DeletedListIds: []int{},
+		Revision:       latestRevision,
+	}, nil
+}
+
+// Reads the first column of every row, which must be an integer
+func queryInts(ctx context.Context, conn dbOrTx, sql string,
+	values ...interface{}) ([]int, error) {
+	rows, err := conn.QueryContext(ctx, sql, values...)
+	if err != nil {
+		return nil, wrapDbError(err, "Error from db.Query with sql=%s", sql)
+	}
+	defer rows.Close()
+
+	ints := []int{}
+	for rows.Next() {
+		var i int
+		if err := rows.Scan(&i); err != nil {
+			return nil, wrapDbError(err, "Error from rows.Scan")
+		}
+		ints = append(ints, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapDbError(err, "Error from rows.Err")
+	}
+	return ints, nil
+}
+
+// Adds context to an error from database/sql or a driver, wrapping the
+// matching sentinel from errors.go so callers can check it with errors.Is
+func wrapDbError(err error, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	if kind := kindOfDbError(err); kind != nil {
+		return fmt.Errorf("%w: %s: %s", kind, message, err)
+	} else {
+		return fmt.Errorf("%s: %w", message, err)
+	}
+}
+
+// Return the kind of their driver's errors, for kindOfDbError;
+// sqlite_driver.go adds SQLite's when it's built in
+var kindOfDriverErrors = []func(error) error{kindOfPqError}
+
+// Returns ErrNotFound, ErrConflict, ErrUnavailable, or nil if unknown
+func kindOfDbError(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+
+	if err == driver.ErrBadConn || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrUnavailable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrUnavailable
+	}
+
+	// Each driver's errors are a different type, so at most one knows it
+	for _, kindOfDriverError := range kindOfDriverErrors {
+		if kind := kindOfDriverError(err); kind != nil {
+			return kind
+		}
+	}
+	return nil
+}
+
+func mapIntIntToMapStringInt(input map[int]int) map[string]int {
+	output := map[string]int{}
+	for k, v := range input {
+		output[strconv.Itoa(k)] = v
+	}
+	return output
+}
+
+func mapStringIntToMapIntInt(input map[string]int) (map[int]int, error) {
+	output := map[int]int{}
+	for kString, v := range input {
+		kInt, err := strconv.Atoi(kString)
+		if err != nil {
+			return nil, fmt.Errorf("Error from strconv.Atoi for '%s': %s", kString, err)
+		}
+		output[kInt] = v
+	}
+	return output, nil
+}
+
+func convertRowsAffectedToInt(i int64, err error) (int, error) {
+	if err != nil {
+		return 0, wrapDbError(err, "Error from RowsAffected()")
+	}
+
+	if int64(int(i)) == i { // if round-trip conversion succeeds
+		return int(i), nil
+	} else {
+		return 0, fmt.Errorf("Couldn't convert int64 %d to int", i)
+	}
+}
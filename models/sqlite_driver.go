@@ -0,0 +1,32 @@
+//go:build sqlite
+// +build sqlite
+
+package models
+
+import (
+	"errors"
+	"github.com/mattn/go-sqlite3"
+)
+
+// The driver needs cgo, so only binaries built with the sqlite tag have it
+func init() {
+	sqliteBuiltIn = true
+	kindOfDriverErrors = append(kindOfDriverErrors, kindOfSqliteError)
+}
+
+// Returns the kind of a go-sqlite3 error, or nil if it isn't one or is
+// unknown
+func kindOfSqliteError(err error) error {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		if sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return ErrConflict
+		}
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrFull, sqlite3.ErrIoErr:
+			return ErrUnavailable
+		}
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+DROP TABLE reset_records;
+DROP TABLE todo_revisions;
+DROP TABLE deleted_todo_items;
+DROP TABLE todo_items;
+DROP TABLE devices;
+DROP TABLE users;
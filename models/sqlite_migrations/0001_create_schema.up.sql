@@ -0,0 +1,50 @@
+CREATE TABLE users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  uid TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE devices (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  uid TEXT NOT NULL UNIQUE,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  -- NULL once revoked; UNIQUE allows any number of NULLs
+  token_hash TEXT UNIQUE,
+  action_to_sync_id_to_output_json TEXT NOT NULL
+);
+
+CREATE TABLE todo_items (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  title TEXT NOT NULL,
+  completed BOOLEAN NOT NULL,
+  revision INTEGER NOT NULL,
+  version INTEGER NOT NULL,
+  title_version INTEGER NOT NULL,
+  completed_version INTEGER NOT NULL,
+  client_updated_at INTEGER NOT NULL
+);
+CREATE INDEX todo_items_user_id_revision_idx ON todo_items (user_id, revision);
+-- For the latest revision
+CREATE INDEX todo_items_revision_idx ON todo_items (revision);
+
+-- Tombstones for deleted todos, so delta syncs can report them
+CREATE TABLE deleted_todo_items (
+  id INTEGER PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  revision INTEGER NOT NULL
+);
+CREATE INDEX deleted_todo_items_user_id_revision_idx
+  ON deleted_todo_items (user_id, revision);
+CREATE INDEX deleted_todo_items_revision_idx ON deleted_todo_items (revision);
+
+-- One row, standing in for Postgres's todo_revisions_seq
+CREATE TABLE todo_revisions (
+  latest INTEGER NOT NULL
+);
+INSERT INTO todo_revisions (latest) VALUES (0);
+
+CREATE TABLE reset_records (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  admin_name TEXT NOT NULL,
+  reset_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE action_events;
@@ -0,0 +1,14 @@
+-- Every change to a todo's fields, and its deletion, for auditing.  todo_id
+-- has no foreign key since the todo may since have been deleted.
+CREATE TABLE todo_changes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  todo_id INTEGER NOT NULL,
+  device_id INTEGER NOT NULL REFERENCES devices (id),
+  action_to_sync_id INTEGER NOT NULL,
+  type TEXT NOT NULL,
+  title TEXT,
+  completed BOOLEAN,
+  server_time TIMESTAMP NOT NULL
+);
+CREATE INDEX todo_changes_todo_id ON todo_changes (todo_id);
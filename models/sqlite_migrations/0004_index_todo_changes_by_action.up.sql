@@ -0,0 +1,4 @@
+-- TODOS/UNDO looks changes up by the action that made them; bulk actions
+-- make many
+CREATE INDEX todo_changes_device_id_action_to_sync_id
+  ON todo_changes (device_id, action_to_sync_id);
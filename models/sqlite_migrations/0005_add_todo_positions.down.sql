@@ -0,0 +1,2 @@
+DROP INDEX todo_items_user_id_position;
+ALTER TABLE todo_items DROP COLUMN position;
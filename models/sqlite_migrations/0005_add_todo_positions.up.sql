@@ -0,0 +1,5 @@
+-- Todos are listed by position, which starts out in the order they were
+-- created; see TodoPositionGap
+ALTER TABLE todo_items ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
+UPDATE todo_items SET position = id * 1024;
+CREATE INDEX todo_items_user_id_position ON todo_items (user_id, position);
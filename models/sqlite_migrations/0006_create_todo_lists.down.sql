@@ -0,0 +1,4 @@
+ALTER TABLE todo_changes DROP COLUMN list_id;
+ALTER TABLE todo_items DROP COLUMN list_id;
+DROP TABLE deleted_todo_lists;
+DROP TABLE todo_lists;
@@ -0,0 +1,23 @@
+DROP INDEX todo_items_list_id_revision_idx;
+DROP INDEX deleted_todo_items_list_id_revision_idx;
+ALTER TABLE deleted_todo_items DROP COLUMN list_id;
+
+-- Keep one tombstone per deleted list, as a copy of the table since SQLite
+-- can't change a primary key
+CREATE TABLE deleted_todo_lists_old (
+  id INTEGER PRIMARY KEY,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  revision INTEGER NOT NULL
+);
+INSERT INTO deleted_todo_lists_old SELECT id, user_id, revision
+  FROM deleted_todo_lists
+  WHERE user_id = (SELECT MIN(user_id) FROM deleted_todo_lists AS other
+    WHERE other.id = deleted_todo_lists.id);
+DROP TABLE deleted_todo_lists;
+ALTER TABLE deleted_todo_lists_old RENAME TO deleted_todo_lists;
+CREATE INDEX deleted_todo_lists_user_id_revision_idx
+  ON deleted_todo_lists (user_id, revision);
+CREATE INDEX deleted_todo_lists_revision_idx ON deleted_todo_lists (revision);
+
+DROP TABLE list_invites;
+DROP TABLE list_members;
@@ -0,0 +1,42 @@
+-- Users a list is shared with, and their roles: 'owner', 'editor' or
+-- 'viewer'.  The list's todos still belong to its owner, who is also a member.
+CREATE TABLE list_members (
+  list_id INTEGER NOT NULL REFERENCES todo_lists (id) ON DELETE CASCADE,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  role TEXT NOT NULL,
+  revision INTEGER NOT NULL,
+  PRIMARY KEY (list_id, user_id)
+);
+CREATE INDEX list_members_user_id_idx ON list_members (user_id);
+INSERT INTO list_members (list_id, user_id, role, revision)
+  SELECT id, user_id, 'owner', revision FROM todo_lists;
+
+-- Each code lets one user join the list
+CREATE TABLE list_invites (
+  code TEXT PRIMARY KEY,
+  list_id INTEGER NOT NULL REFERENCES todo_lists (id) ON DELETE CASCADE,
+  role TEXT NOT NULL
+);
+CREATE INDEX list_invites_list_id_idx ON list_invites (list_id);
+
+-- A deleted list leaves a tombstone for each of its members.  SQLite can't
+-- change a primary key, so copy the table.
+CREATE TABLE deleted_todo_lists_new (
+  id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL REFERENCES users (id),
+  revision INTEGER NOT NULL,
+  PRIMARY KEY (id, user_id)
+);
+INSERT INTO deleted_todo_lists_new SELECT id, user_id, revision
+  FROM deleted_todo_lists;
+DROP TABLE deleted_todo_lists;
+ALTER TABLE deleted_todo_lists_new RENAME TO deleted_todo_lists;
+CREATE INDEX deleted_todo_lists_user_id_revision_idx
+  ON deleted_todo_lists (user_id, revision);
+CREATE INDEX deleted_todo_lists_revision_idx ON deleted_todo_lists (revision);
+
+-- So members can find out about deletions in the lists shared with them
+ALTER TABLE deleted_todo_items ADD COLUMN list_id INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX deleted_todo_items_list_id_revision_idx
+  ON deleted_todo_items (list_id, revision);
+CREATE INDEX todo_items_list_id_revision_idx ON todo_items (list_id, revision);
@@ -0,0 +1,4 @@
+-- The revision when each todo was created, so syncs since a cursor can tell
+-- new todos from updated ones.  Existing todos count as created before every
+-- cursor.
+ALTER TABLE todo_items ADD COLUMN created_revision INTEGER NOT NULL DEFAULT 0;
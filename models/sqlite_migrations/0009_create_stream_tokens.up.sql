@@ -0,0 +1,9 @@
+-- Short-lived, single-use tokens for opening event streams, since browsers
+-- can only pass them in the URL; see StreamToken
+CREATE TABLE stream_tokens (
+  token_hash TEXT PRIMARY KEY,
+  device_id INTEGER NOT NULL REFERENCES devices (id) ON DELETE CASCADE,
+  issued_at TIMESTAMP NOT NULL
+);
+-- Each device has at most one
+CREATE UNIQUE INDEX stream_tokens_device_id_idx ON stream_tokens (device_id);
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ErrSqliteNotBuiltIn is returned by ConnectSqlite in binaries built without
+// the sqlite tag, which leaves out the driver, since it needs cgo
+var ErrSqliteNotBuiltIn = errors.New(
+	"Built without SQLite; rebuild with -tags sqlite")
+
+// sqliteBuiltIn is set by sqlite_driver.go, which the sqlite tag builds
+var sqliteBuiltIn = false
+
+// SQLite's migrations; see SqliteDialect
+//
+//go:embed sqlite_migrations/*.sql
+var sqliteMigrationFiles embed.FS
+
+// Like $1, which SQLite would take as a parameter named "$1", numbered in
+// order of first appearance instead of by its digits
+var postgresPlaceholderRegexp = regexp.MustCompile(`\$([0-9]+)`)
+
+// SqliteDialect is for databases opened with ConnectSqlite
+var SqliteDialect = &Dialect{
+	rebind: func(sql string) string {
+		return postgresPlaceholderRegexp.ReplaceAllString(sql, "?$1")
+	},
+	migrationFiles: sqliteMigrationFiles,
+	migrationsDir:  "sqlite_migrations",
+	schemaMigrationsSql: `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		);`,
+	tableExistsSql: `SELECT EXISTS (
+			SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = $1
+		);`,
+	// Every transaction begins immediate, so only one at a time can write
+	lockSql: "",
+	nextRevisionSql: `UPDATE todo_revisions SET latest = latest + 1
+		RETURNING latest;`,
+	resetSqls: []string{
+		// Restart the AUTOINCREMENT ids
+		`DELETE FROM sqlite_sequence
+			WHERE name IN ('todo_items', 'devices', 'users', 'action_events',
+				'todo_changes', 'todo_lists');`,
+		`UPDATE todo_revisions SET latest = 0;`,
+	},
+	// Inserting ids into todo_items keeps AUTOINCREMENT above them, but not
+	// above the tombstones' ids
+	replaceTodosSqls: []string{
+		`UPDATE sqlite_sequence
+			SET seq = MAX(seq, (SELECT COALESCE(MAX(id), 0) FROM deleted_todo_items))
+			WHERE name = 'todo_items';`,
+		`INSERT INTO sqlite_sequence(name, seq)
+			SELECT 'todo_items', MAX(id) FROM deleted_todo_items
+			HAVING MAX(id) IS NOT NULL AND NOT EXISTS (
+				SELECT 1 FROM sqlite_sequence WHERE name = 'todo_items');`,
+	},
+}
+
+// SqliteModel stores everything in a SQLite file, for durable storage without
+// a Postgres server.  SQLite allows only one writer at a time, so it uses a
+// single connection; transactions take turns like MemoryModel's.
+type SqliteModel struct {
+	sqlModel
+}
+
+// ConnectSqlite opens (or creates) the database file without checking the
+// schema, for migrating it.  A filename of ":memory:" keeps everything in
+// memory.
+func ConnectSqlite(filename string) (*sql.DB, error) {
+	if !sqliteBuiltIn {
+		return nil, ErrSqliteNotBuiltIn
+	}
+	db, err := sql.Open("sqlite3", "file:"+filename+
+		"?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("Error from sql.Open: %w", err)
+	}
+	// Every connection to an in-memory database would get its own empty one,
+	// and a file only allows one writer anyway
+	db.SetMaxOpenConns(1)
+
+	ignored := 0
+	if err := db.QueryRow("SELECT 1").Scan(&ignored); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error from db.QueryRow: %w", err)
+	}
+	return db, nil
+}
+
+// OpenSqliteModel connects to the database file, then refuses to go on
+// unless every migration has been applied, like MustOpenPostgres
+func OpenSqliteModel(filename string) (*SqliteModel, error) {
+	db, err := ConnectSqlite(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckSchema(context.Background(), db,
+		SqliteDialect); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error from CheckSchema: %w", err)
+	}
+	return NewSqliteModel(db), nil
+}
+
+// NewSqliteModel uses a database from ConnectSqlite
+func NewSqliteModel(db *sql.DB) *SqliteModel {
+	return &SqliteModel{newSqlModel(db, nil, SqliteDialect)}
+}
+
+func (model *SqliteModel) Close() error {
+	return model.db.Close()
+}
+
+func (model *SqliteModel) WithTx(ctx context.Context,
+	fn func(tx Model) error) error {
+	return model.withTx(ctx, func(tx sqlModel) error {
+		return fn(&SqliteModel{tx})
+	})
+}
@@ -0,0 +1,106 @@
+//go:build sqlite
+// +build sqlite
+
+package models
+
+import (
+	"context"
+	"errors"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSqliteModel returns a model for a migrated in-memory database
+func newTestSqliteModel(t *testing.T) *SqliteModel {
+	db, err := ConnectSqlite(":memory:")
+	if err != nil {
+		t.Fatalf("Error from ConnectSqlite: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := MigrateUp(context.Background(), db, SqliteDialect); err != nil {
+		t.Fatalf("Error from MigrateUp: %s", err)
+	}
+	return NewSqliteModel(db)
+}
+
+func TestSqliteModelConformance(t *testing.T) {
+	testModelConformance(t, func(t *testing.T) Model {
+		return newTestSqliteModel(t)
+	})
+}
+
+func TestSqliteModelKeepsDataAfterReopening(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite_model_test")
+	if err != nil {
+		t.Fatalf("Error from TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "todomvc.sqlite3")
+
+	// Like MustOpenPostgres, refuses to use the database until it's migrated
+	_, err = OpenSqliteModel(filename)
+	assert.Equal(t, true, errors.Is(err, ErrSchemaOutOfDate))
+	ctx := context.Background()
+	db, err := ConnectSqlite(filename)
+	assert.Equal(t, nil, err)
+	_, err = MigrateUp(ctx, db, SqliteDialect)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, db.Close())
+
+	model, err := OpenSqliteModel(filename)
+	assert.Equal(t, nil, err)
+	user, _ := model.CreateUser(ctx, "U")
+	model.CreateTodo(ctx, user.Id, ActionToSync{
+		Title:     pointToString("t"),
+		Completed: pointToBool(false),
+	})
+	assert.Equal(t, nil, model.Close())
+
+	model, err = OpenSqliteModel(filename)
+	assert.Equal(t, nil, err)
+	defer model.Close()
+	todos, err := model.ListTodos(ctx, user.Id)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(todos))
+}
+
+func TestSqliteMigrateDownAndUp(t *testing.T) {
+	model := newTestSqliteModel(t)
+	ctx := context.Background()
+	migrations, _ := Migrations(SqliteDialect)
+	for range migrations {
+		reverted, err := MigrateDown(ctx, model.db, SqliteDialect)
+		assert.Equal(t, nil, err)
+		assert.NotEqual(t, (*Migration)(nil), reverted)
+	}
+	reverted, err := MigrateDown(ctx, model.db, SqliteDialect)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*Migration)(nil), reverted)
+
+	applied, err := MigrateUp(ctx, model.db, SqliteDialect)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(migrations), len(applied))
+	assert.Equal(t, nil, CheckSchema(ctx, model.db, SqliteDialect))
+	statuses, err := ListMigrationStatuses(ctx, model.db, SqliteDialect)
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, (*time.Time)(nil), statuses[0].AppliedAt)
+}
+
+func TestKindOfSqliteError(t *testing.T) {
+	assert.Equal(t, ErrConflict, kindOfDbError(sqlite3.Error{
+		Code:         sqlite3.ErrConstraint,
+		ExtendedCode: sqlite3.ErrConstraintUnique,
+	}))
+	assert.Equal(t, ErrUnavailable, kindOfDbError(sqlite3.Error{
+		Code: sqlite3.ErrBusy,
+	}))
+	assert.Equal(t, nil, kindOfDbError(sqlite3.Error{
+		Code:         sqlite3.ErrConstraint,
+		ExtendedCode: sqlite3.ErrConstraintNotNull,
+	}))
+}
@@ -1,3 +1,3 @@
 #!/bin/bash -ex
 go install
-$GOPATH/bin/todomvc-backend-go -in_memory_db -socket_path '/tmp/echo.sock'
+$GOPATH/bin/todomvc-backend-go -in_memory_db -test_mode -socket_path '/tmp/echo.sock'
@@ -2,93 +2,298 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/danielstutzman/todomvc-backend-go/handlers"
 	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/gorilla/websocket"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-func mustRunWebServer(model models.Model) {
+func mustRunWebServer(model models.Model, config handlers.Config,
+	requestTimeout time.Duration) {
+	// Push connections outlive Shutdown, which doesn't wait for hijacked
+	// connections, so they're closed separately.  Waiting sync requests stop
+	// too, rather than hold up Shutdown.
+	pushCtx, stopPushes := context.WithCancel(context.Background())
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		handleRequest(w, r, model)
+		handleRequest(w, r, pushCtx, model, config, requestTimeout)
 	})
+	http.HandleFunc("/admin/reset", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminResetRequest(w, r, model, config, requestTimeout)
+	})
+	http.HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
+		handlePushRequest(w, r, pushCtx, model, config, requestTimeout,
+			pushPingInterval)
+	})
+	http.HandleFunc("/events/token", func(w http.ResponseWriter,
+		r *http.Request) {
+		handleStreamTokenRequest(w, r, model, requestTimeout)
+	})
+	http.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		handleEventsRequest(w, r, pushCtx, model, config, requestTimeout,
+			pushPingInterval)
+	})
+	server := &http.Server{Addr: ":3000"}
+	server.RegisterOnShutdown(stopPushes)
+
+	// Stop accepting and let in-flight requests finish, so main can close the
+	// model cleanly
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	shutDown := make(chan struct{})
+	go func() {
+		sig := <-sigc
+		log.Printf("Caught signal %s: shutting down.", sig)
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Error from Shutdown: %s", err)
+		}
+		close(shutDown)
+	}()
+
 	log.Printf("Listening on :3000...")
-	err := http.ListenAndServe(":3000", nil)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
 		log.Fatalf("Error from ListenAndServe: %s", err)
 	}
+	// ListenAndServe returns as soon as Shutdown starts
+	<-shutDown
+	log.Printf("Shut down.")
 }
 
-func mustRunSocketServer(socketPath string, model models.Model) {
+func mustRunSocketServer(socketPath string, model models.Model,
+	config handlers.Config, requestTimeout time.Duration,
+	idleTimeout time.Duration, maxLineBytes int) {
 	log.Printf("Listening on %s...", socketPath)
-	l, err := net.Listen("unix", socketPath)
+	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
 		log.Fatal("listen error:", err)
 	}
-	defer l.Close()
 
-	// Shut down server (delete socket file) if SIGINT received
+	server := &socketServer{
+		model:          model,
+		config:         config,
+		requestTimeout: requestTimeout,
+		idleTimeout:    idleTimeout,
+		maxLineBytes:   maxLineBytes,
+	}
+
+	// Stop accepting, let in-flight requests finish, then delete the socket file
 	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc, os.Interrupt)
-	go func(c chan os.Signal) {
-		sig := <-c
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigc
 		log.Printf("Caught signal %s: shutting down.", sig)
-		l.Close()
-		os.Exit(2)
-	}(sigc)
+		server.shutdown()
+	}()
+
+	if err := server.serve(listener); err != nil {
+		log.Fatalf("Error from serve: %s", err)
+	}
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Error removing %s: %s", socketPath, err)
+	}
+	log.Printf("Shut down.")
+}
+
+// socketServer speaks a line-based protocol: each line from the client is a
+// JSON Body, answered with a line of JSON that's either a Response or, if
+// anything went wrong, an ErrorResponse.  Each connection gets its own
+// goroutine.
+type socketServer struct {
+	model          models.Model
+	config         handlers.Config
+	requestTimeout time.Duration
+	// idleTimeout closes connections that send nothing for this long
+	idleTimeout  time.Duration
+	maxLineBytes int
+
+	// waitCtx is canceled by shutdown, to stop the syncs that are waiting for
+	// changes, which could otherwise hold it up for up to config.MaxWait
+	waitCtx   context.Context
+	stopWaits context.CancelFunc
+
+	mutex        sync.Mutex // for the fields below
+	listener     net.Listener
+	shuttingDown bool
+	conns        map[net.Conn]bool
+	connsDone    sync.WaitGroup
+}
+
+// serve accepts connections until shutdown is called, then waits for the
+// open connections to finish their current request
+func (server *socketServer) serve(listener net.Listener) error {
+	server.mutex.Lock()
+	server.listener = listener
+	server.conns = map[net.Conn]bool{}
+	server.waitCtx, server.stopWaits =
+		context.WithCancel(context.Background())
+	shuttingDown := server.shuttingDown
+	server.mutex.Unlock()
+	if shuttingDown {
+		listener.Close()
+		server.stopWaits()
+	}
 
 	for {
-		fd, err := l.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Fatal("accept error:", err)
+			server.mutex.Lock()
+			shuttingDown := server.shuttingDown
+			server.mutex.Unlock()
+			if shuttingDown {
+				server.connsDone.Wait()
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				log.Printf("Error from Accept: %s", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return fmt.Errorf("Error from Accept: %w", err)
 		}
 
-		scanner := bufio.NewScanner(fd)
-		for scanner.Scan() {
-			bodyJson := scanner.Text()
+		server.mutex.Lock()
+		server.conns[conn] = true
+		server.connsDone.Add(1)
+		server.mutex.Unlock()
+		go server.handleConn(conn)
+	}
+}
 
-			var body handlers.Body
-			if err := json.Unmarshal([]byte(bodyJson), &body); err != nil {
-				l.Close()
-				log.Fatalf("Error parsing JSON %s: %s", bodyJson, err)
-			}
+// shutdown stops serve from accepting connections and makes the open ones
+// close once they've answered the line they're working on, if any.  Syncs
+// waiting for changes are answered with an error, without waiting any
+// longer, like the web server's.
+func (server *socketServer) shutdown() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.shuttingDown = true
+	if server.listener != nil {
+		server.listener.Close()
+		server.stopWaits()
+	}
+	for conn := range server.conns {
+		// Interrupts a connection waiting for its next line
+		conn.SetReadDeadline(time.Now())
+	}
+}
 
-			response, err := handlers.HandleBody(body, model)
-			if err != nil {
-				l.Close()
-				log.Fatalf("Error from HandleBody: %s", err)
-			}
+// waitForLine sets how long conn may take to send its next line, unless the
+// server is shutting down, in which case it returns false
+func (server *socketServer) waitForLine(conn net.Conn) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.shuttingDown {
+		return false
+	}
+	conn.SetReadDeadline(time.Now().Add(server.idleTimeout))
+	return true
+}
 
-			responseJson, err := json.Marshal(response)
-			if err != nil {
-				l.Close()
-				log.Fatalf("Error marshaling JSON %v: %s", response, err)
-			}
-			log.Printf("Response: %s", responseJson)
+func (server *socketServer) handleConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		server.mutex.Lock()
+		delete(server.conns, conn)
+		server.mutex.Unlock()
+		server.connsDone.Done()
+	}()
 
-			_, err = fd.Write(responseJson)
-			if err != nil {
-				l.Close()
-				log.Fatal("Error from Write: ", err)
-			}
+	// Cancel anything still running for this connection once it's done
+	connCtx, cancelConn := context.WithCancel(context.Background())
+	defer cancelConn()
 
-			_, err = fd.Write([]byte("\n"))
-			if err != nil {
-				l.Close()
-				log.Fatal("Error from Write: ", err)
+	// The limit is really the larger of maxLineBytes and the buffer's capacity
+	bufferSize := 4096
+	if bufferSize > server.maxLineBytes {
+		bufferSize = server.maxLineBytes
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, bufferSize), server.maxLineBytes)
+	for server.waitForLine(conn) && scanner.Scan() {
+		response := server.handleLine(connCtx, scanner.Bytes())
+		if err := server.writeLine(conn, response); err != nil {
+			log.Printf("Error writing to socket: %s", err)
+			return
+		}
+	}
+
+	err := scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		// The rest of the line is still unread, so give up on the connection
+		response := handlers.NewErrorResponse(
+			fmt.Errorf("Line longer than %d bytes", server.maxLineBytes))
+		if err := server.writeLine(conn, response); err != nil {
+			log.Printf("Error writing to socket: %s", err)
+		}
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		log.Printf("Closing idle or shut down connection")
+	} else if err != nil {
+		log.Printf("Error reading from socket: %s", err)
+	}
+}
+
+// handleLine returns the Response, or ErrorResponse, to send back
+func (server *socketServer) handleLine(connCtx context.Context,
+	line []byte) interface{} {
+	var body handlers.Body
+	if err := json.Unmarshal(line, &body); err != nil {
+		log.Printf("Error parsing JSON %s: %s", line, err)
+		return handlers.NewErrorResponse(fmt.Errorf("Error parsing JSON: %w", err))
+	}
+
+	ctx, cancel := context.WithTimeout(connCtx,
+		server.requestTimeout+server.config.Wait(body))
+	defer cancel()
+	if server.config.Wait(body) > 0 {
+		go func() {
+			select {
+			case <-server.waitCtx.Done():
+				cancel()
+			case <-ctx.Done():
 			}
-		} // scan next line
-	} // endless loop of accepting more connections
+		}()
+	}
+	response, err := handlers.HandleBody(ctx, body, server.model, server.config)
+	if err != nil {
+		log.Printf("Error from HandleBody: %s", err)
+		return handlers.NewErrorResponse(err)
+	}
+	return response
+}
 
-} // end mustRunSocketServer
+func (server *socketServer) writeLine(conn net.Conn,
+	response interface{}) error {
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("Error marshaling JSON %v: %w", response, err)
+	}
+	log.Printf("Response: %v", response)
+
+	// Don't let a client that stopped reading hold up shutdown forever
+	conn.SetWriteDeadline(time.Now().Add(server.idleTimeout))
+	if _, err := conn.Write(append(responseJson, '\n')); err != nil {
+		return fmt.Errorf("Error from Write: %w", err)
+	}
+	return nil
+}
 
 func handleRequest(writer http.ResponseWriter, request *http.Request,
-	model models.Model) {
+	pushCtx context.Context, model models.Model, config handlers.Config,
+	requestTimeout time.Duration) {
 	// Set Access-Control-Allow-Origin for all requests
 	writer.Header().Set("Access-Control-Allow-Origin", "*")
 
@@ -96,7 +301,8 @@ func handleRequest(writer http.ResponseWriter, request *http.Request,
 	case "GET":
 		writer.Write([]byte("This API expects POST requests"))
 	case "OPTIONS":
-		writer.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		writer.Header().Set("Access-Control-Allow-Headers",
+			"Content-Type, Authorization")
 		writer.Write([]byte("OK"))
 	case "POST":
 		var body handlers.Body
@@ -106,11 +312,28 @@ func handleRequest(writer http.ResponseWriter, request *http.Request,
 				http.StatusBadRequest)
 			return
 		}
+		if token, err := bearerToken(request); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		} else if token != "" {
+			body.Token = token
+		}
 
-		response, err := handlers.HandleBody(body, model)
+		// The request's context is also canceled if the client disconnects
+		ctx, cancel := context.WithTimeout(request.Context(),
+			requestTimeout+config.Wait(body))
+		defer cancel()
+		go func() {
+			select {
+			case <-pushCtx.Done():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		response, err := handlers.HandleBody(ctx, body, model, config)
 		if err != nil {
-			http.Error(writer, fmt.Sprintf("Error from HandleBody: %s", err),
-				http.StatusBadRequest)
+			writeHandlerError(writer, fmt.Errorf("Error from HandleBody: %w", err))
 			return
 		}
 
@@ -129,3 +352,379 @@ func handleRequest(writer http.ResponseWriter, request *http.Request,
 		return
 	}
 }
+
+const pushPingInterval = 30 * time.Second
+
+var pushUpgrader = websocket.Upgrader{
+	// Like the other requests, allowed from any origin, since they need a
+	// token anyway
+	CheckOrigin: func(request *http.Request) bool { return true },
+}
+
+// handlePushRequest upgrades to a WebSocket, whose first message from the
+// client is a JSON Body with the device's token and optionally a cursor.  The
+// server answers with the Response to it, then with another Response of the
+// changes since every time another device changes something the device can
+// see.  Errors are sent as an ErrorResponse before closing.
+func handlePushRequest(writer http.ResponseWriter, request *http.Request,
+	pushCtx context.Context, model models.Model, config handlers.Config,
+	requestTimeout time.Duration, pingInterval time.Duration) {
+	conn, err := pushUpgrader.Upgrade(writer, request, nil)
+	if err != nil {
+		// Upgrade already answered the request
+		log.Printf("Error from Upgrade: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	// Stops when the client goes away or the server shuts down
+	ctx, cancel := context.WithCancel(pushCtx)
+	defer cancel()
+
+	var body handlers.Body
+	conn.SetReadDeadline(time.Now().Add(requestTimeout))
+	if err := conn.ReadJSON(&body); err != nil {
+		log.Printf("Error from ReadJSON: %s", err)
+		writePush(conn, handlers.NewErrorResponse(
+			fmt.Errorf("Error parsing JSON: %w", err)), pingInterval)
+		return
+	}
+	startCtx, cancelStart := context.WithTimeout(ctx, requestTimeout)
+	session, response, err := handlers.StartPushSession(startCtx, body, model,
+		config)
+	cancelStart()
+	if err != nil {
+		log.Printf("Error from StartPushSession: %s", err)
+		writePush(conn, handlers.NewErrorResponse(err), pingInterval)
+		return
+	}
+	defer session.Close()
+	if err := writePush(conn, response, pingInterval); err != nil {
+		log.Printf("Error writing push: %s", err)
+		return
+	}
+
+	// The client sends nothing else, but reading notices when it closes, and
+	// handles its pongs, which it must send at least every pingInterval
+	conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// WriteControl is safe to call alongside writePush
+				if err := conn.WriteControl(websocket.PingMessage, nil,
+					time.Now().Add(pingInterval)); err != nil {
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		response, err := session.Next(ctx)
+		if ctx.Err() != nil {
+			log.Printf("Closing push connection")
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+				time.Now().Add(time.Second))
+			return
+		} else if err != nil {
+			log.Printf("Error from Next: %s", err)
+			writePush(conn, handlers.NewErrorResponse(err), pingInterval)
+			return
+		}
+		if err := writePush(conn, response, pingInterval); err != nil {
+			log.Printf("Error writing push: %s", err)
+			return
+		}
+	}
+}
+
+func writePush(conn *websocket.Conn, response interface{},
+	writeTimeout time.Duration) error {
+	log.Printf("Push: %v", response)
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := conn.WriteJSON(response); err != nil {
+		return fmt.Errorf("Error from WriteJSON: %w", err)
+	}
+	return nil
+}
+
+// handleStreamTokenRequest answers a POST of a JSON Body with the device's
+// token in the Authorization header with {"streamToken": "..."}, for opening
+// one /events stream within handlers.StreamTokenTtl
+func handleStreamTokenRequest(writer http.ResponseWriter,
+	request *http.Request, model models.Model, requestTimeout time.Duration) {
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch request.Method {
+	case "OPTIONS":
+		writer.Header().Set("Access-Control-Allow-Headers",
+			"Content-Type, Authorization")
+		writer.Write([]byte("OK"))
+	case "POST":
+		var body handlers.Body
+		decoder := json.NewDecoder(request.Body)
+		if err := decoder.Decode(&body); err != nil {
+			http.Error(writer, fmt.Sprintf("Error parsing JSON: %s", err),
+				http.StatusBadRequest)
+			return
+		}
+		if token, err := bearerToken(request); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		} else if token != "" {
+			body.Token = token
+		}
+
+		ctx, cancel := context.WithTimeout(request.Context(), requestTimeout)
+		defer cancel()
+		streamToken, err := handlers.IssueStreamToken(ctx, body, model)
+		if err != nil {
+			writeHandlerError(writer,
+				fmt.Errorf("Error from IssueStreamToken: %w", err))
+			return
+		}
+
+		responseBytes, err := json.Marshal(map[string]string{
+			"streamToken": streamToken,
+		})
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Error marshaling JSON: %s", err),
+				http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(responseBytes)
+	default:
+		http.Error(writer, fmt.Sprintf("HTTP method not allowed"),
+			http.StatusMethodNotAllowed)
+	}
+}
+
+// handleEventsRequest streams Server-Sent Events for the changes to the todos
+// a device can see: first those since the cursor, or every todo, then the
+// ones other devices make.  The device is given by the deviceUid query
+// parameter, and authenticated by the streamToken one, from
+// handleStreamTokenRequest, or else the Authorization header.  The device's
+// own token isn't taken from the query, since URLs get logged.  The cursor
+// is given by the Last-Event-ID header, so reconnecting EventSources resume
+// where they left off, or else the cursor query parameter.  Each event is a
+// handlers.ChangeEvent, named by its Type; the event ids are cursors.
+func handleEventsRequest(writer http.ResponseWriter, request *http.Request,
+	pushCtx context.Context, model models.Model, config handlers.Config,
+	requestTimeout time.Duration, pingInterval time.Duration) {
+	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	if request.Method != "GET" {
+		http.Error(writer, fmt.Sprintf("HTTP method not allowed"),
+			http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "Streaming not supported",
+			http.StatusInternalServerError)
+		return
+	}
+
+	query := request.URL.Query()
+	body := handlers.Body{DeviceUid: query.Get("deviceUid")}
+	if streamToken := query.Get("streamToken"); streamToken != "" {
+		tokenCtx, cancelToken := context.WithTimeout(request.Context(),
+			requestTimeout)
+		var err error
+		body, err = handlers.StreamTokenBody(tokenCtx, body.DeviceUid,
+			streamToken, model)
+		cancelToken()
+		if err != nil {
+			writeHandlerError(writer,
+				fmt.Errorf("Error from StreamTokenBody: %w", err))
+			return
+		}
+	} else if token, err := bearerToken(request); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	} else {
+		body.Token = token
+	}
+	cursorString := request.Header.Get("Last-Event-ID")
+	if cursorString == "" {
+		cursorString = query.Get("cursor")
+	}
+	if cursorString != "" {
+		cursor, err := strconv.Atoi(cursorString)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("Bad cursor %q", cursorString),
+				http.StatusBadRequest)
+			return
+		}
+		body.Cursor = &cursor
+	}
+
+	// Stops when the client goes away or the server shuts down
+	ctx, cancel := context.WithCancel(pushCtx)
+	defer cancel()
+	go func() {
+		select {
+		case <-request.Context().Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	startCtx, cancelStart := context.WithTimeout(ctx, requestTimeout)
+	session, response, err := handlers.StartPushSession(startCtx, body, model,
+		config)
+	cancelStart()
+	if err != nil {
+		writeHandlerError(writer,
+			fmt.Errorf("Error from StartPushSession: %w", err))
+		return
+	}
+	defer session.Close()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	responses := make(chan *handlers.Response, 1)
+	responses <- response
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			response, err := session.Next(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case responses <- response:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	cursor := 0
+	if body.Cursor != nil {
+		cursor = *body.Cursor
+	}
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case response := <-responses:
+			if err := writeChangeEvents(writer, response, cursor); err != nil {
+				log.Printf("Error writing events: %s", err)
+				return
+			}
+			cursor = response.Cursor
+		case <-ticker.C:
+			// A comment, which keeps proxies from timing out the stream
+			if _, err := writer.Write([]byte(": ping\n\n")); err != nil {
+				log.Printf("Error writing ping: %s", err)
+				return
+			}
+		case err := <-errs:
+			if ctx.Err() == nil {
+				// The client will reconnect, and get the error then if it's lasting
+				log.Printf("Error from Next: %s", err)
+			}
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeChangeEvents writes an event for each change in the response to a
+// body with the cursor, then sets the last event id to the response's cursor
+// (without another event), so that clients cut off partway resume from
+// before the response
+func writeChangeEvents(writer io.Writer, response *handlers.Response,
+	cursor int) error {
+	log.Printf("Events for: %v", response)
+	for _, event := range handlers.ChangeEvents(response, cursor) {
+		eventJson, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("Error marshaling JSON %v: %w", event, err)
+		}
+		if _, err := fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Type,
+			eventJson); err != nil {
+			return fmt.Errorf("Error from Fprintf: %w", err)
+		}
+	}
+	if _, err := fmt.Fprintf(writer, "id: %d\n\n", response.Cursor); err != nil {
+		return fmt.Errorf("Error from Fprintf: %w", err)
+	}
+	return nil
+}
+
+func handleAdminResetRequest(writer http.ResponseWriter, request *http.Request,
+	model models.Model, config handlers.Config, requestTimeout time.Duration) {
+	if request.Method != "POST" {
+		http.Error(writer, fmt.Sprintf("HTTP method not allowed"),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := bearerToken(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), requestTimeout)
+	defer cancel()
+
+	record, err := handlers.AdminResetModel(ctx, token, model, config)
+	if err != nil {
+		writeHandlerError(writer, fmt.Errorf("Error from AdminResetModel: %w", err))
+		return
+	}
+
+	responseBytes, err := json.Marshal(record)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Error marshaling JSON %v: %s", record, err),
+			http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(responseBytes)
+}
+
+// bearerToken returns the token from the Authorization header, or blank if
+// there's no header
+func bearerToken(request *http.Request) (string, error) {
+	authorization := request.Header.Get("Authorization")
+	if authorization == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return "", fmt.Errorf("Authorization header should be 'Bearer <token>'")
+	}
+	return strings.TrimPrefix(authorization, "Bearer "), nil
+}
+
+func writeHandlerError(writer http.ResponseWriter, err error) {
+	status := handlers.StatusCodeForError(err)
+	if status == http.StatusServiceUnavailable {
+		writer.Header().Set("Retry-After", "1")
+	} else if status == http.StatusUnauthorized {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	http.Error(writer, err.Error(), status)
+}
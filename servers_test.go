@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/danielstutzman/todomvc-backend-go/handlers"
+	"github.com/danielstutzman/todomvc-backend-go/models"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSocketServer returns the server, its socket path, and a channel that
+// gets serve's result
+func startSocketServer(t *testing.T, config handlers.Config,
+	idleTimeout time.Duration, maxLineBytes int) (*socketServer, string,
+	chan error) {
+	dir, err := ioutil.TempDir("", "servers_test")
+	if err != nil {
+		t.Fatalf("Error from TempDir: %s", err)
+	}
+	socketPath := filepath.Join(dir, "test.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Error from Listen: %s", err)
+	}
+
+	server := &socketServer{
+		model:          models.NewMemoryModel(),
+		config:         config,
+		requestTimeout: time.Second,
+		idleTimeout:    idleTimeout,
+		maxLineBytes:   maxLineBytes,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.serve(listener)
+		os.RemoveAll(dir)
+	}()
+	return server, socketPath, served
+}
+
+func dialSocket(t *testing.T, socketPath string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Error from Dial: %s", err)
+	}
+	return conn, bufio.NewReader(conn)
+}
+
+func sendLine(t *testing.T, conn net.Conn, reader *bufio.Reader,
+	line string) map[string]interface{} {
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		t.Fatalf("Error from Write: %s", err)
+	}
+	responseJson, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("Error from ReadBytes: %s", err)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(responseJson, &response); err != nil {
+		t.Fatalf("Error parsing JSON %s: %s", responseJson, err)
+	}
+	return response
+}
+
+const registerLine = `{"deviceUid": "A", "userUid": "U", "register": true}`
+
+func TestSocketServerAnswersMalformedJson(t *testing.T) {
+	server, socketPath, _ := startSocketServer(t, handlers.Config{},
+		time.Minute, 1024)
+	defer server.shutdown()
+	conn, reader := dialSocket(t, socketPath)
+	defer conn.Close()
+
+	response := sendLine(t, conn, reader, `{"deviceUid": `)
+	assert.Equal(t, float64(400), response["status"])
+
+	// The connection is still usable
+	response = sendLine(t, conn, reader, registerLine)
+	assert.NotEqual(t, nil, response["token"])
+}
+
+func TestSocketServerAnswersHandleBodyErrors(t *testing.T) {
+	server, socketPath, _ := startSocketServer(t, handlers.Config{},
+		time.Minute, 1024)
+	defer server.shutdown()
+	conn, reader := dialSocket(t, socketPath)
+	defer conn.Close()
+
+	response := sendLine(t, conn, reader, `{"deviceUid": "A"}`)
+	assert.Equal(t, float64(401), response["status"])
+	assert.Equal(t, false, response["retriable"])
+}
+
+func TestSocketServerRejectsLongLines(t *testing.T) {
+	server, socketPath, _ := startSocketServer(t, handlers.Config{},
+		time.Minute, 100)
+	defer server.shutdown()
+	conn, reader := dialSocket(t, socketPath)
+	defer conn.Close()
+
+	response := sendLine(t, conn, reader,
+		`{"deviceUid": "`+strings.Repeat("A", 200)+`"}`)
+	assert.Equal(t, "Line longer than 100 bytes", response["error"])
+	_, err := reader.ReadBytes('\n')
+	assert.Error(t, err)
+}
+
+func TestSocketServerConcurrentConnections(t *testing.T) {
+	server, socketPath, _ := startSocketServer(t, handlers.Config{},
+		time.Minute, 1024)
+	defer server.shutdown()
+
+	// An idle connection doesn't hold up the next one
+	idleConn, _ := dialSocket(t, socketPath)
+	defer idleConn.Close()
+	conn, reader := dialSocket(t, socketPath)
+	defer conn.Close()
+
+	response := sendLine(t, conn, reader, registerLine)
+	assert.NotEqual(t, nil, response["token"])
+}
+
+func TestSocketServerClosesIdleConnections(t *testing.T) {
+	server, socketPath, _ := startSocketServer(t, handlers.Config{},
+		50*time.Millisecond, 1024)
+	defer server.shutdown()
+	conn, reader := dialSocket(t, socketPath)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := reader.ReadBytes('\n')
+	assert.Error(t, err)
+	netErr, isNetErr := err.(net.Error)
+	assert.Equal(t, false, isNetErr && netErr.Timeout())
+}
+
+func TestSocketServerShutdown(t *testing.T) {
+	server, socketPath, served := startSocketServer(t, handlers.Config{},
+		time.Minute, 1024)
+	conn, reader := dialSocket(t, socketPath)
+	defer conn.Close()
+	sendLine(t, conn, reader, registerLine)
+
+	server.shutdown()
+	select {
+	case err := <-served:
+		assert.Equal(t, nil, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after shutdown")
+	}
+
+	// The open connection was closed, and new ones are refused
+	_, err := reader.ReadBytes('\n')
+	assert.Error(t, err)
+	_, err = net.Dial("unix", socketPath)
+	assert.Error(t, err)
+}
+
+func TestSocketServerShutdownStopsWaitingSyncs(t *testing.T) {
+	server, socketPath, served := startSocketServer(t,
+		handlers.Config{Hub: handlers.NewHub(), MaxWait: time.Minute},
+		time.Minute, 1024)
+	conn, reader := dialSocket(t, socketPath)
+	defer conn.Close()
+	registered := sendLine(t, conn, reader, registerLine)
+
+	waitLine := fmt.Sprintf(`{"deviceUid": "A", "token": %q, "cursor": %v, `+
+		`"waitMillis": 60000}`, registered["token"], registered["cursor"])
+	if _, err := conn.Write([]byte(waitLine + "\n")); err != nil {
+		t.Fatalf("Error from Write: %s", err)
+	}
+	// Let the sync start waiting
+	time.Sleep(100 * time.Millisecond)
+
+	server.shutdown()
+	select {
+	case err := <-served:
+		assert.Equal(t, nil, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after shutdown")
+	}
+
+	// It was answered, and the client can try again elsewhere
+	responseJson, err := reader.ReadBytes('\n')
+	assert.Equal(t, nil, err)
+	var response map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(responseJson, &response))
+	assert.Equal(t, float64(503), response["status"])
+	assert.Equal(t, true, response["retriable"])
+}
+
+// startPushServer returns the URL of a push endpoint, and a function that
+// stops the server
+func startPushServer(t *testing.T, model models.Model,
+	config handlers.Config) (string, func()) {
+	pushCtx, stopPushes := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handlePushRequest(w, r, pushCtx, model, config, time.Second, time.Second)
+		}))
+	return "ws" + strings.TrimPrefix(server.URL, "http"), func() {
+		stopPushes()
+		server.Close()
+	}
+}
+
+func readPush(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var response map[string]interface{}
+	if err := conn.ReadJSON(&response); err != nil {
+		t.Fatalf("Error from ReadJSON: %s", err)
+	}
+	return response
+}
+
+func TestPushServer(t *testing.T) {
+	model := models.NewMemoryModel()
+	config := handlers.Config{Hub: handlers.NewHub()}
+	url, stop := startPushServer(t, model, config)
+	defer stop()
+	registered := map[string]*handlers.Response{}
+	for _, deviceUid := range []string{"A", "B"} {
+		body := handlers.Body{DeviceUid: deviceUid, UserUid: "U", Register: true}
+		if deviceUid == "B" {
+			body.Token = registered["A"].Token
+		}
+		response, err := handlers.HandleBody(context.Background(), body, model,
+			config)
+		if err != nil {
+			t.Fatalf("Error from HandleBody: %s", err)
+		}
+		registered[deviceUid] = response
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Error from Dial: %s", err)
+	}
+	defer conn.Close()
+	conn.WriteJSON(handlers.Body{DeviceUid: "A", Token: registered["A"].Token})
+	response := readPush(t, conn)
+	assert.Equal(t, []interface{}{}, response["todos"])
+
+	title := "pushed"
+	completed := false
+	_, err = handlers.HandleBody(context.Background(), handlers.Body{
+		DeviceUid: "B",
+		Token:     registered["B"].Token,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1, Title: &title,
+				Completed: &completed},
+		},
+	}, model, config)
+	assert.Equal(t, nil, err)
+	response = readPush(t, conn)
+	todos := response["todos"].([]interface{})
+	assert.Equal(t, 1, len(todos))
+	assert.Equal(t, title, todos[0].(map[string]interface{})["title"])
+
+	// Stopping the server closes the connection
+	stop()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	assert.Equal(t, true, websocket.IsCloseError(err, websocket.CloseGoingAway))
+}
+
+func TestPushServerAnswersErrors(t *testing.T) {
+	url, stop := startPushServer(t, models.NewMemoryModel(),
+		handlers.Config{Hub: handlers.NewHub()})
+	defer stop()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Error from Dial: %s", err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(handlers.Body{DeviceUid: "A", Token: "wrong"})
+	response := readPush(t, conn)
+	assert.Equal(t, float64(401), response["status"])
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+}
+
+// readEvent returns the next Server-Sent Event's fields
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	fields := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error from ReadString: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fields
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		fields[parts[0]] = parts[1]
+	}
+}
+
+func TestEventsServer(t *testing.T) {
+	model := models.NewMemoryModel()
+	config := handlers.Config{Hub: handlers.NewHub()}
+	pushCtx, stopPushes := context.WithCancel(context.Background())
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleEventsRequest(w, r, pushCtx, model, config, time.Second,
+				time.Minute)
+		}))
+	defer server.Close()
+	defer stopPushes()
+
+	title := "first"
+	completed := false
+	registered, err := handlers.HandleBody(context.Background(), handlers.Body{
+		DeviceUid: "A",
+		UserUid:   "U",
+		Register:  true,
+		ActionsToSync: []models.ActionToSync{
+			{Id: 1, Type: "TODOS/ADD_TODO", TodoIdMaybeTemp: -1, Title: &title,
+				Completed: &completed},
+		},
+	}, model, config)
+	if err != nil {
+		t.Fatalf("Error from HandleBody: %s", err)
+	}
+	sync := func(actionToSync models.ActionToSync) {
+		_, err := handlers.HandleBody(context.Background(), handlers.Body{
+			DeviceUid:     "A",
+			Token:         registered.Token,
+			ActionsToSync: []models.ActionToSync{actionToSync},
+		}, model, config)
+		assert.Equal(t, nil, err)
+	}
+
+	// A device of the same user follows the changes
+	registeredB, err := handlers.HandleBody(context.Background(), handlers.Body{
+		DeviceUid: "B",
+		UserUid:   "U",
+		Register:  true,
+		Token:     registered.Token,
+	}, model, config)
+	if err != nil {
+		t.Fatalf("Error from HandleBody: %s", err)
+	}
+	// The device's own token isn't accepted in the URL
+	response, err := http.Get(server.URL + "?deviceUid=B&token=" +
+		registeredB.Token)
+	if err != nil {
+		t.Fatalf("Error from Get: %s", err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	openEvents := func(lastEventId string) (*http.Response, *bufio.Reader) {
+		streamToken, err := handlers.IssueStreamToken(context.Background(),
+			handlers.Body{DeviceUid: "B", Token: registeredB.Token}, model)
+		if err != nil {
+			t.Fatalf("Error from IssueStreamToken: %s", err)
+		}
+		request, _ := http.NewRequest("GET",
+			server.URL+"?deviceUid=B&streamToken="+streamToken, nil)
+		if lastEventId != "" {
+			request.Header.Set("Last-Event-ID", lastEventId)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error from Do: %s", err)
+		}
+		return response, bufio.NewReader(response.Body)
+	}
+	response, reader := openEvents("")
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+	event := readEvent(t, reader)
+	assert.Equal(t, "created", event["event"])
+	assert.Equal(t, true, strings.Contains(event["data"], `"title":"first"`))
+	firstId := readEvent(t, reader)["id"]
+
+	updated := "second"
+	sync(models.ActionToSync{Id: 2, Type: "TODO/UPDATE_TODO",
+		TodoIdMaybeTemp: 1, Title: &updated})
+	event = readEvent(t, reader)
+	assert.Equal(t, "updated", event["event"])
+	assert.Equal(t, true, strings.Contains(event["data"], `"title":"second"`))
+	readEvent(t, reader)
+	response.Body.Close()
+
+	// Reconnecting resumes from the last event id
+	sync(models.ActionToSync{Id: 3, Type: "TODOS/DELETE_TODO",
+		TodoIdMaybeTemp: 1})
+	response, reader = openEvents(firstId)
+	defer response.Body.Close()
+	event = readEvent(t, reader)
+	assert.Equal(t, "deleted", event["event"])
+	assert.Equal(t, true, strings.HasPrefix(event["data"], `{"todoId":1,`))
+	assert.NotEqual(t, firstId, readEvent(t, reader)["id"])
+
+	// Lists too
+	name := "list"
+	tempListId, listId := -1, 1
+	sync(models.ActionToSync{Id: 4, Type: "LISTS/ADD_LIST",
+		ListIdMaybeTemp: &tempListId, Name: &name})
+	event = readEvent(t, reader)
+	assert.Equal(t, "listUpdated", event["event"])
+	assert.Equal(t, true, strings.Contains(event["data"], `"name":"list"`))
+	readEvent(t, reader)
+	sync(models.ActionToSync{Id: 5, Type: "LISTS/DELETE_LIST",
+		ListIdMaybeTemp: &listId})
+	event = readEvent(t, reader)
+	assert.Equal(t, "listDeleted", event["event"])
+	assert.Equal(t, true, strings.HasPrefix(event["data"], `{"listId":1,`))
+}
+
+func TestStreamTokenServer(t *testing.T) {
+	model := models.NewMemoryModel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handleStreamTokenRequest(w, r, model, time.Second)
+		}))
+	defer server.Close()
+
+	registered, err := handlers.HandleBody(context.Background(), handlers.Body{
+		DeviceUid: "A",
+		UserUid:   "U",
+		Register:  true,
+	}, model, handlers.Config{})
+	if err != nil {
+		t.Fatalf("Error from HandleBody: %s", err)
+	}
+	post := func(token string) *http.Response {
+		request, _ := http.NewRequest("POST", server.URL,
+			strings.NewReader(`{"deviceUid":"A"}`))
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error from Do: %s", err)
+		}
+		return response
+	}
+
+	response := post("guessed")
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	response = post(registered.Token)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	var decoded map[string]string
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		t.Fatalf("Error from Decode: %s", err)
+	}
+	_, err = handlers.StreamTokenBody(context.Background(), "A",
+		decoded["streamToken"], model)
+	assert.Equal(t, nil, err)
+}
@@ -1,2 +1,3 @@
 #!/bin/bash -ex
-echo '{"DeviceUid": "test"}' | curl -d @- http://localhost:3000/
+# A new user each run, since only servers in -test_mode allow ResetModel
+echo "{\"DeviceUid\": \"test-$$\", \"UserUid\": \"test-$$\", \"Register\": true}" | curl -d @- http://localhost:3000/